@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
 
@@ -17,9 +18,10 @@ var CheckCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		if model == "" || region == "" {
 			fmt.Println("错误: --model 和 --region 是必需的。")
-			os.Exit(1)
+			os.Exit(ExitUsage)
 		}
-		checkLatestVersion(model, region)
+		_, err := checkLatestVersion(commandContext(cmd), model, region)
+		exitOnError(err)
 	},
 }
 
@@ -37,17 +39,17 @@ func init() {
 	// checkCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
 
-func checkLatestVersion(model, region string) string {
+func checkLatestVersion(ctx context.Context, model, region string) (string, error) {
 	fmt.Printf("Checking latest version for Model: %s, Region: %s\n", model, region)
-	result := versionfetch.GetLatestVersion(model, region)
+	result := versionfetch.GetLatestVersionWithOptions(ctx, clientOptions(), model, region)
 
 	if result.Error != nil {
 		fmt.Printf("Error checking version: %v\n", result.Error)
 		fmt.Printf("Raw output: %s\n", result.RawOutput)
-		return "" // Return empty string on error
+		return "", result.Error // Return empty string on error
 	}
 
 	fmt.Printf("Latest Firmware Version: %s\n", result.VersionCode)
 	fmt.Printf("Android Version: %s\n", result.AndroidVersion)
-	return result.VersionCode // Return the firmware version
+	return result.VersionCode, nil // Return the firmware version
 }
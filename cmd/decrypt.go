@@ -1,37 +1,106 @@
 package cmd
 
 import (
-	"errors"
+	"bytes"
+	"context"
+	"crypto/aes"
 	"fmt"
+	"io"
 	"os"
+	"strings"
 
 	"samsung-firmware-tool/internal/cryptutils"
+	"samsung-firmware-tool/internal/diskspace"
 	"samsung-firmware-tool/internal/fusclient"
+	"samsung-firmware-tool/internal/fuserr"
+	"samsung-firmware-tool/internal/progress"
 	"samsung-firmware-tool/internal/request"
-	"samsung-firmware-tool/internal/util"
 
 	"github.com/spf13/cobra"
 )
 
+var (
+	// decryptWorkers is the number of goroutines that decrypt in parallel.
+	decryptWorkers int
+
+	decryptList bool
+	decryptOnly string
+	decryptTest bool
+)
+
+// firmwareStdout is where an output path of "-" writes the firmware. It is
+// the original stdout, as decrypt -o - moves all messages to stderr.
+var firmwareStdout io.Writer = os.Stdout
+
 // DecryptCmd represents the decrypt command
 var DecryptCmd = &cobra.Command{
 	Use:   "decrypt",
 	Short: "Decrypt firmware",
-	Long:  `This command decrypts a firmware file using the provided firmware version, model, region, and IMEI/Serial number.`,
+	Long: `This command decrypts a firmware file using the provided firmware version, model, region, and IMEI/Serial number.
+
+Pass - as --input to read the encrypted file from stdin and as --output to write the decrypted zip to stdout, e.g.
+  cat fw.zip.enc4 | samloadGo decrypt ... -p - -o - | bsdtar -x
+
+--list shows the files in the firmware zip and --only CSC,BL extracts just those files into the --output directory, both without decrypting the rest of the file.
+
+The key is chosen by the extension of --input (.enc2 or .enc4), or by trying both on the first block for other names. A wrong key fails before anything is written. --test reads every file of the decrypted zip afterwards to check its CRC32.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		if decryptList {
+			if inputFile == "" || fwVersion == "" || model == "" || region == "" || imeiSerial == "" {
+				fmt.Println("错误: --input, --fw, --model, --region, 和 --imei 是列出固件内容所必需的。")
+				os.Exit(ExitUsage)
+			}
+			err := ListFirmware(commandContext(cmd), inputFile, fwVersion, model, region, imeiSerial)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+			exitOnError(err)
+			return
+		}
 		if inputFile == "" || outputFile == "" || fwVersion == "" || model == "" || region == "" || imeiSerial == "" {
 			fmt.Println("错误: --input, --output, --fw, --model, --region, 和 --imei 是解码固件所必需的。")
-			os.Exit(1)
+			os.Exit(ExitUsage)
+		}
+		if decryptTest && outputFile == "-" {
+			fmt.Println("错误: --test 需要输出到文件。")
+			os.Exit(ExitUsage)
 		}
-		progressCallback := func(current, max, bps int64) {
-			fmt.Printf("\rDecrypting: %d/%d bytes (%.2f%%) @ %d B/s", current, max, float64(current)/float64(max)*100, bps)
+		if outputFile == "-" {
+			// Keep stdout clean for the firmware.
+			os.Stdout = os.Stderr
 		}
-		DecryptFirmware(inputFile, outputFile, fwVersion, model, region, imeiSerial, progressCallback)
+		if only := parseOnly(decryptOnly); len(only) > 0 {
+			if inputFile == "-" || outputFile == "-" {
+				fmt.Println("错误: --only 需要文件输入和输出目录。")
+				os.Exit(ExitUsage)
+			}
+			progressCallback := progress.NewTerminal(os.Stdout).Callback(progress.PhaseExtract)
+			err := ExtractFirmware(commandContext(cmd), inputFile, outputFile, fwVersion, model, region, imeiSerial, only, progressCallback)
+			if err != nil {
+				fmt.Printf("\nError: %v\n", err)
+			}
+			exitOnError(err)
+			return
+		}
+		cryptutils.SetDecryptWorkers(decryptWorkers)
+		term := progress.NewTerminal(os.Stdout)
+		err := DecryptFirmware(commandContext(cmd), inputFile, outputFile, fwVersion, model, region, imeiSerial, term.Callback(progress.PhaseDecrypt))
+		if err == nil && decryptTest {
+			err = VerifyFirmwareZip(commandContext(cmd), outputFile, term.Callback(progress.PhaseVerify))
+			if err != nil {
+				fmt.Printf("\nError: %v\n", err)
+			}
+		}
+		exitOnError(err)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(DecryptCmd)
+	DecryptCmd.Flags().IntVar(&decryptWorkers, "workers", 0, T("decrypt_workers_desc"))
+	DecryptCmd.Flags().BoolVar(&decryptList, "list", false, T("decrypt_list_desc"))
+	DecryptCmd.Flags().StringVar(&decryptOnly, "only", "", T("decrypt_only_desc"))
+	DecryptCmd.Flags().BoolVar(&decryptTest, "test", false, T("decrypt_test_desc"))
 
 	// Here you will define your flags and configuration settings.
 
@@ -44,73 +113,171 @@ func init() {
 	// decryptCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
 
-func DecryptFirmware(inputPath, outputPath, fwVersion, model, region, imeiSerial string, progressCallback ProgressCallback) error {
+func DecryptFirmware(ctx context.Context, inputPath, outputPath, fwVersion, model, region, imeiSerial string, progressCallback ProgressCallback) error {
 	fmt.Printf("Decrypting %s to %s\n", inputPath, outputPath)
 
-	client := fusclient.NewFusClient()
-
-	onFinish := func(msg string) {
-		fmt.Println(msg)
+	keys, err := firmwareKeys(ctx, inputPath, fwVersion, model, region, imeiSerial)
+	if err != nil {
+		return err
 	}
-	onVersionException := func(err error, info *request.BinaryFileInfo) {
-		fmt.Printf("Version exception: %v\n", err)
-		if info != nil {
-			fmt.Printf("Binary File Info: %+v\n", *info)
+
+	var input io.Reader = os.Stdin
+	var fileSize int64 // Unknown for stdin
+	if inputPath != "-" {
+		inputFile, err := os.Open(inputPath)
+		if err != nil {
+			fmt.Printf("Error opening input file: %v\n", err)
+			return fuserr.Wrap(fuserr.CodeDisk, err, "error opening input file")
 		}
-	}
-	shouldReportError := func(err error) bool {
-		return true // For now, always report
-	}
+		defer inputFile.Close()
 
-	binaryInfo := request.RetrieveBinaryFileInfo(fwVersion, model, region, imeiSerial, client, onFinish, onVersionException, shouldReportError)
-	if binaryInfo == nil {
-		fmt.Println("Failed to retrieve binary file information for decryption key.")
-		return errors.New("failed to retrieve binary file information for decryption key")
+		inputStat, err := inputFile.Stat()
+		if err != nil {
+			fmt.Printf("Error getting input file info: %v\n", err)
+			return fuserr.Wrap(fuserr.CodeDisk, err, "error getting input file info")
+		}
+		input = inputFile
+		fileSize = inputStat.Size()
 	}
 
-	var decryptionKey []byte
-	var decryptionKeyStr string
-
-	// Determine decryption key based on file extension or other info
-	// Kotlin code uses .enc4 and .enc2. We need to infer this.
-	// For simplicity, let's assume if V4Key is present, use it, otherwise use V2Key.
-	if binaryInfo.V4Key != nil {
-		decryptionKey = binaryInfo.V4Key
-		decryptionKeyStr = binaryInfo.V4KeyStr
-		fmt.Println("Using V4 decryption key.")
-	} else {
-		decryptionKey, decryptionKeyStr = cryptutils.GetV2Key(fwVersion, model, region)
-		fmt.Println("Using V2 decryption key.")
+	// Pick the key by the first block, which also catches a wrong key
+	// before anything is written, and put the block back in front.
+	first, err := readFirstBlock(input)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return err
 	}
-
-	fmt.Printf("Decryption Key (MD5): %x\n", decryptionKey)
-	fmt.Printf("Decryption Key (String): %s\n", decryptionKeyStr)
-
-	inputFile, err := os.Open(inputPath)
+	decryptionKey, err := selectKey(keys, first)
 	if err != nil {
-		fmt.Printf("Error opening input file: %v\n", err)
-		return fmt.Errorf("error opening input file: %v", err)
+		fmt.Printf("Error: %v\n", err)
+		return err
+	}
+	input = io.MultiReader(bytes.NewReader(first), input)
+
+	if outputPath == "-" {
+		err = cryptutils.DecryptProgress(ctx, input, firmwareStdout, decryptionKey, fileSize, cryptutils.DecryptChunkSize, progressCallback)
+		if err != nil {
+			fmt.Printf("\nError decrypting file: %v\n", err)
+			return fmt.Errorf("error decrypting file: %w", err)
+		}
+		fmt.Println("\nDecryption complete.")
+		return nil
 	}
-	defer inputFile.Close()
 
-	outputFile, err := os.Create(outputPath)
+	// Decrypt into a temporary file that only gets the output name once it
+	// is complete, so a failure never leaves a truncated zip behind.
+	tmpPath := outputPath + ".tmp"
+	outputFile, err := os.Create(tmpPath)
 	if err != nil {
 		fmt.Printf("Error creating output file: %v\n", err)
-		return fmt.Errorf("error creating output file: %v", err)
+		return fuserr.Wrap(fuserr.CodeDisk, err, "error creating output file")
 	}
-	defer outputFile.Close()
+	defer func() {
+		outputFile.Close()
+		os.Remove(tmpPath)
+	}()
 
-	inputStat, err := inputFile.Stat()
-	if err != nil {
-		fmt.Printf("Error getting input file info: %v\n", err)
-		return fmt.Errorf("error getting input file info: %v", err)
+	if err := diskspace.Reserve(outputFile, fileSize, fileSize, preallocate); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return err
 	}
-	fileSize := inputStat.Size()
-	err = cryptutils.DecryptProgress(inputFile, outputFile, decryptionKey, fileSize, util.DEFAULT_CHUNK_SIZE, progressCallback)
+	err = cryptutils.DecryptProgress(ctx, input, outputFile, decryptionKey, fileSize, cryptutils.DecryptChunkSize, progressCallback)
 	if err != nil {
 		fmt.Printf("\nError decrypting file: %v\n", err)
-		return fmt.Errorf("error decrypting file: %v", err)
+		return fmt.Errorf("error decrypting file: %w", err)
+	}
+	err = outputFile.Sync()
+	if closeErr := outputFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, outputPath)
+	}
+	if err != nil {
+		fmt.Printf("\nError writing output file: %v\n", err)
+		return fuserr.Wrap(fuserr.CodeDisk, err, "error finishing output file")
 	}
 	fmt.Println("\nDecryption complete.")
 	return nil
 }
+
+// candidateKey is a key that may decrypt a firmware file.
+type candidateKey struct {
+	version int // cryptutils.EncV2 or cryptutils.EncV4
+	key     []byte
+	str     string // What the key is derived from
+}
+
+// firmwareKeys returns the keys that may decrypt the firmware file at
+// inputPath. Its extension decides: a .enc2 file takes the V2 key derived
+// from the version, a .enc4 file the V4 key from the FUS server's
+// LOGIC_VALUE_FACTORY. For other names, such as - for stdin, both are
+// returned, V4 first, and selectKey tells them apart by content; if the
+// server cannot be asked for the V4 key, only the V2 key is returned.
+func firmwareKeys(ctx context.Context, inputPath, fwVersion, model, region, imeiSerial string) ([]candidateKey, error) {
+	version := cryptutils.EncVersion(inputPath)
+	var keys []candidateKey
+	if version != cryptutils.EncV2 {
+		client := fusclient.NewFusClientWithOptions(clientOptions())
+
+		onFinish := func(msg string) {
+			fmt.Println(msg)
+		}
+		onVersionException := func(err error, info *request.BinaryFileInfo) {
+			fmt.Printf("Version exception: %v\n", err)
+			if info != nil {
+				fmt.Printf("Binary File Info: %+v\n", *info)
+			}
+		}
+		shouldReportError := func(err error) bool {
+			return true // For now, always report
+		}
+
+		binaryInfo, err := request.RetrieveBinaryFileInfo(ctx, fwVersion, model, region, imeiSerial, client, onFinish, onVersionException, shouldReportError)
+		if err != nil {
+			fmt.Println("Failed to retrieve binary file information for decryption key.")
+			// Without the .enc4 extension the file may still be V2, so only
+			// give up when the V4 key is the only candidate.
+			if version == cryptutils.EncV4 || ctx.Err() != nil {
+				return nil, fmt.Errorf("failed to retrieve binary file information for decryption key: %w", err)
+			}
+			fmt.Printf("%v\nTrying the V2 key instead.\n", err)
+		} else if binaryInfo.V4Key != nil {
+			keys = append(keys, candidateKey{version: cryptutils.EncV4, key: binaryInfo.V4Key, str: binaryInfo.V4KeyStr})
+		} else if version == cryptutils.EncV4 {
+			return nil, fuserr.New(fuserr.CodeBadKey, "the server sent no V4 key for %s", inputPath)
+		}
+	}
+	if version != cryptutils.EncV4 {
+		key, str := cryptutils.GetV2Key(fwVersion, model, region)
+		keys = append(keys, candidateKey{version: cryptutils.EncV2, key: key, str: str})
+	}
+	return keys, nil
+}
+
+// selectKey returns the first of keys that decrypts first, the first block
+// of the firmware file, to the start of a zip.
+func selectKey(keys []candidateKey, first []byte) ([]byte, error) {
+	var tried []string
+	for _, k := range keys {
+		if cryptutils.KeyMatches(first, k.key) {
+			fmt.Printf("Using V%d decryption key.\n", k.version)
+			fmt.Printf("Decryption Key (MD5): %x\n", k.key)
+			fmt.Printf("Decryption Key (String): %s\n", k.str)
+			return k.key, nil
+		}
+		tried = append(tried, fmt.Sprintf("V%d", k.version))
+	}
+	return nil, fuserr.New(fuserr.CodeBadKey, "wrong decryption key: the %s key does not decrypt the file to a zip", strings.Join(tried, " or "))
+}
+
+// readFirstBlock reads the first AES block of a firmware file from r. A
+// shorter file gives a short block, which no key matches.
+func readFirstBlock(r io.Reader) ([]byte, error) {
+	first := make([]byte, aes.BlockSize)
+	n, err := io.ReadFull(r, first)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, fuserr.Wrap(fuserr.CodeDisk, err, "error reading encrypted file")
+	}
+	return first[:n], nil
+}
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+
+	"samsung-firmware-tool/internal/cryptutils"
+	"samsung-firmware-tool/internal/fustest"
+)
+
+// TestFirmwareKeysInformFails checks that a failed BinaryInform only fails
+// the key lookup for an .enc4 file, and that other names fall back to the
+// V2 key.
+func TestFirmwareKeysInformFails(t *testing.T) {
+	// The server knows no firmware, so BinaryInform fails.
+	srv, err := fustest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	oldURL, oldClient, oldRetries, oldSession := fusURL, httpClient, retries, sessionFile
+	defer func() { fusURL, httpClient, retries, sessionFile = oldURL, oldClient, oldRetries, oldSession }()
+	fusURL, httpClient, retries, sessionFile = srv.URL, srv.Client(), 1, ""
+
+	ctx := context.Background()
+	if _, err := firmwareKeys(ctx, "fw.zip.enc4", testVersion, "SM-S9110", "CHC", "123456789012345"); err == nil {
+		t.Error("firmwareKeys for an .enc4 file succeeded without BinaryInform")
+	}
+	for _, name := range []string{"fw.zip.enc", "-"} {
+		keys, err := firmwareKeys(ctx, name, testVersion, "SM-S9110", "CHC", "123456789012345")
+		if err != nil {
+			t.Fatalf("firmwareKeys(%q) = %v", name, err)
+		}
+		if len(keys) != 1 || keys[0].version != cryptutils.EncV2 {
+			t.Errorf("firmwareKeys(%q) = %+v, want only the V2 key", name, keys)
+		}
+	}
+}
@@ -2,49 +2,29 @@ package cmd
 
 import (
 	"context"
+	"crypto/aes"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
+	"samsung-firmware-tool/internal/cryptutils"
+	"samsung-firmware-tool/internal/diskspace"
 	"samsung-firmware-tool/internal/fusclient"
+	"samsung-firmware-tool/internal/fuserr"
+	"samsung-firmware-tool/internal/progress"
+	"samsung-firmware-tool/internal/ratelimit"
 	"samsung-firmware-tool/internal/request"
 
 	"github.com/spf13/cobra"
 )
 
-// DownloadStatus defines the current status of a download task.
-type DownloadStatus int
-
-const (
-	StatusIdle DownloadStatus = iota
-	StatusInitializing
-	StatusDownloading
-	StatusPaused
-	StatusCompleted
-	StatusFailed
-)
-
-func (s DownloadStatus) String() string {
-	switch s {
-	case StatusIdle:
-		return "Idle"
-	case StatusInitializing:
-		return "Initializing"
-	case StatusDownloading:
-		return "Downloading"
-	case StatusPaused:
-		return "Paused"
-	case StatusCompleted:
-		return "Completed"
-	case StatusFailed:
-		return "Failed"
-	default:
-		return "Unknown"
-	}
-}
+// DefaultConnections is the number of parallel connections of a DownloadTask.
+const DefaultConnections = 4
 
 // ProgressCallback defines the function signature for progress updates.
 type ProgressCallback = func(current, max, bps int64)
@@ -58,268 +38,678 @@ type DownloadTask struct {
 	OutputPath string
 	FileName   string
 
-	Status         DownloadStatus
-	Progress       float64 // Percentage
-	CurrentSize    int64   // Bytes downloaded so far
-	TotalSize      int64   // Total bytes to download
-	BytesPerSecond int64   // Download speed
+	// Connections is the number of byte ranges fetched in parallel. The
+	// file is split into fewer segments when it is small.
+	Connections int
+
+	// Decrypt writes the decrypted zip instead of the encrypted file. The
+	// download is decrypted block by block as it arrives, so the encrypted
+	// file never touches the disk.
+	Decrypt bool
+
+	// Only downloads just these entries of the firmware zip, e.g. "CSC"
+	// and "BL" (see matchEntry), and writes them to OutputPath instead of
+	// the firmware file.
+	Only []string
+
+	// RateLimit caps the download speed of this task. It is unlimited
+	// until SetRateLimit is called; ratelimit.Global applies on top.
+	RateLimit *ratelimit.Limiter
+
+	// ProgressInterval is the least time between two progress reports
+	// while bytes are transferred or verified. 0 uses
+	// progress.DefaultInterval; a negative interval reports every chunk.
+	ProgressInterval time.Duration
+
+	// Preallocate allocates the disk space of the whole file before the
+	// download starts, where the file system supports it. Either way the
+	// download fails early if the free space is too small.
+	Preallocate bool
 
 	client     *fusclient.FusClient
 	binaryInfo *request.BinaryFileInfo
 	outputFile *os.File
-	progressMu sync.Mutex // Mutex to protect progress updates
-	pauseMu    sync.Mutex // Mutex to protect pause/resume state
-	paused     bool
-	cond       *sync.Cond // Condition variable for pausing/resuming
-
-	cancelCtx  context.Context    // Context for cancelling the download
-	cancelFunc context.CancelFunc // Function to cancel the context
-
-	// Callbacks
+	restarted  bool // The .part file was discarded after a range mismatch
+
+	// State shared with Pause, Resume, Cancel and Snapshot, guarded by mu.
+	mu             sync.Mutex
+	status         DownloadStatus
+	currentSize    int64 // Bytes downloaded so far
+	totalSize      int64 // Total bytes to download
+	bytesPerSecond int64 // Moving average of the speed
+	eta            time.Duration
+	phase          progress.Phase
+	err            error // Why the task failed
+	cancelRun      context.CancelFunc
+	interrupted    bool // The current run was stopped by Pause or Cancel
+	deleteFiles    bool // Cancel asked to remove the partial download
+
+	wake       chan struct{} // Signals the Start loop while paused
+	progressMu sync.Mutex    // Serializes OnProgress calls
+
+	// Callbacks. Pause, Resume, Cancel and Snapshot may be called from them.
+	// OnUpdate gets the same reports as OnProgress with the phase and ETA.
 	OnProgress ProgressCallback
+	OnUpdate   func(u progress.Update)
 	OnFinish   func(msg string)
 	OnError    func(err error)
+	OnRetry    func(event fusclient.RetryEvent)
 }
 
 // NewDownloadTask creates and initializes a new DownloadTask.
 func NewDownloadTask(model, region, fwVersion, imeiSerial, outputPath string, onProgress ProgressCallback) *DownloadTask {
+	dt := NewDownloadTaskWithClient(fusclient.NewFusClientWithOptions(clientOptions()), model, region, fwVersion, imeiSerial, outputPath, onProgress)
+	dt.Preallocate = preallocate
+	return dt
+}
+
+// NewDownloadTaskWithClient creates a DownloadTask that uses the given FusClient,
+// and therefore its endpoints and HTTP transport.
+func NewDownloadTaskWithClient(client *fusclient.FusClient, model, region, fwVersion, imeiSerial, outputPath string, onProgress ProgressCallback) *DownloadTask {
 	dt := &DownloadTask{
-		Model:      model,
-		Region:     region,
-		FwVersion:  fwVersion,
-		ImeiSerial: imeiSerial,
-		OutputPath: outputPath,
-		Status:     StatusIdle,
-		OnProgress: onProgress,
-		client:     fusclient.NewFusClient(),
+		Model:       model,
+		Region:      region,
+		FwVersion:   fwVersion,
+		ImeiSerial:  imeiSerial,
+		OutputPath:  outputPath,
+		Connections: DefaultConnections,
+		RateLimit:   ratelimit.New(0),
+		status:      StatusIdle,
+		wake:        make(chan struct{}, 1),
+		OnProgress:  onProgress,
+		client:      client,
 		OnFinish: func(msg string) {
 			fmt.Println(msg)
 		},
 		OnError: func(err error) {
 			fmt.Printf("Error: %v\n", err)
 		},
+		OnRetry: printRetry,
 	}
-	dt.cond = sync.NewCond(&dt.pauseMu)
-	dt.cancelCtx, dt.cancelFunc = context.WithCancel(context.Background()) // Initialize context
 	return dt
 }
 
 // Start initiates the download process, supporting resume.
 func (dt *DownloadTask) Start() error {
-	dt.Status = StatusInitializing
-	dt.updateProgress()
+	return dt.StartContext(context.Background())
+}
+
+// StartContext is Start with a parent context. Cancelling ctx aborts the
+// BinaryInform/BinaryInit requests and the download itself, and leaves the
+// task Cancelled. StartContext returns once the task is Completed, Failed
+// or Cancelled; while it is paused it waits for Resume or Cancel.
+func (dt *DownloadTask) StartContext(ctx context.Context) error {
+	dt.mu.Lock()
+	if err := dt.transitionLocked(StatusInitializing); err != nil {
+		dt.mu.Unlock()
+		return err
+	}
+	dt.binaryInfo = nil
+	dt.restarted = false
+	dt.interrupted = false
+	dt.deleteFiles = false
+	dt.err = nil
+	dt.phase = progress.PhaseInit
+	dt.mu.Unlock()
+	dt.notifyProgress()
+
+	ctx = fusclient.WithRetryNotify(ctx, dt.notifyRetry)
+	ctx = fusclient.WithRateLimit(ctx, dt.RateLimit)
 
 	fmt.Printf("Initializing download for firmware %s for Model: %s, Region: %s to %s\n", dt.FwVersion, dt.Model, dt.Region, dt.OutputPath)
 
-	onVersionException := func(err error, info *request.BinaryFileInfo) {
-		fmt.Printf("Version exception: %v\n", err)
-		if info != nil {
-			fmt.Println("Attempting to proceed with download despite version exception...")
-			dt.binaryInfo = info
-			dt.performDownload(dt.cancelCtx) // Proceed with download, pass context
+	for {
+		dt.mu.Lock()
+		switch dt.status {
+		case StatusPaused:
+			dt.mu.Unlock()
+			dt.waitWhilePaused(ctx)
+			continue
+		case StatusCancelled:
+			deleteFiles := dt.deleteFiles
+			dt.mu.Unlock()
+			if deleteFiles {
+				dt.discardFiles()
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return context.Canceled
+		}
+		runCtx, cancelRun := context.WithCancel(ctx)
+		dt.cancelRun = cancelRun
+		dt.mu.Unlock()
+
+		err := dt.run(runCtx)
+		cancelRun()
+
+		dt.mu.Lock()
+		dt.cancelRun = nil
+		interrupted := dt.interrupted
+		dt.interrupted = false
+		dt.mu.Unlock()
+		if interrupted {
+			// Paused or cancelled; the next iteration waits or returns.
+			dt.notifyProgress()
+			continue
+		}
+		if err != nil && ctx.Err() != nil {
+			// The caller cancelled the task.
+			fmt.Println("\nDownload cancelled.")
+			dt.transition(StatusCancelled)
+			return ctx.Err()
+		}
+		return err
+	}
+}
+
+// waitWhilePaused blocks until the task is resumed or cancelled, or ctx is
+// done, which cancels it.
+func (dt *DownloadTask) waitWhilePaused(ctx context.Context) {
+	select {
+	case <-dt.wake:
+	case <-ctx.Done():
+		dt.transition(StatusCancelled)
+	}
+}
+
+// run fetches the file information unless a previous run has already done
+// so, and then downloads the file.
+func (dt *DownloadTask) run(ctx context.Context) error {
+	if dt.binaryInfo == nil {
+		var forced *request.BinaryFileInfo
+		onVersionException := func(err error, info *request.BinaryFileInfo) {
+			fmt.Printf("Version exception: %v\n", err)
+			if info != nil {
+				fmt.Println("Attempting to proceed with download despite version exception...")
+				forced = info
+			}
 		}
+		shouldReportError := func(err error) bool {
+			return true // For now, always report
+		}
+
+		binaryInfo, err := request.RetrieveBinaryFileInfo(ctx, dt.FwVersion, dt.Model, dt.Region, dt.ImeiSerial, dt.client, dt.OnFinish, onVersionException, shouldReportError)
+		if forced != nil {
+			binaryInfo, err = forced, nil
+		}
+		if err != nil {
+			dt.fail(ctx, fmt.Errorf("failed to retrieve binary file information: %w", err))
+			return err
+		}
+		dt.setBinaryInfo(binaryInfo)
 	}
-	shouldReportError := func(err error) bool {
-		return true // For now, always report
+	if len(dt.Only) > 0 {
+		return dt.performExtract(ctx)
 	}
+	return dt.performDownload(ctx, dt.Connections)
+}
 
-	binaryInfo := request.RetrieveBinaryFileInfo(dt.FwVersion, dt.Model, dt.Region, dt.ImeiSerial, dt.client, dt.OnFinish, onVersionException, shouldReportError)
-	if binaryInfo == nil {
-		dt.Status = StatusFailed
-		dt.OnError(errors.New("failed to retrieve binary file information"))
-		return errors.New("failed to retrieve binary file information")
+// fail moves the task to Failed and reports err, unless the run was
+// stopped through ctx, in which case StartContext decides what follows.
+func (dt *DownloadTask) fail(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return err
 	}
-	dt.binaryInfo = binaryInfo
-	dt.FileName = binaryInfo.FileName
-	dt.TotalSize = binaryInfo.Size
+	dt.mu.Lock()
+	dt.err = err
+	dt.transitionLocked(StatusFailed)
+	dt.mu.Unlock()
+	dt.notifyProgress()
+	dt.OnError(err)
+	return err
+}
 
-	return dt.performDownload(dt.cancelCtx) // Pass the context
+// setBinaryInfo sets the file to download. FileName is the name of the
+// local file, without the .enc2/.enc4 extension when decrypting.
+func (dt *DownloadTask) setBinaryInfo(info *request.BinaryFileInfo) {
+	dt.binaryInfo = info
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.FileName = info.FileName
+	if dt.Decrypt {
+		dt.FileName = strings.TrimSuffix(strings.TrimSuffix(info.FileName, ".enc4"), ".enc2")
+	}
+	dt.totalSize = info.Size
+}
+
+// decryptionKey returns the key of the firmware: the V2 key derived from
+// the version for a .enc2 file, otherwise the V4 key if the server sent
+// LOGIC_VALUE_FACTORY.
+func (dt *DownloadTask) decryptionKey() []byte {
+	if cryptutils.EncVersion(dt.binaryInfo.FileName) != cryptutils.EncV2 && dt.binaryInfo.V4Key != nil {
+		return dt.binaryInfo.V4Key
+	}
+	key, _ := cryptutils.GetV2Key(dt.FwVersion, dt.Model, dt.Region)
+	return key
+}
+
+// openOutput returns where the downloaded bytes of file go: the file
+// itself, or an ECBFile that stores their plaintext in it.
+func (dt *DownloadTask) openOutput(file *os.File) (interface {
+	io.ReaderAt
+	io.WriterAt
+}, error) {
+	if !dt.Decrypt {
+		return file, nil
+	}
+	return cryptutils.NewECBFile(file, dt.decryptionKey(), dt.binaryInfo.Size)
 }
 
 // performDownload handles the actual file download logic, including resume.
-func (dt *DownloadTask) performDownload(ctx context.Context) error {
+// The file is fetched in up to connections parallel segments into a .part
+// file whose sidecar records the progress of every segment, and gets its
+// final name once it has been verified.
+func (dt *DownloadTask) performDownload(ctx context.Context, connections int) error {
 	fullPath := filepath.Join(dt.OutputPath, dt.FileName)
-
-	// Check for existing file to resume download
-	fileInfo, err := os.Stat(fullPath)
-	if err == nil {
-		// File exists, check if it's a partial download
-		dt.CurrentSize = fileInfo.Size()
-		if dt.CurrentSize >= dt.TotalSize {
-			dt.Status = StatusCompleted
+	partPath := fullPath + partSuffix
+	statePath := fullPath + stateSuffix
+
+	if info, err := os.Stat(fullPath); err == nil {
+		complete := dt.binaryInfo.Size
+		if dt.Decrypt {
+			// The decrypted firmware lacks the padding of the last block.
+			complete -= aes.BlockSize
+		}
+		if info.Size() >= complete {
+			if err := dt.transition(StatusVerifying); err != nil {
+				return err
+			}
+			if err := dt.verifyExisting(ctx, fullPath); err != nil {
+				return dt.failVerification(ctx, fullPath, fullPath, err)
+			}
+			if err := dt.transition(StatusCompleted); err != nil {
+				return err
+			}
 			dt.OnFinish(fmt.Sprintf("File already downloaded: %s", fullPath))
 			return nil
 		}
-		fmt.Printf("Resuming download from %d bytes.\n", dt.CurrentSize)
-		dt.outputFile, err = os.OpenFile(fullPath, os.O_APPEND|os.O_WRONLY, 0644)
-		if err != nil {
-			dt.Status = StatusFailed
-			dt.OnError(fmt.Errorf("error opening file for resume: %w", err))
-			return err
-		}
-	} else if os.IsNotExist(err) {
-		// File does not exist, start new download
-		dt.CurrentSize = 0
-		dt.outputFile, err = os.Create(fullPath)
-		if err != nil {
-			dt.Status = StatusFailed
-			dt.OnError(fmt.Errorf("error creating output file: %w", err))
-			return err
-		}
-	} else {
-		dt.Status = StatusFailed
-		dt.OnError(fmt.Errorf("error checking file status: %w", err))
-		return err
+		fmt.Printf("Ignoring incomplete file %s, it has no resume state and will be replaced.\n", fullPath)
 	}
-	defer dt.outputFile.Close()
 
-	// Perform BINARY_INIT request
-	nonce, err := dt.client.GetNonce()
+	flags := os.O_RDWR | os.O_CREATE
+	segments := dt.resumeSegments(partPath, statePath)
+	if segments == nil {
+		segments = fusclient.SplitSegments(0, dt.binaryInfo.Size, connections)
+		flags |= os.O_TRUNC
+	}
+
+	var done int64
+	for _, seg := range segments {
+		done += seg.Done
+	}
+	dt.setProgress(progress.Update{Phase: progress.PhaseInit, Current: done, Total: dt.binaryInfo.Size})
+	if done > 0 {
+		fmt.Printf("Resuming download from %d bytes.\n", done)
+	}
+	var err error
+	dt.outputFile, err = os.OpenFile(partPath, flags, 0644)
 	if err != nil {
-		dt.Status = StatusFailed
-		dt.OnError(fmt.Errorf("error getting nonce for BINARY_INIT: %w", err))
-		return err
+		return dt.fail(ctx, fuserr.Wrap(fuserr.CodeDisk, err, "error opening output file"))
+	}
+	defer dt.outputFile.Close()
+	if err := diskspace.Reserve(dt.outputFile, dt.binaryInfo.Size, dt.binaryInfo.Size-done, dt.Preallocate); err != nil {
+		if done == 0 {
+			// Nothing to resume, so do not leave an empty .part behind.
+			dt.outputFile.Close()
+			dt.discardFiles()
+		}
+		return dt.fail(ctx, err)
 	}
-	binaryInitRequest := request.CreateBinaryInit(dt.binaryInfo.FileName, nonce)
-	_, err = dt.client.MakeReq(fusclient.BinaryInit, binaryInitRequest, true)
+	output, err := dt.openOutput(dt.outputFile)
 	if err != nil {
-		dt.Status = StatusFailed
-		dt.OnError(fmt.Errorf("error performing BINARY_INIT request: %w", err))
-		return err
+		return dt.fail(ctx, err)
 	}
 
-	dt.Status = StatusDownloading
-	dt.updateProgress()
+	if err := dt.binaryInit(ctx); err != nil {
+		return err
+	}
 
-	// Wrap the original progress callback to include pause/resume logic
-	wrappedProgressCallback := func(current, max, bps int64) {
-		dt.pauseMu.Lock()
-		for dt.paused {
-			dt.Status = StatusPaused
-			dt.updateProgress() // Update status to paused
-			dt.cond.Wait()
+	if err := dt.transition(StatusDownloading); err != nil {
+		return err
+	}
+	reporter := progress.NewReporter(dt.ProgressInterval, dt.setProgress)
+	reporter.Start(progress.PhaseDownload, done, dt.binaryInfo.Size)
+
+	// Hash the file behind the segments as they are written, including
+	// what is already on disk from an earlier run.
+	hasher := newStreamHasher(output)
+	hashable := make(chan int64, 1)
+	hashDone := make(chan error, 1)
+	go func() {
+		var err error
+		for end := range hashable {
+			if err == nil {
+				err = hasher.advance(ctx, end)
+			}
 		}
-		dt.Status = StatusDownloading // Resume status
-		dt.pauseMu.Unlock()
-		dt.updateProgressCallback()(current, max, bps) // Call original progress update
+		hashDone <- err
+	}()
+
+	// Combine the progress of all segments.
+	var segmentsMu sync.Mutex
+	onSegment := func(i int, seg fusclient.Segment) {
+		segmentsMu.Lock()
+		done += seg.Done - segments[i].Done
+		segments[i] = seg
+		current := done
+		select {
+		case hashable <- contiguousEnd(segments):
+		default: // The hasher is busy; a later chunk will move it on
+		}
+		segmentsMu.Unlock()
+		reporter.Set(current)
 	}
 
-	md5Sum, err := dt.client.DownloadFile(
+	// Record the progress in the sidecar every few seconds.
+	stopSaving := make(chan struct{})
+	savingDone := make(chan struct{})
+	go func() {
+		defer close(savingDone)
+		ticker := time.NewTicker(stateSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopSaving:
+				return
+			case <-ticker.C:
+				segmentsMu.Lock()
+				snapshot := append([]fusclient.Segment(nil), segments...)
+				segmentsMu.Unlock()
+				dt.saveState(statePath, snapshot)
+			}
+		}
+	}()
+	dt.saveState(statePath, segments)
+
+	md5Sum, err := dt.client.DownloadSegments(
 		ctx, // Pass the context here
 		dt.binaryInfo.Path+dt.binaryInfo.FileName,
-		dt.CurrentSize, // Pass current size for resume
+		segments,
 		dt.binaryInfo.Size,
-		dt.outputFile,
-		dt.CurrentSize, // outputSize for progress tracking
-		wrappedProgressCallback,
+		output,
+		onSegment,
 	)
+	close(stopSaving)
+	<-savingDone
+	close(hashable)
+	hashErr := <-hashDone
+	var rangeErr *fusclient.RangeError
+	if errors.As(err, &rangeErr) && !dt.restarted {
+		// The server's answer does not fit the .part file, so start over,
+		// over a single connection in case the server ignores ranges.
+		fmt.Printf("\n%v\nRestarting the download from scratch.\n", err)
+		// dt.Connections is left alone for later runs of the task.
+		dt.restarted = true
+		dt.outputFile.Close()
+		os.Remove(partPath)
+		os.Remove(statePath)
+		return dt.performDownload(ctx, 1)
+	}
 	if err != nil {
-		if err == context.Canceled {
-			fmt.Println("\nDownload cancelled by user (paused).")
-			return nil // Return nil error as it's a controlled pause
+		dt.saveState(statePath, segments)
+		dt.fail(ctx, fmt.Errorf("\nError downloading file: %w", err))
+		return err
+	}
+
+	if err := dt.transition(StatusVerifying); err != nil {
+		// Paused or cancelled just as the last bytes arrived.
+		dt.saveState(statePath, segments)
+		return err
+	}
+	reporter.Flush()
+	if hashErr == nil {
+		reporter.Start(progress.PhaseVerify, hasher.offset, dt.binaryInfo.Size)
+		hasher.onAdvance = reporter.Set
+		hashErr = hasher.advance(ctx, dt.binaryInfo.Size)
+		reporter.Flush()
+	}
+	if hashErr == nil {
+		hashErr = hasher.verify(dt.binaryInfo.CRC32, md5Sum)
+	}
+	if hashErr != nil {
+		dt.saveState(statePath, segments)
+		dt.outputFile.Close()
+		return dt.failVerification(ctx, partPath, fullPath, hashErr)
+	}
+	if md5Sum == "" {
+		// Every response was partial; report the MD5 of the file instead.
+		md5Sum = fmt.Sprintf("%x", hasher.md5.Sum(nil))
+	}
+
+	if ecb, ok := output.(*cryptutils.ECBFile); ok {
+		// The padding was only kept for the verification.
+		plainSize, err := ecb.PlainSize()
+		if err == nil {
+			err = dt.outputFile.Truncate(plainSize)
 		}
-		if err == io.EOF {
-			// io.EOF means download finished successfully
-			dt.Status = StatusCompleted
-			dt.OnFinish(fmt.Sprintf("\nDownload complete. MD5: %s", md5Sum))
-			return nil
+		if err != nil {
+			return dt.fail(ctx, fuserr.Wrap(fuserr.CodeDisk, err, "error finishing download"))
 		}
-		dt.Status = StatusFailed
-		dt.OnError(fmt.Errorf("\nError downloading file: %w", err))
+	}
+	err = dt.outputFile.Sync()
+	if closeErr := dt.outputFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(partPath, fullPath)
+	}
+	if err != nil {
+		return dt.fail(ctx, fuserr.Wrap(fuserr.CodeDisk, err, "error finishing download"))
+	}
+	os.Remove(statePath)
+
+	if err := dt.transition(StatusCompleted); err != nil {
 		return err
 	}
+	if dt.Decrypt {
+		dt.OnFinish(fmt.Sprintf("\nDownload complete and verified. MD5: %s\nDecrypted firmware written to %s", md5Sum, fullPath))
+		return nil
+	}
+	dt.OnFinish(fmt.Sprintf("\nDownload complete and verified. MD5: %s", md5Sum))
+	return nil
+}
 
-	dt.Status = StatusCompleted
-	dt.OnFinish(fmt.Sprintf("\nDownload complete. MD5: %s", md5Sum))
+// binaryInit performs the BINARY_INIT request that authorizes the
+// download of the file.
+func (dt *DownloadTask) binaryInit(ctx context.Context) error {
+	if _, err := dt.client.GetNonce(ctx); err != nil {
+		dt.fail(ctx, fmt.Errorf("error getting nonce for BINARY_INIT: %w", err))
+		return err
+	}
+	_, err := dt.client.MakeReqFunc(ctx, fusclient.BinaryInit, func(nonce string) string {
+		return request.CreateBinaryInit(dt.binaryInfo.FileName, nonce)
+	}, true)
+	if err != nil {
+		dt.fail(ctx, fmt.Errorf("error performing BINARY_INIT request: %w", err))
+		return err
+	}
 	return nil
 }
 
-// updateProgressCallback returns a progress callback function that updates the task's state.
-func (dt *DownloadTask) updateProgressCallback() ProgressCallback {
-	return func(current, max, bps int64) {
-		dt.progressMu.Lock()
-		defer dt.progressMu.Unlock()
-		dt.CurrentSize = current
-		dt.TotalSize = max
-		dt.BytesPerSecond = bps
-		if max > 0 {
-			dt.Progress = float64(current) / float64(max) * 100
-		} else {
-			dt.Progress = 0
-		}
-		if dt.OnProgress != nil {
-			dt.OnProgress(dt.CurrentSize, dt.TotalSize, dt.BytesPerSecond)
+// performExtract downloads only the zip entries in Only. The firmware zip
+// is read remotely: Range requests fetch its central directory at the end
+// of the file and then the blocks of the chosen entries, which are
+// decrypted on the fly, so the rest of the file is never transferred.
+func (dt *DownloadTask) performExtract(ctx context.Context) error {
+	if err := dt.binaryInit(ctx); err != nil {
+		return err
+	}
+	if err := dt.transition(StatusDownloading); err != nil {
+		return err
+	}
+
+	remote := dt.client.OpenRemote(ctx, dt.binaryInfo.Path+dt.binaryInfo.FileName, dt.binaryInfo.Size)
+	file, err := cryptutils.NewDecryptedFile(remote, dt.binaryInfo.Size, dt.decryptionKey())
+	if err != nil {
+		return dt.fail(ctx, err)
+	}
+	zr, err := openFirmwareZip(file)
+	if err != nil {
+		return dt.fail(ctx, err)
+	}
+	reporter := progress.NewReporter(dt.ProgressInterval, dt.setProgress)
+	names, err := extractEntries(ctx, zr, dt.Only, dt.OutputPath, reporter)
+	if err != nil {
+		return dt.fail(ctx, err)
+	}
+
+	// zip has checked the CRC32 of every entry while reading it.
+	if err := dt.transition(StatusVerifying); err != nil {
+		return err
+	}
+	if err := dt.transition(StatusCompleted); err != nil {
+		return err
+	}
+	dt.OnFinish(fmt.Sprintf("\nExtracted %s to %s, fetched %s of %s.",
+		strings.Join(names, ", "), dt.OutputPath, progress.FormatBytes(remote.BytesRead()), progress.FormatBytes(dt.binaryInfo.Size)))
+	return nil
+}
+
+// verifyExisting checks the CRC32 of a download that is already complete.
+func (dt *DownloadTask) verifyExisting(ctx context.Context, fullPath string) error {
+	if dt.binaryInfo.CRC32 == 0 {
+		return nil
+	}
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return fuserr.Wrap(fuserr.CodeDisk, err, "error opening download for verification")
+	}
+	defer file.Close()
+	output, err := dt.openOutput(file)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Verifying %s\n", fullPath)
+	reporter := progress.NewReporter(dt.ProgressInterval, dt.setProgress)
+	reporter.Start(progress.PhaseVerify, 0, dt.binaryInfo.Size)
+	hasher := newStreamHasher(output)
+	hasher.onAdvance = reporter.Set
+	if err := hasher.advance(ctx, dt.binaryInfo.Size); err != nil {
+		return err
+	}
+	return hasher.verify(dt.binaryInfo.CRC32, "")
+}
+
+// failVerification fails the task after a complete download at path
+// could not be verified. A file with wrong checksums is quarantined.
+func (dt *DownloadTask) failVerification(ctx context.Context, path, fullPath string, err error) error {
+	if errors.Is(err, fuserr.ErrChecksum) {
+		err = fmt.Errorf("%w; file moved to %s", err, quarantine(path, fullPath))
+	}
+	return dt.fail(ctx, err)
+}
+
+// contiguousEnd returns the end of the part of the file that has been
+// written without gaps from the start.
+func contiguousEnd(segments []fusclient.Segment) int64 {
+	for _, seg := range segments {
+		if !seg.Complete() {
+			return seg.Start + seg.Done
 		}
 	}
+	if len(segments) == 0 {
+		return 0
+	}
+	return segments[len(segments)-1].End
+}
+
+// SetRateLimit changes the download speed limit of the task in bytes per
+// second, also while it is downloading. 0 removes the limit.
+func (dt *DownloadTask) SetRateLimit(bytesPerSecond int64) {
+	dt.RateLimit.SetLimit(bytesPerSecond)
+}
+
+// notifyRetry forwards retry events to OnRetry.
+func (dt *DownloadTask) notifyRetry(event fusclient.RetryEvent) {
+	if dt.OnRetry != nil {
+		dt.OnRetry(event)
+	}
+}
+
+// setProgress records the progress and reports it through OnProgress and
+// OnUpdate.
+func (dt *DownloadTask) setProgress(u progress.Update) {
+	dt.mu.Lock()
+	dt.phase = u.Phase
+	dt.currentSize = u.Current
+	dt.totalSize = u.Total
+	dt.bytesPerSecond = u.BytesPerSecond
+	dt.eta = u.ETA
+	dt.mu.Unlock()
+	dt.notifyProgress()
 }
 
 // DownloadCmd represents the download command
 var DownloadCmd = &cobra.Command{
 	Use:   "download",
 	Short: "Download firmware",
-	Long:  `This command downloads firmware for a given device model, region, firmware version, and IMEI/Serial number.`,
+	Long: `This command downloads firmware for a given device model, region, firmware version, and IMEI/Serial number.
+
+With --only CSC,BL it downloads just those files of the firmware zip into the --output directory, fetching only their part of the encrypted file.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if model == "" || region == "" || fwVersion == "" || imeiSerial == "" || outputFile == "" {
 			fmt.Println("错误: --model, --region, --fw, --imei, 和 --output 是下载固件所必需的。")
-			os.Exit(1)
+			os.Exit(ExitUsage)
 		}
-		var progressCall = func(current, max, bps int64) {
-			fmt.Printf("\rDownloading: %d/%d bytes (%.2f%%) @ %d B/s", current, max, float64(current)/float64(max)*100, bps)
+		limit, err := ratelimit.ParseRate(downloadLimit)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(ExitUsage)
 		}
-
-		task := NewDownloadTask(model, region, fwVersion, imeiSerial, outputFile, progressCall)
-		err := task.Start()
+		term := progress.NewTerminal(os.Stdout)
+		task := NewDownloadTask(model, region, fwVersion, imeiSerial, outputFile, nil)
+		task.OnUpdate = func(u progress.Update) {
+			if u.Phase != progress.PhaseInit {
+				term.Update(u)
+			}
+		}
+		task.OnFinish = func(msg string) {
+			term.Done()
+			fmt.Println(strings.TrimPrefix(msg, "\n"))
+		}
+		task.OnError = func(err error) {
+			term.Done()
+			fmt.Printf("Error: %v\n", strings.TrimPrefix(err.Error(), "\n"))
+		}
+		task.Connections = downloadConnections
+		task.SetRateLimit(limit)
+		task.Decrypt = downloadDecrypt
+		task.Only = parseOnly(downloadOnly)
+		err = task.StartContext(commandContext(cmd))
 		if err != nil {
 			fmt.Printf("Download task failed: %v\n", err)
-			os.Exit(1)
+			os.Exit(ExitCode(err))
 		}
 	},
 }
 
-// Pause pauses the download task.
-func (dt *DownloadTask) Pause() {
-	dt.pauseMu.Lock()
-	defer dt.pauseMu.Unlock()
-	if dt.Status == StatusDownloading {
-		dt.paused = true
-		dt.Status = StatusPaused
-		dt.updateProgress()
-		dt.cancelFunc() // Cancel the context to stop the HTTP request
-		fmt.Println("Download paused.")
-	}
-}
-
-// Resume resumes a paused download task.
-func (dt *DownloadTask) Resume() {
-	dt.pauseMu.Lock()
-	defer dt.pauseMu.Unlock()
-	if dt.Status == StatusPaused {
-		dt.paused = false
-		dt.Status = StatusDownloading
-		dt.updateProgress()
-		// Recreate context for new request
-		dt.cancelCtx, dt.cancelFunc = context.WithCancel(context.Background())
-		go func() {
-			// Re-initiate download in a new goroutine
-			err := dt.performDownload(dt.cancelCtx)
-			if err != nil {
-				dt.OnError(err)
-			}
-		}()
-		dt.cond.Signal() // Signal the waiting goroutine to resume (though it might not be waiting anymore if context cancelled)
-		fmt.Println("Download resumed.")
-	}
-}
+var (
+	downloadConnections int
+	downloadLimit       string
+	downloadDecrypt     bool
+	downloadOnly        string
+)
 
 func init() {
 	rootCmd.AddCommand(DownloadCmd)
+	DownloadCmd.Flags().IntVar(&downloadConnections, "connections", DefaultConnections, T("connections_desc"))
+	DownloadCmd.Flags().StringVar(&downloadLimit, "limit", "", T("limit_desc"))
+	DownloadCmd.Flags().BoolVar(&downloadDecrypt, "decrypt", false, T("download_decrypt_desc"))
+	DownloadCmd.Flags().StringVar(&downloadOnly, "only", "", T("download_only_desc"))
 }
 
-// updateProgress is a helper to call the OnProgress callback.
-func (dt *DownloadTask) updateProgress() {
+// notifyProgress calls OnProgress and OnUpdate with the current state of
+// the task.
+func (dt *DownloadTask) notifyProgress() {
 	dt.progressMu.Lock()
 	defer dt.progressMu.Unlock()
+	s := dt.Snapshot()
 	if dt.OnProgress != nil {
-		dt.OnProgress(dt.CurrentSize, dt.TotalSize, dt.BytesPerSecond)
+		dt.OnProgress(s.CurrentSize, s.TotalSize, s.BytesPerSecond)
+	}
+	if dt.OnUpdate != nil {
+		dt.OnUpdate(progress.Update{Phase: s.Phase, Current: s.CurrentSize, Total: s.TotalSize, BytesPerSecond: s.BytesPerSecond, ETA: s.ETA})
 	}
 }
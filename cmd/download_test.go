@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"samsung-firmware-tool/internal/fusclient"
+	"samsung-firmware-tool/internal/fustest"
+)
+
+const testVersion = "S9110ZCU1AWA1/S9110CHC1AWA1/S9110ZCU1AWA1/S9110ZCU1AWA1"
+
+// TestRestartKeepsConnections checks that a download that starts over
+// after a RangeError does so over one connection without changing the
+// configured Connections of the task.
+func TestRestartKeepsConnections(t *testing.T) {
+	fw := fustest.Firmware{Model: "SM-S9110", Region: "CHC", Version: testVersion, Data: bytes.Repeat([]byte("firmware"), 3*fusclient.MinSegmentSize/8)}
+	h, err := fustest.NewHandler(fw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Answer the first request for a range after the start of the file
+	// with the whole file, as a server that ignores Range would.
+	var ignored atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rng := r.Header.Get("Range"); rng != "" && rng[len("bytes="):][0] != '0' && ignored.CompareAndSwap(false, true) {
+			r.Header.Del("Range")
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	client := fusclient.NewFusClientWithOptions(fusclient.Options{FusURL: srv.URL, DownloadURL: srv.URL, FotaURL: srv.URL, HTTPClient: srv.Client()})
+	dt := NewDownloadTaskWithClient(client, fw.Model, fw.Region, fw.Version, "123456789012345", t.TempDir(), nil)
+	dt.Connections = 3
+	if err := dt.StartContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !ignored.Load() {
+		t.Fatal("the download never requested a later range")
+	}
+	if dt.Connections != 3 {
+		t.Errorf("Connections = %d after the restart, want 3", dt.Connections)
+	}
+}
+
+// TestDownloadDecryptMatchesDecrypt checks that download --decrypt writes
+// the same bytes as a plain download followed by decrypt, without the
+// padding, and that it recognises its output as complete afterwards.
+func TestDownloadDecryptMatchesDecrypt(t *testing.T) {
+	// 2 MiB + 5 needs 11 bytes of padding, 2 MiB a whole block of it.
+	sample, err := fustest.SampleZip(testVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{2*fusclient.MinSegmentSize + 5, 2 * fusclient.MinSegmentSize} {
+		// decrypt picks the key by the zip header, so start with a zip.
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		copy(data, sample)
+		fw := fustest.Firmware{Model: "SM-S9110", Region: "CHC", Version: testVersion, Data: data}
+		srv, err := fustest.NewServer(fw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		oldURL, oldClient, oldSession := fusURL, httpClient, sessionFile
+		defer func() { fusURL, httpClient, sessionFile = oldURL, oldClient, oldSession }()
+		fusURL, httpClient, sessionFile = srv.URL, srv.Client(), ""
+
+		ctx := context.Background()
+		download := func(decrypt bool) string {
+			dir := t.TempDir()
+			dt := NewDownloadTaskWithClient(fusclient.NewFusClientWithOptions(srv.Options()), fw.Model, fw.Region, fw.Version, "123456789012345", dir, nil)
+			dt.Decrypt = decrypt
+			dt.Connections = 2
+			if err := dt.StartContext(ctx); err != nil {
+				t.Fatal(err)
+			}
+			return filepath.Join(dir, dt.FileName)
+		}
+
+		decrypted := download(true)
+		encrypted := download(false)
+		plainPath := filepath.Join(t.TempDir(), "fw.zip")
+		if err := DecryptFirmware(ctx, encrypted, plainPath, fw.Version, fw.Model, fw.Region, "123456789012345", nil); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := os.ReadFile(decrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := os.ReadFile(plainPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) || !bytes.Equal(got, data) {
+			t.Fatalf("size %d: download --decrypt wrote %d bytes, decrypt %d, want %d", size, len(got), len(want), len(data))
+		}
+
+		// Running the task again verifies the existing file.
+		var finished string
+		dt := NewDownloadTaskWithClient(fusclient.NewFusClientWithOptions(srv.Options()), fw.Model, fw.Region, fw.Version, "123456789012345", filepath.Dir(decrypted), nil)
+		dt.Decrypt = true
+		dt.OnFinish = func(msg string) { finished = msg }
+		if err := dt.StartContext(ctx); err != nil {
+			t.Fatalf("size %d: second run: %v", size, err)
+		}
+		if !strings.HasPrefix(finished, "File already downloaded") {
+			t.Errorf("size %d: second run finished with %q", size, finished)
+		}
+	}
+}
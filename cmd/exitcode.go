@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"samsung-firmware-tool/internal/fuserr"
+)
+
+// Exit codes of the CLI. They are documented in the README and must not change.
+const (
+	ExitOK              = 0
+	ExitError           = 1   // Unclassified error
+	ExitUsage           = 2   // Missing or invalid arguments
+	ExitInvalidFirmware = 3   // FUS_F01
+	ExitInvalidIMEI     = 4   // FUS_408
+	ExitAuth            = 5   // FUS_401, AUTH
+	ExitNotFound        = 6   // NO_BINARY, NOT_FOUND
+	ExitVersionMismatch = 7   // VERSION_MISMATCH, VERSION_CHECK
+	ExitNetwork         = 8   // NETWORK
+	ExitServer          = 9   // SERVER, FUS_STATUS
+	ExitBlocked         = 10  // WAF_BLOCKED
+	ExitBadKey          = 11  // BAD_KEY
+	ExitDisk            = 12  // DISK
+	ExitChecksum        = 13  // CHECKSUM
+	ExitCancelled       = 130 // Interrupted by Ctrl+C or SIGTERM
+)
+
+// ExitCode maps an error to the exit code of its class.
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	if errors.Is(err, context.Canceled) {
+		return ExitCancelled
+	}
+	switch fuserr.CodeOf(err) {
+	case fuserr.CodeInvalidFirmware:
+		return ExitInvalidFirmware
+	case fuserr.CodeInvalidIMEI:
+		return ExitInvalidIMEI
+	case fuserr.CodeUnauthorized, fuserr.CodeAuth:
+		return ExitAuth
+	case fuserr.CodeNoBinary, fuserr.CodeNotFound:
+		return ExitNotFound
+	case fuserr.CodeVersionMismatch, fuserr.CodeVersionCheck:
+		return ExitVersionMismatch
+	case fuserr.CodeNetwork:
+		return ExitNetwork
+	case fuserr.CodeServer, fuserr.CodeBadStatus:
+		return ExitServer
+	case fuserr.CodeBlocked:
+		return ExitBlocked
+	case fuserr.CodeBadKey:
+		return ExitBadKey
+	case fuserr.CodeDisk, fuserr.CodeNoSpace:
+		return ExitDisk
+	case fuserr.CodeChecksum:
+		return ExitChecksum
+	default:
+		return ExitError
+	}
+}
+
+// exitOnError terminates the process with the exit code of err, if any.
+func exitOnError(err error) {
+	if err != nil {
+		os.Exit(ExitCode(err))
+	}
+}
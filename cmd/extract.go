@@ -0,0 +1,277 @@
+package cmd
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"samsung-firmware-tool/internal/cryptutils"
+	"samsung-firmware-tool/internal/diskspace"
+	"samsung-firmware-tool/internal/fuserr"
+	"samsung-firmware-tool/internal/progress"
+)
+
+// ListFirmware prints the entries of the zip inside an encrypted firmware
+// file without decrypting the whole file.
+func ListFirmware(ctx context.Context, inputPath, fwVersion, model, region, imeiSerial string) error {
+	file, err := openFirmware(ctx, inputPath, fwVersion, model, region, imeiSerial)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	zr, err := openFirmwareZip(file)
+	if err != nil {
+		return err
+	}
+	printEntries(zr)
+	return nil
+}
+
+// ExtractFirmware decrypts only the zip entries of an encrypted firmware
+// file that match only (see matchEntry) and writes them to outputDir.
+func ExtractFirmware(ctx context.Context, inputPath, outputDir, fwVersion, model, region, imeiSerial string, only []string, progressCallback ProgressCallback) error {
+	file, err := openFirmware(ctx, inputPath, fwVersion, model, region, imeiSerial)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	zr, err := openFirmwareZip(file)
+	if err != nil {
+		return err
+	}
+	reporter := progress.NewReporter(0, func(u progress.Update) {
+		if progressCallback != nil {
+			progressCallback(u.Current, u.Total, u.BytesPerSecond)
+		}
+	})
+	_, err = extractEntries(ctx, zr, only, outputDir, reporter)
+	return err
+}
+
+// openFirmware opens the encrypted firmware file at inputPath for reading
+// its plaintext, with the key that selectKey picks by its first block.
+func openFirmware(ctx context.Context, inputPath, fwVersion, model, region, imeiSerial string) (*cryptutils.DecryptedFile, error) {
+	keys, err := firmwareKeys(ctx, inputPath, fwVersion, model, region, imeiSerial)
+	if err != nil {
+		return nil, err
+	}
+	input, err := os.Open(inputPath)
+	if err != nil {
+		return nil, fuserr.Wrap(fuserr.CodeDisk, err, "error opening encrypted file")
+	}
+	first, err := readFirstBlock(input)
+	input.Close()
+	if err != nil {
+		return nil, err
+	}
+	key, err := selectKey(keys, first)
+	if err != nil {
+		return nil, err
+	}
+	return cryptutils.OpenDecryptedFile(inputPath, key)
+}
+
+// openFirmwareZip reads the central directory of the decrypted firmware
+// zip.
+func openFirmwareZip(file *cryptutils.DecryptedFile) (*zip.Reader, error) {
+	zr, err := zip.NewReader(file, file.Size())
+	if err != nil {
+		if fuserr.CodeOf(err) != "" {
+			return nil, err
+		}
+		return nil, fuserr.Wrap(fuserr.CodeBadKey, err, "the decrypted firmware is not a zip file, is the key right?")
+	}
+	return zr, nil
+}
+
+// parseOnly splits a comma-separated --only value.
+func parseOnly(value string) []string {
+	var only []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			only = append(only, name)
+		}
+	}
+	return only
+}
+
+// matchEntry reports whether a zip entry is one of only. An item matches
+// the entry's full name or the start of it up to an underscore, so "CSC"
+// selects CSC_OXM_S9110CHC1AWA1_MULTI_CERT.tar.md5 but not HOME_CSC_...,
+// which "HOME_CSC" selects. Case is ignored.
+func matchEntry(name string, only []string) bool {
+	base := strings.ToUpper(filepath.Base(name))
+	for _, item := range only {
+		item = strings.ToUpper(item)
+		if base == item || strings.HasPrefix(base, item+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyFirmwareZip reads every file of the decrypted firmware zip at
+// path, which makes archive/zip check its CRC32, and fails with
+// CodeChecksum on the first damaged one.
+func VerifyFirmwareZip(ctx context.Context, path string, progressCallback ProgressCallback) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return fuserr.Wrap(fuserr.CodeChecksum, err, "the decrypted firmware is not a valid zip file")
+	}
+	defer zr.Close()
+
+	var total int64
+	for _, f := range zr.File {
+		total += int64(f.UncompressedSize64)
+	}
+	reporter := progress.NewReporter(0, func(u progress.Update) {
+		if progressCallback != nil {
+			progressCallback(u.Current, u.Total, u.BytesPerSecond)
+		}
+	})
+	reporter.Start(progress.PhaseVerify, 0, total)
+	buf := make([]byte, cryptutils.DecryptChunkSize)
+	files := 0
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if err := verifyEntry(ctx, f, buf, reporter); err != nil {
+			return err
+		}
+		files++
+	}
+	reporter.Flush()
+	fmt.Printf("\nAll %d files of %s are intact.\n", files, path)
+	return nil
+}
+
+// verifyEntry reads one zip entry to its end using buf.
+func verifyEntry(ctx context.Context, f *zip.File, buf []byte, reporter *progress.Reporter) error {
+	src, err := f.Open()
+	if err != nil {
+		return fuserr.Wrap(fuserr.CodeChecksum, err, "error opening "+f.Name)
+	}
+	defer src.Close()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := src.Read(buf)
+		reporter.Add(int64(n))
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fuserr.Wrap(fuserr.CodeChecksum, err, f.Name+" is damaged")
+		}
+	}
+}
+
+// printEntries prints the files of zr as a table.
+func printEntries(zr *zip.Reader) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSIZE")
+	for _, f := range zr.File {
+		if !f.FileInfo().IsDir() {
+			fmt.Fprintf(w, "%s\t%s\n", f.Name, progress.FormatBytes(int64(f.UncompressedSize64)))
+		}
+	}
+	w.Flush()
+}
+
+// extractEntries writes the entries of zr that match only to dir and
+// returns their names. Each entry is written to a temporary file first, so
+// an interrupted extraction leaves no truncated tar behind. reporter gets
+// the progress of every entry as PhaseExtract.
+func extractEntries(ctx context.Context, zr *zip.Reader, only []string, dir string, reporter *progress.Reporter) ([]string, error) {
+	var selected []*zip.File
+	var need int64
+	for _, f := range zr.File {
+		if !f.FileInfo().IsDir() && matchEntry(f.Name, only) {
+			selected = append(selected, f)
+			need += int64(f.UncompressedSize64)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fuserr.New(fuserr.CodeNotFound, "no entry of the firmware matches %s", strings.Join(only, ","))
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fuserr.Wrap(fuserr.CodeDisk, err, "error creating output directory")
+	}
+	if err := diskspace.Check(dir, need); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range selected {
+		if err := extractEntry(ctx, f, dir, reporter); err != nil {
+			return nil, err
+		}
+		names = append(names, filepath.Base(f.Name))
+	}
+	return names, nil
+}
+
+// extractEntry writes one zip entry to dir under its base name.
+func extractEntry(ctx context.Context, f *zip.File, dir string, reporter *progress.Reporter) error {
+	target := filepath.Join(dir, filepath.Base(f.Name))
+	fmt.Printf("Extracting %s to %s\n", f.Name, target)
+	src, err := f.Open()
+	if err != nil {
+		return fuserr.Wrap(fuserr.CodeBadKey, err, "error opening "+f.Name)
+	}
+	defer src.Close()
+
+	tmpPath := target + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return fuserr.Wrap(fuserr.CodeDisk, err, "error creating output file")
+	}
+	defer func() {
+		out.Close()
+		os.Remove(tmpPath)
+	}()
+
+	reporter.Start(progress.PhaseExtract, 0, int64(f.UncompressedSize64))
+	var written int64
+	buf := make([]byte, cryptutils.DecryptChunkSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			if _, err := out.Write(buf[:n]); err != nil {
+				return fuserr.Wrap(fuserr.CodeDisk, err, "error writing "+target)
+			}
+			written += int64(n)
+			reporter.Set(written)
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			// zip reports a CRC mismatch of the entry here.
+			return fuserr.Wrap(fuserr.CodeChecksum, readErr, "error extracting "+f.Name)
+		}
+	}
+	reporter.Flush()
+
+	err = out.Sync()
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, target)
+	}
+	if err != nil {
+		return fuserr.Wrap(fuserr.CodeDisk, err, "error finishing "+target)
+	}
+	fmt.Println()
+	return nil
+}
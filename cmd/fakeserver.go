@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"samsung-firmware-tool/internal/fusclient"
+	"samsung-firmware-tool/internal/fustest"
+
+	"github.com/spf13/cobra"
+)
+
+var fakeServerListen string
+
+// FakeServerCmd runs the fustest server for integration tests
+var FakeServerCmd = &cobra.Command{
+	Use:    "fake-server",
+	Short:  "Run a local fake Samsung server",
+	Long:   `This command serves the FUS, download and FOTA endpoints locally for one firmware, so that check, download and decrypt can be tested without internet access.`,
+	Hidden: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		fw := fustest.Firmware{Model: model, Region: region, Version: fwVersion}
+		if fw.Model == "" {
+			fw.Model = "SM-S9110"
+		}
+		if fw.Region == "" {
+			fw.Region = "CHC"
+		}
+		if fw.Version == "" {
+			fw.Version = "S9110ZCU1AWA1/S9110CHC1AWA1/S9110ZCU1AWA1/S9110ZCU1AWA1"
+		}
+		handler, err := fustest.NewHandler(fw)
+		if err != nil {
+			return err
+		}
+
+		listener, err := net.Listen("tcp", fakeServerListen)
+		if err != nil {
+			return err
+		}
+		url := "http://" + listener.Addr().String()
+		fmt.Printf("Serving %s %s %s on %s\n", fw.Model, fw.Region, fw.Version, url)
+		fmt.Printf("export %s=%s %s=%s %s=%s\n", fusclient.EnvFusURL, url, fusclient.EnvDownloadURL, url, fusclient.EnvFotaURL, url)
+
+		server := &http.Server{Handler: handler}
+		ctx := commandContext(cmd)
+		go func() {
+			<-ctx.Done()
+			server.Shutdown(context.Background())
+		}()
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(FakeServerCmd)
+	FakeServerCmd.Flags().StringVar(&fakeServerListen, "listen", "127.0.0.1:0", T("fake_server_listen_desc"))
+}
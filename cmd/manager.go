@@ -0,0 +1,708 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"samsung-firmware-tool/internal/filelock"
+	"samsung-firmware-tool/internal/fusclient"
+	"samsung-firmware-tool/internal/fuserr"
+)
+
+// DefaultConcurrentDownloads is the number of jobs a DownloadManager runs
+// at the same time.
+const DefaultConcurrentDownloads = 2
+
+var (
+	// ErrJobExists is returned by Add for a firmware that is already queued
+	// for the same output directory; both would write the same .part file.
+	ErrJobExists = errors.New("this firmware is already queued for this output directory")
+
+	// ErrJobNotFound is returned for an unknown job ID.
+	ErrJobNotFound = errors.New("download job not found")
+
+	// ErrQueueInUse is returned by NewDownloadManager for a queue file that
+	// another manager, e.g. a running queue run, holds.
+	ErrQueueInUse = errors.New("the download queue is in use by another process")
+)
+
+// Job is a download in the queue of a DownloadManager. The fields up to
+// Priority describe the download; the others are maintained by the manager.
+type Job struct {
+	ID          string `json:"id"`
+	Model       string `json:"model"`
+	Region      string `json:"region"`
+	FwVersion   string `json:"version"`
+	ImeiSerial  string `json:"imei"`
+	OutputPath  string `json:"outputPath"`
+	Connections int    `json:"connections,omitempty"` // 0 uses DefaultConnections
+	Decrypt     bool   `json:"decrypt,omitempty"`
+	RateLimit   int64  `json:"rateLimit,omitempty"` // Bytes per second, 0 is unlimited
+	Priority    int    `json:"priority"`            // Higher priorities start first
+
+	Seq            int64          `json:"seq"` // Queue order within a priority
+	Status         DownloadStatus `json:"status"`
+	FileName       string         `json:"fileName,omitempty"`
+	CurrentSize    int64          `json:"currentSize"`
+	TotalSize      int64          `json:"totalSize"`
+	BytesPerSecond int64          `json:"bytesPerSecond,omitempty"` // While running
+	Error          string         `json:"error,omitempty"`
+	Code           fuserr.Code    `json:"code,omitempty"` // fuserr code of Error
+	AddedAt        time.Time      `json:"addedAt"`
+}
+
+// Queued reports whether the job waits for a free slot.
+func (j Job) Queued() bool {
+	return j.Status == StatusIdle
+}
+
+// Running reports whether the job is being downloaded or verified.
+func (j Job) Running() bool {
+	return j.Status == StatusInitializing || j.Status == StatusDownloading || j.Status == StatusVerifying
+}
+
+// sameTarget reports whether both jobs download the same firmware into
+// the same directory.
+func (j Job) sameTarget(other Job) bool {
+	return j.Model == other.Model && j.Region == other.Region &&
+		j.FwVersion == other.FwVersion && filepath.Clean(j.OutputPath) == filepath.Clean(other.OutputPath)
+}
+
+// stopReason tells a finishing job why its task was stopped.
+type stopReason int
+
+const (
+	stopNone stopReason = iota
+	stopPause
+	stopCancel
+)
+
+// managedJob is a Job with the state of its running task.
+type managedJob struct {
+	Job
+	task        *DownloadTask
+	client      *fusclient.FusClient // Taken from Clients while running
+	cancel      context.CancelFunc   // Stops the task
+	stop        stopReason
+	deleteFiles bool
+}
+
+// savedQueue is the on-disk form of the queue.
+type savedQueue struct {
+	Concurrency int   `json:"concurrency"`
+	Jobs        []Job `json:"jobs"`
+}
+
+// DownloadManager runs download jobs from a queue, at most Concurrency at
+// a time, in the order of their priority and then of Add. The queue is
+// kept in a file, so jobs that were queued, running or paused when the
+// process stopped are queued or paused again by the next manager.
+//
+// A paused job gives up its slot and keeps its .part file; resuming it
+// puts it back into the queue at its old position.
+//
+// A manager holds an exclusive lock on its queue file until Close, so no
+// other process changes the queue under it.
+type DownloadManager struct {
+	// NewTask creates the task of a job with the client it is to use. It
+	// defaults to NewDownloadTaskWithClient and can be replaced before Run,
+	// e.g. to set callbacks.
+	NewTask func(job Job, client *fusclient.FusClient) *DownloadTask
+
+	// Clients gives every running job a FusClient of its own, so that jobs
+	// never share a nonce. It holds Concurrency clients of clientOptions()
+	// and can be replaced before Run, e.g. to use other endpoints.
+	Clients *fusclient.Pool
+
+	// OnProgress is called with the job whenever its task reports
+	// progress, OnChange whenever its status changes.
+	OnProgress func(job Job)
+	OnChange   func(job Job)
+
+	path string
+	lock *filelock.Lock
+
+	mu          sync.Mutex
+	concurrency int
+	jobs        map[string]*managedJob
+	nextSeq     int64
+	running     int
+	ctx         context.Context // Set by Run; nil while jobs are only queued
+	wg          sync.WaitGroup
+	changed     chan struct{} // Closed and replaced on every status change
+}
+
+// NewDownloadManager returns a manager whose queue is kept in the file at
+// path, loading the jobs already in it. An empty path keeps the queue in
+// memory only. concurrency < 1 uses the saved value or
+// DefaultConcurrentDownloads. While another manager holds the queue file,
+// it fails with ErrQueueInUse.
+func NewDownloadManager(path string, concurrency int) (*DownloadManager, error) {
+	m := &DownloadManager{
+		NewTask: func(job Job, client *fusclient.FusClient) *DownloadTask {
+			task := NewDownloadTaskWithClient(client, job.Model, job.Region, job.FwVersion, job.ImeiSerial, job.OutputPath, nil)
+			task.Preallocate = preallocate
+			return task
+		},
+		path:        path,
+		concurrency: DefaultConcurrentDownloads,
+		jobs:        make(map[string]*managedJob),
+		nextSeq:     1,
+		changed:     make(chan struct{}),
+	}
+	if path != "" {
+		lock, err := filelock.TryLock(path + ".lock")
+		if errors.Is(err, filelock.ErrLocked) {
+			return nil, fmt.Errorf("%w: %s", ErrQueueInUse, path)
+		}
+		if err != nil {
+			return nil, fuserr.Wrap(fuserr.CodeDisk, err, "error locking download queue")
+		}
+		m.lock = lock
+	}
+	if err := m.load(); err != nil {
+		m.lock.Unlock()
+		return nil, err
+	}
+	if concurrency > 0 {
+		m.concurrency = concurrency
+	}
+	m.Clients = fusclient.NewPool(clientOptions(), m.concurrency)
+	return m, nil
+}
+
+// DefaultQueueFile returns the default location of the download queue, in
+// the user's cache directory, or "" if there is none.
+func DefaultQueueFile() string {
+	return cacheFile("queue.json")
+}
+
+// DefaultLibraryQueueFile returns the default location of the download
+// queue of the shared library. It is kept apart from DefaultQueueFile, so
+// that the library and the CLI do not lock each other out.
+func DefaultLibraryQueueFile() string {
+	return cacheFile("library-queue.json")
+}
+
+// cacheFile returns the path of name in the user's cache directory, or ""
+// if there is none.
+func cacheFile(name string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "samloadGo", name)
+}
+
+// Close releases the queue file for other managers. Call it once Run has
+// returned.
+func (m *DownloadManager) Close() error {
+	return m.lock.Unlock()
+}
+
+// ReadQueue returns the jobs saved in the queue file at path in queue
+// order, without locking it. While a manager runs them, their status is
+// the one it last saved.
+func ReadQueue(path string) ([]Job, error) {
+	q, err := readQueue(path)
+	if err != nil {
+		return nil, err
+	}
+	sortJobs(q.Jobs)
+	return q.Jobs, nil
+}
+
+// readQueue reads a queue file. A missing file is an empty queue.
+func readQueue(path string) (savedQueue, error) {
+	var q savedQueue
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return q, fuserr.Wrap(fuserr.CodeDisk, err, "error reading download queue")
+	}
+	if err := json.Unmarshal(data, &q); err != nil {
+		return q, fuserr.Wrap(fuserr.CodeDisk, err, fmt.Sprintf("invalid download queue %s", path))
+	}
+	return q, nil
+}
+
+// load reads the queue file. Jobs that were running are queued again.
+func (m *DownloadManager) load() error {
+	if m.path == "" {
+		return nil
+	}
+	q, err := readQueue(m.path)
+	if err != nil {
+		return err
+	}
+	if q.Concurrency > 0 {
+		m.concurrency = q.Concurrency
+	}
+	for _, job := range q.Jobs {
+		if job.Running() {
+			job.Status = StatusIdle
+		}
+		m.jobs[job.ID] = &managedJob{Job: job}
+		m.nextSeq = max(m.nextSeq, job.Seq+1)
+	}
+	return nil
+}
+
+// saveLocked writes the queue file, replacing it atomically. m.mu must be
+// held.
+func (m *DownloadManager) saveLocked() error {
+	if m.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(savedQueue{Concurrency: m.concurrency, Jobs: m.sortedLocked()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0755); err != nil {
+		return fuserr.Wrap(fuserr.CodeDisk, err, "error saving download queue")
+	}
+	tmpPath := m.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		os.Remove(tmpPath)
+		return fuserr.Wrap(fuserr.CodeDisk, err, "error saving download queue")
+	}
+	if err := os.Rename(tmpPath, m.path); err != nil {
+		os.Remove(tmpPath)
+		return fuserr.Wrap(fuserr.CodeDisk, err, "error saving download queue")
+	}
+	return nil
+}
+
+// sortedLocked returns copies of the jobs in queue order. m.mu must be held.
+func (m *DownloadManager) sortedLocked() []Job {
+	jobs := make([]Job, 0, len(m.jobs))
+	for _, mj := range m.jobs {
+		jobs = append(jobs, mj.Job)
+	}
+	sortJobs(jobs)
+	return jobs
+}
+
+// sortJobs sorts jobs into queue order.
+func sortJobs(jobs []Job) {
+	sort.Slice(jobs, func(a, b int) bool {
+		if jobs[a].Priority != jobs[b].Priority {
+			return jobs[a].Priority > jobs[b].Priority
+		}
+		return jobs[a].Seq < jobs[b].Seq
+	})
+}
+
+// Add queues a download and returns it with its ID. A job for a firmware
+// that is already queued, running or paused for the same directory is
+// rejected with ErrJobExists and that job.
+func (m *DownloadManager) Add(job Job) (Job, error) {
+	if job.Model == "" || job.Region == "" || job.FwVersion == "" || job.ImeiSerial == "" || job.OutputPath == "" {
+		return Job{}, errors.New("model, region, firmware version, IMEI/serial and output path are required")
+	}
+
+	m.mu.Lock()
+	for _, mj := range m.jobs {
+		if !mj.Status.Done() && mj.sameTarget(job) {
+			m.mu.Unlock()
+			return mj.Job, ErrJobExists
+		}
+	}
+	job.Seq = m.nextSeq
+	m.nextSeq++
+	job.ID = strconv.FormatInt(job.Seq, 10)
+	job.Status = StatusIdle
+	job.FileName, job.CurrentSize, job.TotalSize, job.BytesPerSecond = "", 0, 0, 0
+	job.Error, job.Code = "", ""
+	job.AddedAt = time.Now()
+	m.jobs[job.ID] = &managedJob{Job: job}
+	err := m.saveLocked()
+	m.changedLocked()
+	m.scheduleLocked()
+	m.mu.Unlock()
+
+	m.notifyChange(job)
+	return job, err
+}
+
+// Job returns the job with the given ID.
+func (m *DownloadManager) Job(id string) (Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mj, ok := m.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return mj.Job, true
+}
+
+// Find returns the unfinished job that downloads the firmware into
+// outputPath.
+func (m *DownloadManager) Find(model, region, fwVersion, outputPath string) (Job, bool) {
+	target := Job{Model: model, Region: region, FwVersion: fwVersion, OutputPath: outputPath}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, mj := range m.jobs {
+		if !mj.Status.Done() && mj.sameTarget(target) {
+			return mj.Job, true
+		}
+	}
+	return Job{}, false
+}
+
+// Jobs returns all jobs in queue order.
+func (m *DownloadManager) Jobs() []Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sortedLocked()
+}
+
+// Concurrency returns the number of jobs that run at the same time.
+func (m *DownloadManager) Concurrency() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.concurrency
+}
+
+// SetConcurrency changes the number of jobs that run at the same time.
+// Lowering it lets running jobs finish rather than pausing them.
+func (m *DownloadManager) SetConcurrency(n int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.concurrency = max(n, 1)
+	m.Clients.SetSize(m.concurrency)
+	m.scheduleLocked()
+	return m.saveLocked()
+}
+
+// SetPriority changes the priority of a job. It moves a queued job ahead
+// of or behind other queued jobs; a running job keeps running.
+func (m *DownloadManager) SetPriority(id string, priority int) error {
+	return m.update(id, func(mj *managedJob) error {
+		mj.Priority = priority
+		return nil
+	})
+}
+
+// SetRateLimit changes the speed limit of a job in bytes per second, also
+// while it is downloading. 0 removes the limit.
+func (m *DownloadManager) SetRateLimit(id string, bytesPerSecond int64) error {
+	return m.update(id, func(mj *managedJob) error {
+		mj.RateLimit = bytesPerSecond
+		if mj.task != nil {
+			mj.task.SetRateLimit(bytesPerSecond)
+		}
+		return nil
+	})
+}
+
+// Pause holds a queued job back, or stops a running one and keeps its
+// partial download.
+func (m *DownloadManager) Pause(id string) error {
+	return m.update(id, func(mj *managedJob) error {
+		switch {
+		case mj.Queued():
+			mj.Status = StatusPaused
+		case mj.Running():
+			mj.stop = stopPause
+			mj.cancel()
+		case mj.Status != StatusPaused:
+			return &TransitionError{From: mj.Status, To: StatusPaused}
+		}
+		return nil
+	})
+}
+
+// Resume queues a paused, failed or cancelled job again. It continues
+// from its partial download if there is one.
+func (m *DownloadManager) Resume(id string) error {
+	return m.update(id, func(mj *managedJob) error {
+		switch mj.Status {
+		case StatusPaused, StatusFailed, StatusCancelled:
+			for _, other := range m.jobs {
+				if other != mj && !other.Status.Done() && other.sameTarget(mj.Job) {
+					return ErrJobExists
+				}
+			}
+			mj.Status = StatusIdle
+			mj.Error, mj.Code = "", ""
+		case StatusCompleted:
+			return &TransitionError{From: mj.Status, To: StatusIdle}
+		}
+		return nil
+	})
+}
+
+// Cancel stops a job for good. With deleteFiles its .part file and resume
+// state are removed.
+func (m *DownloadManager) Cancel(id string, deleteFiles bool) error {
+	return m.update(id, func(mj *managedJob) error {
+		switch {
+		case mj.Running():
+			mj.stop = stopCancel
+			mj.deleteFiles = deleteFiles
+			mj.cancel()
+		case mj.Status == StatusCompleted:
+			return &TransitionError{From: mj.Status, To: StatusCancelled}
+		default:
+			mj.Status = StatusCancelled
+			if deleteFiles {
+				discardPartFiles(mj.OutputPath, mj.FileName)
+			}
+		}
+		return nil
+	})
+}
+
+// Remove deletes a job that is not running from the queue.
+func (m *DownloadManager) Remove(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mj, ok := m.jobs[id]
+	if !ok {
+		return ErrJobNotFound
+	}
+	if mj.Running() {
+		return fmt.Errorf("job %s is running; cancel it first", id)
+	}
+	delete(m.jobs, id)
+	m.changedLocked()
+	return m.saveLocked()
+}
+
+// update applies fn to a job, saves the queue and starts queued jobs.
+func (m *DownloadManager) update(id string, fn func(mj *managedJob) error) error {
+	m.mu.Lock()
+	mj, ok := m.jobs[id]
+	if !ok {
+		m.mu.Unlock()
+		return ErrJobNotFound
+	}
+	if err := fn(mj); err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	job := mj.Job
+	err := m.saveLocked()
+	m.changedLocked()
+	m.scheduleLocked()
+	m.mu.Unlock()
+
+	m.notifyChange(job)
+	return err
+}
+
+// Run starts queued jobs until ctx is done. Running jobs are then stopped
+// and queued again, and Run returns once they have stopped.
+func (m *DownloadManager) Run(ctx context.Context) error {
+	m.mu.Lock()
+	if m.ctx != nil {
+		m.mu.Unlock()
+		return errors.New("download manager is already running")
+	}
+	m.ctx = ctx
+	m.scheduleLocked()
+	m.mu.Unlock()
+
+	<-ctx.Done()
+	m.wg.Wait()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ctx = nil
+	return m.saveLocked()
+}
+
+// scheduleLocked starts queued jobs while there are free slots. m.mu must
+// be held.
+func (m *DownloadManager) scheduleLocked() {
+	if m.ctx == nil || m.ctx.Err() != nil {
+		return
+	}
+	for _, job := range m.sortedLocked() {
+		if m.running >= m.concurrency {
+			return
+		}
+		if job.Queued() && !m.startLocked(m.jobs[job.ID]) {
+			return
+		}
+	}
+}
+
+// startLocked runs the task of a job in a new goroutine with a client from
+// Clients. It returns false if no client is free. m.mu must be held.
+func (m *DownloadManager) startLocked(mj *managedJob) bool {
+	client := m.Clients.TryAcquire()
+	if client == nil {
+		return false
+	}
+	task := m.NewTask(mj.Job, client)
+	if mj.Connections > 0 {
+		task.Connections = mj.Connections
+	}
+	task.Decrypt = mj.Decrypt
+	task.SetRateLimit(mj.RateLimit)
+	onProgress := task.OnProgress
+	task.OnProgress = func(current, max, bps int64) {
+		if onProgress != nil {
+			onProgress(current, max, bps)
+		}
+		m.progress(mj, task.Snapshot())
+	}
+
+	ctx, cancel := context.WithCancel(m.ctx)
+	mj.task = task
+	mj.client = client
+	mj.cancel = cancel
+	mj.stop = stopNone
+	mj.deleteFiles = false
+	mj.Status = StatusInitializing
+	mj.Error, mj.Code = "", ""
+	m.running++
+	m.saveLocked()
+	m.changedLocked()
+
+	job := mj.Job
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer cancel()
+		m.notifyChange(job)
+		err := task.StartContext(ctx)
+		m.finish(mj, task.Snapshot(), err)
+	}()
+	return true
+}
+
+// progress records the state of a running task.
+func (m *DownloadManager) progress(mj *managedJob, s DownloadSnapshot) {
+	m.mu.Lock()
+	if mj.task == nil {
+		m.mu.Unlock()
+		return
+	}
+	changed := s.Status != mj.Status && !s.Status.Done() && s.Status != StatusPaused
+	mj.FileName = s.FileName
+	mj.CurrentSize = s.CurrentSize
+	mj.TotalSize = s.TotalSize
+	mj.BytesPerSecond = s.BytesPerSecond
+	if changed {
+		mj.Status = s.Status
+		m.changedLocked()
+	}
+	job := mj.Job
+	m.mu.Unlock()
+
+	if m.OnProgress != nil {
+		m.OnProgress(job)
+	}
+	if changed {
+		m.notifyChange(job)
+	}
+}
+
+// finish records how the task of a job ended and starts the next jobs.
+func (m *DownloadManager) finish(mj *managedJob, s DownloadSnapshot, err error) {
+	m.mu.Lock()
+	m.Clients.Release(mj.client)
+	mj.task = nil
+	mj.client = nil
+	mj.cancel = nil
+	mj.FileName = s.FileName
+	mj.CurrentSize = s.CurrentSize
+	mj.TotalSize = s.TotalSize
+	mj.BytesPerSecond = 0
+	switch {
+	case mj.stop == stopPause:
+		mj.Status = StatusPaused
+	case mj.stop == stopCancel:
+		mj.Status = StatusCancelled
+		if mj.deleteFiles {
+			discardPartFiles(mj.OutputPath, mj.FileName)
+		}
+	case s.Status == StatusCancelled:
+		// The manager is stopping; run the job again next time.
+		mj.Status = StatusIdle
+	case err != nil:
+		mj.Status = StatusFailed
+		mj.Error = err.Error()
+		mj.Code = fuserr.CodeOf(err)
+	default:
+		mj.Status = StatusCompleted
+	}
+	m.running--
+	job := mj.Job
+	m.saveLocked()
+	m.changedLocked()
+	m.scheduleLocked()
+	m.mu.Unlock()
+
+	m.notifyChange(job)
+}
+
+// changedLocked wakes Wait and WaitIdle. m.mu must be held.
+func (m *DownloadManager) changedLocked() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// notifyChange calls OnChange.
+func (m *DownloadManager) notifyChange(job Job) {
+	if m.OnChange != nil {
+		m.OnChange(job)
+	}
+}
+
+// Wait blocks until the job is completed, failed or cancelled, or ctx is
+// done, and returns the job.
+func (m *DownloadManager) Wait(ctx context.Context, id string) (Job, error) {
+	for {
+		m.mu.Lock()
+		mj, ok := m.jobs[id]
+		if !ok {
+			m.mu.Unlock()
+			return Job{}, ErrJobNotFound
+		}
+		job, changed := mj.Job, m.changed
+		m.mu.Unlock()
+		if job.Status.Done() {
+			return job, nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return job, ctx.Err()
+		}
+	}
+}
+
+// WaitIdle blocks until no job is queued or running, or ctx is done.
+func (m *DownloadManager) WaitIdle(ctx context.Context) error {
+	for {
+		m.mu.Lock()
+		busy := false
+		for _, mj := range m.jobs {
+			busy = busy || mj.Queued() || mj.Running()
+		}
+		changed := m.changed
+		m.mu.Unlock()
+		if !busy {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
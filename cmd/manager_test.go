@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// TestQueueLock checks that only one manager at a time uses a queue file,
+// while ReadQueue still sees the jobs it saved.
+func TestQueueLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+	m, err := NewDownloadManager(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := m.Add(Job{Model: "SM-S9110", Region: "CHC", FwVersion: testVersion, ImeiSerial: "123456789012345", OutputPath: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewDownloadManager(path, 1); !errors.Is(err, ErrQueueInUse) {
+		t.Fatalf("second manager = %v, want ErrQueueInUse", err)
+	}
+	jobs, err := ReadQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != job.ID {
+		t.Fatalf("ReadQueue = %+v, want job %s", jobs, job.ID)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewDownloadManager(path, 1)
+	if err != nil {
+		t.Fatalf("manager after Close = %v", err)
+	}
+	defer other.Close()
+	if _, ok := other.Job(job.ID); !ok {
+		t.Errorf("job %s was not loaded", job.ID)
+	}
+}
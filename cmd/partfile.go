@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"samsung-firmware-tool/internal/fusclient"
+)
+
+const (
+	// partSuffix is appended to the file name while it is downloaded. The
+	// file gets its final name once it has been verified.
+	partSuffix = ".part"
+
+	// stateSuffix names the sidecar that identifies a .part file and
+	// records how much of it is on disk.
+	stateSuffix = ".part.json"
+
+	// stateSaveInterval is how often the .part file is synced and the
+	// sidecar updated.
+	stateSaveInterval = 5 * time.Second
+)
+
+// downloadState is the sidecar of a .part file. A .part file is only
+// resumed when the firmware fields match what the server reports now.
+type downloadState struct {
+	Model     string              `json:"model"`
+	Region    string              `json:"region"`
+	Version   string              `json:"version"`
+	FileName  string              `json:"fileName"`
+	CRC32     uint32              `json:"crc32"`     // BINARY_CRC
+	Size      int64               `json:"size"`      // BINARY_BYTE_SIZE
+	Confirmed int64               `json:"confirmed"` // Bytes synced to disk
+	IMEI      string              `json:"imei"`      // IMEI or serial used for BinaryInform
+	Decrypted bool                `json:"decrypted"` // The .part file holds the plaintext
+	Segments  []fusclient.Segment `json:"segments"`
+}
+
+// newDownloadState returns the sidecar of the task with the given progress.
+func (dt *DownloadTask) newDownloadState(segments []fusclient.Segment) downloadState {
+	state := downloadState{
+		Model:     dt.Model,
+		Region:    dt.Region,
+		Version:   dt.FwVersion,
+		FileName:  dt.binaryInfo.FileName,
+		CRC32:     dt.binaryInfo.CRC32,
+		Size:      dt.binaryInfo.Size,
+		IMEI:      dt.ImeiSerial,
+		Decrypted: dt.Decrypt,
+		Segments:  segments,
+	}
+	for _, seg := range segments {
+		state.Confirmed += seg.Done
+	}
+	return state
+}
+
+// sameFirmware reports whether both states describe the same file.
+func (s downloadState) sameFirmware(other downloadState) bool {
+	return s.Model == other.Model &&
+		s.Region == other.Region &&
+		s.Version == other.Version &&
+		s.FileName == other.FileName &&
+		s.CRC32 == other.CRC32 &&
+		s.Size == other.Size &&
+		s.Decrypted == other.Decrypted
+}
+
+// consistent reports whether the segments cover the file and add up to
+// the confirmed bytes.
+func (s downloadState) consistent() bool {
+	var next, done int64
+	for _, seg := range s.Segments {
+		if seg.Start != next || seg.End <= seg.Start || seg.Done < 0 || seg.Start+seg.Done > seg.End {
+			return false
+		}
+		next = seg.End
+		done += seg.Done
+	}
+	return next == s.Size && done == s.Confirmed
+}
+
+// resumeSegments returns the progress recorded in the sidecar at
+// statePath, or nil if the .part file at partPath cannot be resumed for
+// the firmware the server offers now. In that case both files are removed.
+func (dt *DownloadTask) resumeSegments(partPath, statePath string) []fusclient.Segment {
+	_, partErr := os.Stat(partPath)
+	data, stateErr := os.ReadFile(statePath)
+	if os.IsNotExist(partErr) && os.IsNotExist(stateErr) {
+		return nil
+	}
+
+	var state downloadState
+	if partErr == nil && stateErr == nil && json.Unmarshal(data, &state) == nil &&
+		state.sameFirmware(dt.newDownloadState(nil)) && state.consistent() {
+		return state.Segments
+	}
+
+	fmt.Printf("Discarding %s, it does not belong to this firmware or has no valid resume state.\n", partPath)
+	os.Remove(partPath)
+	os.Remove(statePath)
+	return nil
+}
+
+// saveState syncs the .part file and then records segments in the
+// sidecar, so that the sidecar never claims bytes that are not on disk.
+// The sidecar is replaced atomically. Failures only cost the ability to
+// resume, so they are ignored.
+func (dt *DownloadTask) saveState(statePath string, segments []fusclient.Segment) {
+	if err := dt.outputFile.Sync(); err != nil {
+		return
+	}
+	data, err := json.MarshalIndent(dt.newDownloadState(segments), "", "  ")
+	if err != nil {
+		return
+	}
+	tmpPath := statePath + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, statePath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+}
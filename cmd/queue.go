@@ -0,0 +1,235 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"samsung-firmware-tool/internal/fusclient"
+	"samsung-firmware-tool/internal/ratelimit"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	queueFile        string
+	queueJobs        int
+	queuePriority    int
+	queueConnections int
+	queueLimit       string
+	queueDecrypt     bool
+	queueDelete      bool
+)
+
+// QueueCmd manages the persistent download queue
+var QueueCmd = &cobra.Command{
+	Use:   "queue",
+	Short: "Manage the download queue",
+	Long:  `This command queues firmware downloads and runs several of them at the same time. The queue is kept in a file, so queued and paused downloads survive a restart.`,
+}
+
+var queueAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Add a download to the queue",
+	Run: func(cmd *cobra.Command, args []string) {
+		if model == "" || region == "" || fwVersion == "" || imeiSerial == "" || outputFile == "" {
+			fmt.Println(T("err_download_required"))
+			os.Exit(ExitUsage)
+		}
+		limit, err := ratelimit.ParseRate(queueLimit)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(ExitUsage)
+		}
+		m := openQueue(0)
+		job, err := m.Add(Job{
+			Model:       model,
+			Region:      region,
+			FwVersion:   fwVersion,
+			ImeiSerial:  imeiSerial,
+			OutputPath:  outputFile,
+			Connections: queueConnections,
+			Decrypt:     queueDecrypt,
+			RateLimit:   limit,
+			Priority:    queuePriority,
+		})
+		if err != nil {
+			fmt.Printf("%v (job %s)\n", err, job.ID)
+			os.Exit(ExitUsage)
+		}
+		fmt.Printf(T("queue_added"), job.ID)
+	},
+}
+
+var queueListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the downloads in the queue",
+	Run: func(cmd *cobra.Command, args []string) {
+		// Read the file rather than lock it, so that list also works
+		// while queue run is active.
+		jobs, err := ReadQueue(queueFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(ExitCode(err))
+		}
+		printJobs(jobs)
+	},
+}
+
+var queueRunCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Run the queued downloads",
+	Long:  `This command runs the queued downloads, --jobs at a time, until none is left. Ctrl+C stops it; unfinished downloads stay queued and resume on the next run.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		m := openQueue(queueJobs)
+		m.NewTask = func(job Job, client *fusclient.FusClient) *DownloadTask {
+			task := NewDownloadTaskWithClient(client, job.Model, job.Region, job.FwVersion, job.ImeiSerial, job.OutputPath, nil)
+			task.Preallocate = preallocate
+			task.OnFinish = func(msg string) {
+				fmt.Printf("[%s] %s\n", job.ID, strings.TrimSpace(msg))
+			}
+			task.OnError = func(err error) {
+				fmt.Printf("[%s] Error: %v\n", job.ID, err)
+			}
+			return task
+		}
+		m.OnChange = func(job Job) {
+			fmt.Printf("[%s] %s %s: %s\n", job.ID, job.Model, job.FwVersion, jobStatus(job))
+		}
+
+		ctx := commandContext(cmd)
+		runCtx, stop := context.WithCancel(ctx)
+		done := make(chan error, 1)
+		go func() { done <- m.Run(runCtx) }()
+		waitErr := m.WaitIdle(ctx)
+		stop()
+		if err := <-done; err != nil {
+			fmt.Println(err)
+			os.Exit(ExitCode(err))
+		}
+		if waitErr != nil {
+			os.Exit(ExitCode(waitErr))
+		}
+		printJobs(m.Jobs())
+		for _, job := range m.Jobs() {
+			if job.Status == StatusFailed {
+				os.Exit(ExitError)
+			}
+		}
+	},
+}
+
+var queuePauseCmd = &cobra.Command{
+	Use:   "pause ID",
+	Short: "Pause a queued download",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		exitOnQueueError(openQueue(0).Pause(args[0]))
+	},
+}
+
+var queueResumeCmd = &cobra.Command{
+	Use:   "resume ID",
+	Short: "Queue a paused, failed or cancelled download again",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		exitOnQueueError(openQueue(0).Resume(args[0]))
+	},
+}
+
+var queueCancelCmd = &cobra.Command{
+	Use:   "cancel ID",
+	Short: "Cancel a download",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		exitOnQueueError(openQueue(0).Cancel(args[0], queueDelete))
+	},
+}
+
+var queueRemoveCmd = &cobra.Command{
+	Use:   "remove ID",
+	Short: "Remove a download from the queue",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		exitOnQueueError(openQueue(0).Remove(args[0]))
+	},
+}
+
+var queuePriorityCmd = &cobra.Command{
+	Use:   "priority ID PRIORITY",
+	Short: "Change the priority of a download",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		priority, err := strconv.Atoi(args[1])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(ExitUsage)
+		}
+		exitOnQueueError(openQueue(0).SetPriority(args[0], priority))
+	},
+}
+
+// openQueue loads and locks the queue file or exits, e.g. while queue run
+// holds it.
+func openQueue(concurrency int) *DownloadManager {
+	m, err := NewDownloadManager(queueFile, concurrency)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(ExitCode(err))
+	}
+	return m
+}
+
+// exitOnQueueError exits with the code of a failed queue change.
+func exitOnQueueError(err error) {
+	if err == nil {
+		return
+	}
+	fmt.Println(err)
+	if errors.Is(err, ErrJobNotFound) {
+		os.Exit(ExitUsage)
+	}
+	os.Exit(ExitCode(err))
+}
+
+// jobStatus describes the status of a job for the terminal.
+func jobStatus(job Job) string {
+	switch {
+	case job.Queued():
+		return "Queued"
+	case job.Status == StatusFailed:
+		return "Failed: " + job.Error
+	default:
+		return job.Status.String()
+	}
+}
+
+// printJobs prints the jobs as a table.
+func printJobs(jobs []Job) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPRIORITY\tMODEL\tREGION\tVERSION\tPROGRESS\tSTATUS")
+	for _, job := range jobs {
+		progress := "-"
+		if job.TotalSize > 0 {
+			progress = fmt.Sprintf("%.1f%%", float64(job.CurrentSize)/float64(job.TotalSize)*100)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n", job.ID, job.Priority, job.Model, job.Region, job.FwVersion, progress, jobStatus(job))
+	}
+	w.Flush()
+}
+
+func init() {
+	rootCmd.AddCommand(QueueCmd)
+	QueueCmd.AddCommand(queueAddCmd, queueListCmd, queueRunCmd, queuePauseCmd, queueResumeCmd, queueCancelCmd, queueRemoveCmd, queuePriorityCmd)
+	QueueCmd.PersistentFlags().StringVar(&queueFile, "queue-file", DefaultQueueFile(), T("queue_file_desc"))
+	queueAddCmd.Flags().IntVar(&queuePriority, "priority", 0, T("queue_priority_desc"))
+	queueAddCmd.Flags().IntVar(&queueConnections, "connections", DefaultConnections, T("connections_desc"))
+	queueAddCmd.Flags().StringVar(&queueLimit, "limit", "", T("limit_desc"))
+	queueAddCmd.Flags().BoolVar(&queueDecrypt, "decrypt", false, T("download_decrypt_desc"))
+	queueRunCmd.Flags().IntVar(&queueJobs, "jobs", 0, T("queue_jobs_desc"))
+	queueCancelCmd.Flags().BoolVar(&queueDelete, "delete", false, T("queue_delete_desc"))
+}
@@ -1,9 +1,19 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
+
+	"samsung-firmware-tool/internal/cassette"
+	"samsung-firmware-tool/internal/fusclient"
+	"samsung-firmware-tool/internal/httpclient"
 
 	"github.com/spf13/cobra"
 )
@@ -16,6 +26,30 @@ var (
 	outputFile  string
 	inputFile   string
 	currentLang string
+
+	fusURL      string
+	downloadURL string
+	fotaURL     string
+
+	proxyURL        string
+	caFiles         []string
+	bindAddr        string
+	connectTimeout  time.Duration
+	responseTimeout time.Duration
+	readTimeout     time.Duration
+
+	retries    int
+	retryDelay time.Duration
+
+	sessionFile string
+	preallocate bool
+
+	recordFile string
+	replayFile string
+
+	// httpClient is built from the transport flags before a command runs.
+	// Nil (e.g. when used as a library) means httpclient.Default().
+	httpClient *http.Client
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -23,6 +57,9 @@ var rootCmd = &cobra.Command{
 	Use:   "samsung-firmware-tool",
 	Short: "", // Will be set in init()
 	Long:  "", // Will be set in init()
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return setupHTTPClient()
+	},
 }
 
 var translations = map[string]map[string]string{
@@ -39,6 +76,37 @@ var translations = map[string]map[string]string{
 		"fw_desc":                             "Firmware version (e.g., G998USQU4AUF5/G998UOYN4AUF5/G998USQU4AUF5/G998USQU4AUF5)",
 		"output_desc":                         "Output file path for download or decryption",
 		"input_desc":                          "Input file path for decryption",
+		"fus_url_desc":                        "Base URL of the FUS server (env " + fusclient.EnvFusURL + ")",
+		"download_url_desc":                   "Base URL of the firmware download server (env " + fusclient.EnvDownloadURL + ")",
+		"fota_url_desc":                       "Base URL of the FOTA version server (env " + fusclient.EnvFotaURL + ")",
+		"proxy_desc":                          "Proxy URL (http://, https:// or socks5://), \"direct\" to ignore HTTP(S)_PROXY",
+		"ca_cert_desc":                        "Extra PEM CA bundle to trust (can be repeated)",
+		"bind_desc":                           "Local IP address or interface name for outgoing connections",
+		"connect_timeout_desc":                "TCP connect timeout (0 disables)",
+		"response_timeout_desc":               "Timeout waiting for response headers (0 disables)",
+		"read_timeout_desc":                   "Maximum time without receiving data before a connection fails (0 disables)",
+		"connections_desc":                    "Number of parallel connections used to download the firmware",
+		"download_decrypt_desc":               "Decrypt while downloading and write only the decrypted zip",
+		"limit_desc":                          "Maximum download speed, e.g. 20MiB/s or 500KB/s (unlimited if empty)",
+		"queue_file_desc":                     "File that keeps the download queue between runs (empty keeps it in memory)",
+		"queue_priority_desc":                 "Priority of the download; higher priorities start first",
+		"queue_jobs_desc":                     "Number of downloads that run at the same time (0 uses the saved value)",
+		"queue_delete_desc":                   "Also delete the partial download",
+		"queue_added":                         "Added download job %s\n",
+		"retries_desc":                        "Maximum attempts for FUS requests and download reconnects (1 disables retries)",
+		"retry_delay_desc":                    "Initial delay between retries, doubled on every attempt",
+		"retrying":                            "\nRetrying: %s\n",
+		"session_file_desc":                   "File that keeps the FUS session between runs (empty disables)",
+		"preallocate_desc":                    "Allocate the disk space of downloaded and decrypted files up front (fallocate)",
+		"decrypt_workers_desc":                "Number of goroutines that decrypt in parallel (0 = one per CPU)",
+		"decrypt_list_desc":                   "List the files in the encrypted firmware zip",
+		"decrypt_only_desc":                   "Extract only these files of the firmware zip into the output directory (e.g. CSC,BL)",
+		"decrypt_test_desc":                   "Check the CRC32 of every file in the decrypted zip",
+		"download_only_desc":                  "Download only these files of the firmware zip into the output directory (e.g. CSC,BL)",
+		"record_desc":                         "Record all FUS, FOTA and download traffic to a cassette file",
+		"replay_desc":                         "Answer requests from a cassette file instead of the network",
+		"fake_server_listen_desc":             "Address the fake server listens on",
+		"err_record_replay":                   "--record and --replay cannot be used together",
 		"check_short":                         "Check for the latest firmware version",
 		"check_long":                          "This command checks for the latest firmware version for a given device model and region.",
 		"download_short":                      "Download firmware",
@@ -89,6 +157,37 @@ var translations = map[string]map[string]string{
 		"fw_desc":                             "固件版本 (例如: G998USQU4AUF5/G998UOYN4AUF5/G998USQU4AUF5/G998USQU4AUF5)",
 		"output_desc":                         "下载或解密的输出文件路径",
 		"input_desc":                          "解密的输入文件路径",
+		"fus_url_desc":                        "FUS 服务器基础地址 (环境变量 " + fusclient.EnvFusURL + ")",
+		"download_url_desc":                   "固件下载服务器基础地址 (环境变量 " + fusclient.EnvDownloadURL + ")",
+		"fota_url_desc":                       "FOTA 版本服务器基础地址 (环境变量 " + fusclient.EnvFotaURL + ")",
+		"proxy_desc":                          "代理地址 (http://, https:// 或 socks5://)，\"direct\" 表示忽略 HTTP(S)_PROXY",
+		"ca_cert_desc":                        "额外信任的 PEM CA 证书文件 (可重复指定)",
+		"bind_desc":                           "出站连接绑定的本地 IP 地址或网卡名称",
+		"connect_timeout_desc":                "TCP 连接超时 (0 表示不限制)",
+		"response_timeout_desc":               "等待响应头的超时 (0 表示不限制)",
+		"read_timeout_desc":                   "连接无数据传输的最长时间，超过则失败 (0 表示不限制)",
+		"connections_desc":                    "下载固件时使用的并行连接数",
+		"download_decrypt_desc":               "边下载边解密，只写入解密后的 zip 文件",
+		"limit_desc":                          "最大下载速度，例如 20MiB/s 或 500KB/s (为空时不限速)",
+		"queue_file_desc":                     "在多次运行之间保存下载队列的文件 (留空表示只保存在内存中)",
+		"queue_priority_desc":                 "下载优先级，优先级高的先开始",
+		"queue_jobs_desc":                     "同时进行的下载数 (0 表示使用保存的值)",
+		"queue_delete_desc":                   "同时删除未完成的下载文件",
+		"queue_added":                         "已添加下载任务 %s\n",
+		"retries_desc":                        "FUS 请求和下载重连的最大尝试次数 (1 表示不重试)",
+		"retry_delay_desc":                    "首次重试前的等待时间，每次重试翻倍",
+		"retrying":                            "\n正在重试: %s\n",
+		"session_file_desc":                   "在多次运行之间保存 FUS 会话的文件 (留空表示不保存)",
+		"preallocate_desc":                    "提前为下载和解密的文件分配磁盘空间 (fallocate)",
+		"decrypt_workers_desc":                "并行解密的 goroutine 数量 (0 表示每个 CPU 一个)",
+		"decrypt_list_desc":                   "列出加密固件 zip 中的文件",
+		"decrypt_only_desc":                   "只把固件 zip 中的这些文件解压到输出目录 (例如 CSC,BL)",
+		"decrypt_test_desc":                   "解密后校验 zip 中每个文件的 CRC32",
+		"download_only_desc":                  "只下载固件 zip 中的这些文件到输出目录 (例如 CSC,BL)",
+		"record_desc":                         "将所有 FUS、FOTA 和下载流量记录到 cassette 文件",
+		"replay_desc":                         "从 cassette 文件回放响应，而不访问网络",
+		"fake_server_listen_desc":             "模拟服务器监听的地址",
+		"err_record_replay":                   "--record 和 --replay 不能同时使用",
 		"check_short":                         "查询最新固件版本",
 		"check_long":                          "此命令用于检查给定设备型号和地区的最新固件版本。",
 		"download_short":                      "下载固件",
@@ -163,16 +262,122 @@ func init() {
 	rootCmd.PersistentFlags().StringVarP(&outputFile, "output", "o", "", T("output_desc"))
 	rootCmd.PersistentFlags().StringVarP(&inputFile, "input", "p", "", T("input_desc")) // Changed from -i to -p to avoid conflict with imei
 
+	defaults := fusclient.DefaultOptions()
+	rootCmd.PersistentFlags().StringVar(&fusURL, "fus-url", defaults.FusURL, T("fus_url_desc"))
+	rootCmd.PersistentFlags().StringVar(&downloadURL, "download-url", defaults.DownloadURL, T("download_url_desc"))
+	rootCmd.PersistentFlags().StringVar(&fotaURL, "fota-url", defaults.FotaURL, T("fota_url_desc"))
+
+	httpDefaults := httpclient.DefaultConfig()
+	rootCmd.PersistentFlags().StringVar(&proxyURL, "proxy", "", T("proxy_desc"))
+	rootCmd.PersistentFlags().StringArrayVar(&caFiles, "ca-cert", nil, T("ca_cert_desc"))
+	rootCmd.PersistentFlags().StringVar(&bindAddr, "bind", "", T("bind_desc"))
+	rootCmd.PersistentFlags().DurationVar(&connectTimeout, "connect-timeout", httpDefaults.ConnectTimeout, T("connect_timeout_desc"))
+	rootCmd.PersistentFlags().DurationVar(&responseTimeout, "response-timeout", httpDefaults.ResponseHeaderTimeout, T("response_timeout_desc"))
+	rootCmd.PersistentFlags().DurationVar(&readTimeout, "read-timeout", httpDefaults.ReadTimeout, T("read_timeout_desc"))
+
+	retryDefaults := fusclient.DefaultRetryPolicy()
+	rootCmd.PersistentFlags().IntVar(&retries, "retries", retryDefaults.MaxAttempts, T("retries_desc"))
+	rootCmd.PersistentFlags().DurationVar(&retryDelay, "retry-delay", retryDefaults.BaseDelay, T("retry_delay_desc"))
+	rootCmd.PersistentFlags().StringVar(&sessionFile, "session-file", fusclient.DefaultSessionFile(), T("session_file_desc"))
+	rootCmd.PersistentFlags().BoolVar(&preallocate, "preallocate", false, T("preallocate_desc"))
+	rootCmd.PersistentFlags().StringVar(&recordFile, "record", "", T("record_desc"))
+	rootCmd.PersistentFlags().StringVar(&replayFile, "replay", "", T("replay_desc"))
+
 	// Cobra also supports local flags, which will only run when this command
 	// is called directly.
 	// rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
 
+// setupHTTPClient builds httpClient from the transport flags. With --record
+// the traffic is also written to a cassette; with --replay it is served from
+// one and the network is never used.
+func setupHTTPClient() error {
+	if recordFile != "" && replayFile != "" {
+		return errors.New(T("err_record_replay"))
+	}
+	if replayFile != "" {
+		replayer, err := cassette.NewReplayer(replayFile)
+		if err != nil {
+			return err
+		}
+		httpClient = &http.Client{Transport: replayer}
+		return nil
+	}
+
+	cfg := httpclient.DefaultConfig()
+	cfg.Proxy = proxyURL
+	cfg.CAFiles = caFiles
+	cfg.LocalAddr = bindAddr
+	cfg.ConnectTimeout = connectTimeout
+	cfg.ResponseHeaderTimeout = responseTimeout
+	cfg.ReadTimeout = readTimeout
+
+	client, err := httpclient.New(cfg)
+	if err != nil {
+		return err
+	}
+	if recordFile != "" {
+		client.Transport = cassette.NewRecorder(recordFile, client.Transport)
+	}
+	httpClient = client
+	return nil
+}
+
+// clientOptions builds the FusClient options from the command-line flags.
+func clientOptions() fusclient.Options {
+	retry := fusclient.DefaultRetryPolicy()
+	retry.MaxAttempts = retries
+	retry.BaseDelay = retryDelay
+
+	// A saved session would skip the recorded nonce exchange.
+	session := sessionFile
+	if recordFile != "" || replayFile != "" {
+		session = ""
+	}
+
+	return fusclient.Options{
+		FusURL:      fusURL,
+		DownloadURL: downloadURL,
+		FotaURL:     fotaURL,
+		HTTPClient:  httpClient,
+		Retry:       &retry,
+		SessionFile: session,
+	}
+}
+
+// printRetry reports a retry on the terminal.
+func printRetry(event fusclient.RetryEvent) {
+	fmt.Printf(T("retrying"), event)
+}
+
+// commandContext returns the context of cmd, falling back to the root
+// command's context for commands invoked directly from interactive mode.
+// Retries made under the returned context are printed.
+func commandContext(cmd *cobra.Command) context.Context {
+	ctx := cmd.Context()
+	if ctx == nil {
+		ctx = rootCmd.Context()
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return fusclient.WithRetryNotify(ctx, printRetry)
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
+	// Cancel in-flight requests, downloads and decryption on Ctrl+C.
+	// A second signal falls through to the default handler and exits.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
 	// Always execute rootCmd to parse flags, but handle errors
-	err := rootCmd.Execute()
+	err := rootCmd.ExecuteContext(ctx)
 	if err != nil {
 		// If the error is due to a subcommand not found or similar,
 		// we might want to proceed to interactive mode.
@@ -180,7 +385,7 @@ func Execute() {
 		// A more robust solution would check the error type.
 		if err.Error() != "unknown command" && !strings.Contains(err.Error(), "unknown flag") {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
+			os.Exit(ExitCode(err))
 		}
 	}
 
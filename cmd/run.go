@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"strings" // Added for strings.TrimSpace and strings.ToLower
 
@@ -27,7 +28,7 @@ var runCmd = &cobra.Command{
 
 			switch choice {
 			case "a":
-				runCheckCommand()
+				runCheckCommand(commandContext(cmd))
 			case "b":
 				runDownloadCommand()
 			case "c":
@@ -48,7 +49,7 @@ func init() {
 	// The flags are defined in rootCmd and are persistent, so they are available here.
 }
 
-func runCheckCommand() {
+func runCheckCommand(ctx context.Context) {
 	if model == "" {
 		fmt.Print("请输入设备型号 (例如: SM-G998U): ")
 		fmt.Scanln(&model)
@@ -63,7 +64,7 @@ func runCheckCommand() {
 	}
 
 	// Get the firmware version from checkLatestVersion and store it globally
-	fwVersion = checkLatestVersion(model, region)
+	fwVersion, _ = checkLatestVersion(ctx, model, region)
 	if fwVersion != "" {
 		fmt.Printf("已获取固件版本: %s，可用于后续操作。\n", fwVersion)
 	}
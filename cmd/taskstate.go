@@ -0,0 +1,266 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"samsung-firmware-tool/internal/progress"
+)
+
+// DownloadStatus defines the current status of a download task.
+type DownloadStatus int
+
+const (
+	StatusIdle DownloadStatus = iota
+	StatusInitializing
+	StatusDownloading
+	StatusPaused
+	StatusVerifying
+	StatusCompleted
+	StatusFailed
+	StatusCancelled
+)
+
+func (s DownloadStatus) String() string {
+	switch s {
+	case StatusIdle:
+		return "Idle"
+	case StatusInitializing:
+		return "Initializing"
+	case StatusDownloading:
+		return "Downloading"
+	case StatusPaused:
+		return "Paused"
+	case StatusVerifying:
+		return "Verifying"
+	case StatusCompleted:
+		return "Completed"
+	case StatusFailed:
+		return "Failed"
+	case StatusCancelled:
+		return "Cancelled"
+	default:
+		return "Unknown"
+	}
+}
+
+// MarshalText encodes the status by its name, e.g. in the download queue.
+func (s DownloadStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes a status name written by MarshalText.
+func (s *DownloadStatus) UnmarshalText(text []byte) error {
+	for status := StatusIdle; status <= StatusCancelled; status++ {
+		if status.String() == string(text) {
+			*s = status
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown download status %q", text)
+}
+
+// Done reports whether s is a final status: Completed, Failed or Cancelled.
+func (s DownloadStatus) Done() bool {
+	return s == StatusCompleted || s == StatusFailed || s == StatusCancelled
+}
+
+// transitions lists the statuses a task may move to from each status.
+// Failed and Cancelled tasks can be started again.
+var transitions = map[DownloadStatus][]DownloadStatus{
+	StatusIdle:         {StatusInitializing, StatusCancelled},
+	StatusInitializing: {StatusDownloading, StatusVerifying, StatusFailed, StatusCancelled},
+	StatusDownloading:  {StatusPaused, StatusVerifying, StatusFailed, StatusCancelled},
+	StatusPaused:       {StatusDownloading, StatusCancelled},
+	StatusVerifying:    {StatusCompleted, StatusFailed, StatusCancelled},
+	StatusFailed:       {StatusInitializing},
+	StatusCancelled:    {StatusInitializing},
+}
+
+// TransitionError is returned for a status change the state machine does
+// not allow, e.g. resuming a task that is not paused.
+type TransitionError struct {
+	From, To DownloadStatus
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("download task cannot go from %s to %s", e.From, e.To)
+}
+
+// canTransition reports whether a task may move from one status to another.
+// Staying in the same status is always allowed.
+func canTransition(from, to DownloadStatus) bool {
+	if from == to {
+		return true
+	}
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// DownloadSnapshot is a consistent copy of the state of a DownloadTask.
+type DownloadSnapshot struct {
+	Status         DownloadStatus
+	Phase          progress.Phase // Step the progress belongs to
+	FileName       string         // Local file name, empty before initialization
+	Progress       float64        // Percentage
+	CurrentSize    int64          // Bytes downloaded or verified so far
+	TotalSize      int64          // Total bytes to download
+	BytesPerSecond int64          // Moving average of the speed
+	ETA            time.Duration  // Estimated time left, 0 if unknown
+	Err            error          // Why the task failed, if it did
+}
+
+// Snapshot returns the current state of the task. It is safe to call from
+// any goroutine, including from the task's callbacks.
+func (dt *DownloadTask) Snapshot() DownloadSnapshot {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	s := DownloadSnapshot{
+		Status:         dt.status,
+		Phase:          dt.phase,
+		FileName:       dt.FileName,
+		CurrentSize:    dt.currentSize,
+		TotalSize:      dt.totalSize,
+		BytesPerSecond: dt.bytesPerSecond,
+		ETA:            dt.eta,
+		Err:            dt.err,
+	}
+	if s.TotalSize > 0 {
+		s.Progress = float64(s.CurrentSize) / float64(s.TotalSize) * 100
+	}
+	return s
+}
+
+// Status returns the current status of the task.
+func (dt *DownloadTask) Status() DownloadStatus {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	return dt.status
+}
+
+// transition moves the task to status to and reports the change through
+// OnProgress.
+func (dt *DownloadTask) transition(to DownloadStatus) error {
+	dt.mu.Lock()
+	err := dt.transitionLocked(to)
+	dt.mu.Unlock()
+	if err == nil {
+		dt.notifyProgress()
+	}
+	return err
+}
+
+// transitionLocked is transition with dt.mu held; it does not notify.
+func (dt *DownloadTask) transitionLocked(to DownloadStatus) error {
+	if !canTransition(dt.status, to) {
+		return &TransitionError{From: dt.status, To: to}
+	}
+	dt.status = to
+	return nil
+}
+
+// Pause, Resume and Cancel do not call OnProgress themselves, so that they
+// can be called from it; the Start loop reports the change.
+
+// Pause stops a downloading task. The partial file and its progress are
+// kept, and Resume continues where the download stopped. Pausing a paused
+// task does nothing.
+func (dt *DownloadTask) Pause() error {
+	dt.mu.Lock()
+	if dt.status == StatusPaused {
+		dt.mu.Unlock()
+		return nil
+	}
+	if err := dt.transitionLocked(StatusPaused); err != nil {
+		dt.mu.Unlock()
+		return err
+	}
+	dt.interruptLocked()
+	dt.mu.Unlock()
+
+	fmt.Println("Download paused.")
+	return nil
+}
+
+// Resume continues a paused task. The download is restarted by the call
+// to Start that is waiting for the task, once the paused run has stopped.
+// Resuming a task that is not paused is a TransitionError.
+func (dt *DownloadTask) Resume() error {
+	dt.mu.Lock()
+	if dt.status != StatusPaused {
+		err := &TransitionError{From: dt.status, To: StatusDownloading}
+		dt.mu.Unlock()
+		return err
+	}
+	dt.status = StatusDownloading
+	dt.mu.Unlock()
+
+	dt.wakeUp()
+	fmt.Println("Download resumed.")
+	return nil
+}
+
+// Cancel stops the task for good. With deleteFiles the .part file and its
+// resume state are removed once the download has stopped; otherwise a
+// later task can still resume them. Start returns context.Canceled.
+// Cancelling a cancelled task does nothing.
+func (dt *DownloadTask) Cancel(deleteFiles bool) error {
+	dt.mu.Lock()
+	if dt.status == StatusCancelled {
+		dt.mu.Unlock()
+		return nil
+	}
+	wasIdle := dt.status == StatusIdle
+	if err := dt.transitionLocked(StatusCancelled); err != nil {
+		dt.mu.Unlock()
+		return err
+	}
+	dt.deleteFiles = deleteFiles
+	dt.interruptLocked()
+	dt.mu.Unlock()
+
+	if !wasIdle {
+		dt.wakeUp()
+	}
+	fmt.Println("Download cancelled.")
+	return nil
+}
+
+// interruptLocked stops the current run, if any. dt.mu must be held.
+func (dt *DownloadTask) interruptLocked() {
+	dt.interrupted = true
+	if dt.cancelRun != nil {
+		dt.cancelRun()
+	}
+}
+
+// wakeUp signals the Start loop that waits while the task is paused.
+func (dt *DownloadTask) wakeUp() {
+	select {
+	case dt.wake <- struct{}{}:
+	default:
+	}
+}
+
+// discardFiles removes the .part file and its resume state.
+func (dt *DownloadTask) discardFiles() {
+	discardPartFiles(dt.OutputPath, dt.FileName)
+}
+
+// discardPartFiles removes the .part file of fileName in dir and its
+// resume state.
+func discardPartFiles(dir, fileName string) {
+	if fileName == "" {
+		return
+	}
+	fullPath := filepath.Join(dir, fileName)
+	os.Remove(fullPath + partSuffix)
+	os.Remove(fullPath + stateSuffix)
+	os.Remove(fullPath + stateSuffix + ".tmp")
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestTaskControls calls Pause, Resume and Cancel on a task in every
+// status and checks the result and the status afterwards.
+func TestTaskControls(t *testing.T) {
+	type result struct {
+		ok   bool           // The call succeeds
+		next DownloadStatus // Status afterwards
+	}
+	tests := []struct {
+		status                DownloadStatus
+		pause, resume, cancel result
+	}{
+		{StatusIdle, result{false, StatusIdle}, result{false, StatusIdle}, result{true, StatusCancelled}},
+		{StatusInitializing, result{false, StatusInitializing}, result{false, StatusInitializing}, result{true, StatusCancelled}},
+		{StatusDownloading, result{true, StatusPaused}, result{false, StatusDownloading}, result{true, StatusCancelled}},
+		{StatusPaused, result{true, StatusPaused}, result{true, StatusDownloading}, result{true, StatusCancelled}},
+		{StatusVerifying, result{false, StatusVerifying}, result{false, StatusVerifying}, result{true, StatusCancelled}},
+		{StatusCompleted, result{false, StatusCompleted}, result{false, StatusCompleted}, result{false, StatusCompleted}},
+		{StatusFailed, result{false, StatusFailed}, result{false, StatusFailed}, result{false, StatusFailed}},
+		{StatusCancelled, result{false, StatusCancelled}, result{false, StatusCancelled}, result{true, StatusCancelled}},
+	}
+	for _, tt := range tests {
+		calls := []struct {
+			name string
+			call func(dt *DownloadTask) error
+			want result
+		}{
+			{"Pause", (*DownloadTask).Pause, tt.pause},
+			{"Resume", (*DownloadTask).Resume, tt.resume},
+			{"Cancel", func(dt *DownloadTask) error { return dt.Cancel(false) }, tt.cancel},
+		}
+		for _, c := range calls {
+			t.Run(tt.status.String()+"/"+c.name, func(t *testing.T) {
+				dt := NewDownloadTaskWithClient(nil, "SM-S9110", "CHC", "fw", "imei", t.TempDir(), nil)
+				dt.status = tt.status
+
+				err := c.call(dt)
+				if c.want.ok && err != nil {
+					t.Fatalf("%s = %v, want nil", c.name, err)
+				}
+				var transitionErr *TransitionError
+				if !c.want.ok && !errors.As(err, &transitionErr) {
+					t.Fatalf("%s = %v, want a TransitionError", c.name, err)
+				}
+				if got := dt.Status(); got != c.want.next {
+					t.Errorf("status after %s = %s, want %s", c.name, got, c.want.next)
+				}
+				if !c.want.ok && len(dt.wake) > 0 {
+					t.Errorf("failed %s woke the task", c.name)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"samsung-firmware-tool/internal/cryptutils"
+	"samsung-firmware-tool/internal/fuserr"
+	"samsung-firmware-tool/internal/util"
+)
+
+// quarantineSuffix is appended to a download that failed verification.
+const quarantineSuffix = ".corrupt"
+
+// streamHasher computes the CRC32 and MD5 of a file that is written in
+// segments. It reads the file right behind the writers, up to the end of
+// the part that has been written contiguously from the start, so the
+// data is still in the page cache and never read twice.
+type streamHasher struct {
+	file   io.ReaderAt
+	crc    hash.Hash32
+	md5    hash.Hash
+	offset int64 // Bytes hashed so far
+	buf    []byte
+
+	onAdvance func(offset int64) // Reports the progress, if set
+}
+
+func newStreamHasher(file io.ReaderAt) *streamHasher {
+	return &streamHasher{
+		file: file,
+		crc:  crc32.NewIEEE(),
+		md5:  md5.New(),
+		buf:  make([]byte, util.DEFAULT_CHUNK_SIZE),
+	}
+}
+
+// advance hashes the file up to end. It stops early when ctx is done.
+func (h *streamHasher) advance(ctx context.Context, end int64) error {
+	for h.offset < end {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		chunk := h.buf
+		if remaining := end - h.offset; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		n, err := h.file.ReadAt(chunk, h.offset)
+		h.crc.Write(chunk[:n])
+		h.md5.Write(chunk[:n])
+		h.offset += int64(n)
+		if h.onAdvance != nil {
+			h.onAdvance(h.offset)
+		}
+		if err != nil {
+			return fuserr.Wrap(fuserr.CodeDisk, err, "error reading download for verification")
+		}
+	}
+	return nil
+}
+
+// verify compares the hashes with BINARY_CRC and the Content-MD5 header.
+// A zero crc or an empty header is not checked.
+func (h *streamHasher) verify(crc uint32, contentMD5 string) error {
+	if crc != 0 && h.crc.Sum32() != crc {
+		return fuserr.New(fuserr.CodeChecksum, "CRC32 mismatch: expected %08x, got %08x", crc, h.crc.Sum32())
+	}
+	if contentMD5 != "" && !cryptutils.MD5Matches(h.md5.Sum(nil), contentMD5) {
+		return fuserr.New(fuserr.CodeChecksum, "MD5 mismatch: expected %s, got %x", contentMD5, h.md5.Sum(nil))
+	}
+	return nil
+}
+
+// quarantine moves a download that failed verification from path to
+// fullPath+".corrupt", so that it is neither resumed nor taken for a
+// complete file, and drops its resume state.
+func quarantine(path, fullPath string) string {
+	target := fullPath + quarantineSuffix
+	if err := os.Rename(path, target); err != nil {
+		fmt.Printf("Could not quarantine %s: %v\n", path, err)
+		return path
+	}
+	os.Remove(fullPath + stateSuffix)
+	return target
+}
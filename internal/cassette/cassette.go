@@ -0,0 +1,330 @@
+package cassette
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// DefaultMaxBodySize is the largest response body stored in a cassette.
+// Firmware downloads are far larger, so only their headers and the first
+// bytes are kept.
+const DefaultMaxBodySize = 1 << 20
+
+// Cassette is a recorded sequence of HTTP exchanges.
+type Cassette struct {
+	Version      int            `json:"version"`
+	Interactions []*Interaction `json:"interactions"`
+}
+
+// Interaction is one request and the response or error it produced.
+type Interaction struct {
+	Request  Request   `json:"request"`
+	Response *Response `json:"response,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Request is a recorded HTTP request.
+type Request struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   Body        `json:"body,omitempty"`
+}
+
+// Response is a recorded HTTP response.
+type Response struct {
+	StatusCode    int         `json:"statusCode"`
+	Status        string      `json:"status"`
+	Header        http.Header `json:"header,omitempty"`
+	Body          Body        `json:"body,omitempty"`
+	ContentLength int64       `json:"contentLength"`
+	Truncated     bool        `json:"truncated,omitempty"` // Body holds only the first bytes
+}
+
+// Body is stored as text when it is valid UTF-8 and as base64 otherwise.
+type Body []byte
+
+func (b Body) MarshalJSON() ([]byte, error) {
+	if utf8.Valid(b) {
+		return json.Marshal(string(b))
+	}
+	return json.Marshal(map[string]string{"base64": base64.StdEncoding.EncodeToString(b)})
+}
+
+func (b *Body) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*b = Body(text)
+		return nil
+	}
+	var encoded struct {
+		Base64 string `json:"base64"`
+	}
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded.Base64)
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// Load reads a cassette file.
+func Load(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Cassette
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("invalid cassette %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// Save writes the cassette to path.
+func (c *Cassette) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// Recorder is an http.RoundTripper that passes requests to Next and
+// appends every exchange to a cassette file.
+type Recorder struct {
+	Next        http.RoundTripper // Nil uses http.DefaultTransport
+	Path        string
+	MaxBodySize int // Zero uses DefaultMaxBodySize
+
+	mu       sync.Mutex
+	cassette Cassette
+}
+
+// NewRecorder creates a recorder writing to path.
+func NewRecorder(path string, next http.RoundTripper) *Recorder {
+	return &Recorder{Next: next, Path: path, cassette: Cassette{Version: 1}}
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	interaction := &Interaction{Request: Request{
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Header: req.Header.Clone(),
+		Body:   reqBody,
+	}}
+
+	next := r.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	resp, err := next.RoundTrip(req)
+	if err != nil {
+		interaction.Error = err.Error()
+		r.add(interaction)
+		return nil, err
+	}
+
+	interaction.Response = &Response{
+		StatusCode:    resp.StatusCode,
+		Status:        resp.Status,
+		Header:        resp.Header.Clone(),
+		ContentLength: resp.ContentLength,
+	}
+	r.add(interaction)
+
+	limit := r.MaxBodySize
+	if limit <= 0 {
+		limit = DefaultMaxBodySize
+	}
+	resp.Body = &recordingBody{ReadCloser: resp.Body, recorder: r, response: interaction.Response, limit: limit}
+	return resp, nil
+}
+
+// add appends an interaction and saves the cassette.
+func (r *Recorder) add(interaction *Interaction) {
+	r.mu.Lock()
+	r.cassette.Interactions = append(r.cassette.Interactions, interaction)
+	r.mu.Unlock()
+	r.save()
+}
+
+// save writes the cassette, reporting failures without interrupting the request.
+func (r *Recorder) save() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.cassette.Save(r.Path); err != nil {
+		fmt.Printf("Warning: could not write cassette: %v\n", err)
+	}
+}
+
+// recordingBody captures up to limit bytes of a response body and saves
+// the cassette once the body is closed.
+type recordingBody struct {
+	io.ReadCloser
+	recorder  *Recorder
+	response  *Response
+	limit     int
+	buf       bytes.Buffer
+	truncated bool
+	closed    bool
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if room := b.limit - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(n, room)])
+	}
+	if n > 0 && b.buf.Len() >= b.limit {
+		b.truncated = true
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	err := b.ReadCloser.Close()
+	if !b.closed {
+		b.closed = true
+		b.recorder.mu.Lock()
+		b.response.Body = Body(bytes.Clone(b.buf.Bytes()))
+		b.response.Truncated = b.truncated
+		b.recorder.mu.Unlock()
+		b.recorder.save()
+	}
+	return err
+}
+
+// Replayer is an http.RoundTripper that answers requests from a cassette
+// without touching the network. Interactions are matched by method, path
+// and query, in recorded order, so the host of the replayed URLs may differ.
+type Replayer struct {
+	mu       sync.Mutex
+	cassette *Cassette
+	used     []bool
+}
+
+// NewReplayer loads the cassette at path.
+func NewReplayer(path string) (*Replayer, error) {
+	c, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewReplayerFromCassette(c), nil
+}
+
+// NewReplayerFromCassette replays an in-memory cassette.
+func NewReplayerFromCassette(c *Cassette) *Replayer {
+	return &Replayer{cassette: c, used: make([]bool, len(c.Interactions))}
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	interaction := r.next(req)
+	if interaction == nil {
+		return nil, fmt.Errorf("cassette: no recorded response for %s %s", req.Method, req.URL.RequestURI())
+	}
+	if interaction.Response == nil {
+		return nil, fmt.Errorf("cassette: recorded error: %s", interaction.Error)
+	}
+
+	recorded := interaction.Response
+	header := recorded.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	contentLength := int64(len(recorded.Body))
+	if recorded.Truncated {
+		// The real body was longer; announce only what can be served.
+		header.Del("Content-Length")
+	} else if recorded.ContentLength >= 0 {
+		contentLength = recorded.ContentLength
+	}
+
+	return &http.Response{
+		StatusCode:    recorded.StatusCode,
+		Status:        recorded.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(recorded.Body)),
+		ContentLength: contentLength,
+		Request:       req,
+	}, nil
+}
+
+// next returns the first unused interaction matching req.
+func (r *Replayer) next(req *http.Request) *Interaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	want := requestKey(req.Method, req.URL.RequestURI())
+	for i, interaction := range r.cassette.Interactions {
+		if r.used[i] {
+			continue
+		}
+		if requestKey(interaction.Request.Method, requestURI(interaction.Request.URL)) == want {
+			r.used[i] = true
+			return interaction
+		}
+	}
+	return nil
+}
+
+// Remaining returns how many recorded interactions have not been replayed.
+func (r *Replayer) Remaining() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, used := range r.used {
+		if !used {
+			n++
+		}
+	}
+	return n
+}
+
+func requestKey(method, uri string) string {
+	return strings.ToUpper(method) + " " + uri
+}
+
+// requestURI strips the scheme and host from a recorded URL.
+func requestURI(rawURL string) string {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return rawURL
+	}
+	return req.URL.RequestURI()
+}
+
+// readRequestBody reads and restores the request body.
+func readRequestBody(req *http.Request) (Body, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	data, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	return data, nil
+}
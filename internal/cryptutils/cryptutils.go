@@ -2,6 +2,7 @@ package cryptutils
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/md5"
@@ -11,8 +12,10 @@ import (
 	"hash" // Import hash package
 	"hash/crc32"
 	"io"
-	"os"
+	"strings"
 
+	"samsung-firmware-tool/internal/fuserr"
+	"samsung-firmware-tool/internal/progress"
 	"samsung-firmware-tool/internal/util"
 )
 
@@ -46,6 +49,24 @@ func pad(d []byte) []byte {
 	return append(d, padText...)
 }
 
+// paddingLen returns the length of the padding that pad appended to the
+// last block of a message, or 0 if block does not end in valid padding.
+func paddingLen(block []byte) int {
+	if len(block) == 0 {
+		return 0
+	}
+	padding := int(block[len(block)-1])
+	if padding == 0 || padding > aes.BlockSize || padding > len(block) {
+		return 0
+	}
+	for _, b := range block[len(block)-padding:] {
+		if int(b) != padding {
+			return 0
+		}
+	}
+	return padding
+}
+
 // aesEncrypt encrypts data using AES CBC with custom padding.
 func aesEncrypt(input, key []byte) ([]byte, error) {
 	paddedInput := pad(input)
@@ -117,6 +138,30 @@ func DecryptNonce(input string) (string, error) {
 	return string(decrypted), nil
 }
 
+// EncryptNonce encrypts a nonce the way the FUS server sends it, so that
+// DecryptNonce can read it back.
+func EncryptNonce(nonce string) (string, error) {
+	encrypted, err := aesEncrypt([]byte(nonce), []byte(key1))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(encrypted), nil
+}
+
+// EncryptFirmware pads data and encrypts it with AES ECB, producing a file
+// that DecryptProgress turns back into data.
+func EncryptFirmware(data, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	padded := pad(append([]byte(nil), data...))
+	for i := 0; i < len(padded); i += aes.BlockSize {
+		block.Encrypt(padded[i:i+aes.BlockSize], padded[i:i+aes.BlockSize])
+	}
+	return padded, nil
+}
+
 // getV2Key creates the decryption key for a .enc2 firmware file.
 func GetV2Key(version, model, region string) ([]byte, string) {
 	decKey := fmt.Sprintf("%s:%s:%s", region, model, version)
@@ -125,11 +170,15 @@ func GetV2Key(version, model, region string) ([]byte, string) {
 	return hasher.Sum(nil), decKey
 }
 
-// decryptProgress decrypts a provided file to a specified target, with a progress callback.
-// This function assumes ECB mode for decryption as per Kotlin's aesEcbProvider.
+// DecryptProgress decrypts AES-ECB ciphertext from r to w, with a progress
+// callback. It reads length bytes, or up to EOF if length is 0, so r may be
+// a pipe or a network stream. Chunks of chunkSize bytes are decrypted by
+// DecryptWorkers goroutines in parallel; chunkSize <= 0 uses
+// DecryptChunkSize. The padding at the end of the firmware is not written.
 func DecryptProgress(
-	inf *os.File,
-	outf *os.File,
+	ctx context.Context,
+	r io.Reader,
+	w io.Writer,
 	key []byte,
 	length int64,
 	chunkSize int,
@@ -137,125 +186,86 @@ func DecryptProgress(
 ) error {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return err
+		return fuserr.Wrap(fuserr.CodeBadKey, err, "invalid decryption key")
 	}
 
-	// Manual ECB decryption
-	buf := make([]byte, chunkSize)
-	totalRead := int64(0)
-
-	for totalRead < length {
-		n, err := inf.Read(buf)
-		if err != nil && err != io.EOF {
-			return err
-		}
-		if n == 0 {
-			break
-		}
-
-		encryptedBlock := buf[:n]
-		decryptedBlock := make([]byte, n)
-
-		for i := 0; i < n; i += block.BlockSize() {
-			dstBlobck := decryptedBlock[i:]
-			srcBlobck := encryptedBlock[i:]
-
-			if len(srcBlobck) < aes.BlockSize {
-				return fmt.Errorf("crypto/aes: output not full block")
-			}
-			if len(dstBlobck) < aes.BlockSize {
-				return fmt.Errorf("crypto/aes: output not full block")
-			}
-			block.Decrypt(dstBlobck, srcBlobck)
+	reporter := progress.NewReporter(0, func(u progress.Update) {
+		if progressCallback != nil {
+			progressCallback(u.Current, u.Total, u.BytesPerSecond)
 		}
+	})
+	reporter.Start(progress.PhaseDecrypt, 0, length)
+	defer reporter.Flush()
 
-		_, err = outf.Write(decryptedBlock)
-		if err != nil {
-			return err
-		}
-
-		totalRead += int64(n)
-		progressCallback(totalRead, length, 0) // bps not implemented yet
-	}
-
-	return nil
+	return decryptECB(ctx, r, w, block, length, chunkSize, reporter.Set)
 }
 
-// CheckCrc32 checks the CRC32 of a given encrypted firmware file.
+// CheckCrc32 checks the CRC32 of an encrypted firmware file read from r.
+// encSize is only used for the progress and may be 0 if unknown. To check
+// a file without moving its offset, pass io.NewSectionReader(f, 0, size).
 func CheckCrc32(
-	enc *os.File,
+	r io.Reader,
 	encSize int64,
 	expected uint32,
 	progressCallback func(current, max, bps int64),
 ) (bool, error) {
-	if enc == nil {
+	if r == nil {
 		return false, nil
 	}
 
-	buffer := make([]byte, util.DEFAULT_CHUNK_SIZE)
 	crc := crc32.NewIEEE()
-	totalRead := int64(0)
-
-	for totalRead < encSize {
-		n, err := enc.Read(buffer)
-		if err != nil && err != io.EOF {
-			return false, err
-		}
-		if n == 0 {
-			break
+	reporter := progress.NewReporter(0, func(u progress.Update) {
+		if progressCallback != nil {
+			progressCallback(u.Current, u.Total, u.BytesPerSecond)
 		}
+	})
+	reporter.Start(progress.PhaseVerify, 0, encSize)
+	defer reporter.Flush()
 
-		crc.Write(buffer[:n])
-		totalRead += int64(n)
-		progressCallback(totalRead, encSize, 0) // bps not implemented yet
+	if _, err := io.CopyBuffer(crc, &progressReader{r: r, onRead: reporter.Add}, make([]byte, util.DEFAULT_CHUNK_SIZE)); err != nil {
+		return false, fuserr.Wrap(fuserr.CodeDisk, err, "error reading encrypted file")
 	}
-
-	// Reset file pointer for future reads if needed
-	_, err := enc.Seek(0, io.SeekStart)
-	if err != nil {
-		return false, err
-	}
-
 	return crc.Sum32() == expected, nil
 }
 
-// CheckMD5 checks an MD5 hash given an input file and an expected value.
-func CheckMD5(md5Sum string, updateFile *os.File) (bool, error) {
-	if md5Sum == "" || updateFile == nil {
+// CheckMD5 checks the MD5 of everything read from r against an expected
+// value in hex or base64.
+func CheckMD5(md5Sum string, r io.Reader) (bool, error) {
+	if md5Sum == "" || r == nil {
 		return false, nil
 	}
 
-	calculatedDigest, err := calculateMD5(updateFile)
-	if err != nil {
-		return false, err
-	}
-
-	// Reset file pointer for future reads if needed
-	_, err = updateFile.Seek(0, io.SeekStart)
-	if err != nil {
+	hasher := md5.New()
+	if _, err := io.Copy(hasher, r); err != nil {
 		return false, err
 	}
-
-	return bytes.EqualFold([]byte(calculatedDigest), []byte(md5Sum)), nil
+	return MD5Matches(hasher.Sum(nil), md5Sum), nil
 }
 
-// calculateMD5 calculates an MD5 hash for a given input file.
-func calculateMD5(updateFile *os.File) (string, error) {
-	hasher := md5.New()
-	buffer := make([]byte, 8192) // 8KB buffer
+// progressReader reports the bytes read through it.
+type progressReader struct {
+	r      io.Reader
+	onRead func(n int64)
+}
 
-	for {
-		n, err := updateFile.Read(buffer)
-		if err != nil && err != io.EOF {
-			return "", err
-		}
-		if n == 0 {
-			break
-		}
-		hasher.Write(buffer[:n])
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.onRead(int64(n))
 	}
+	return n, err
+}
 
-	return hex.EncodeToString(hasher.Sum(nil)), nil
+// MD5Matches reports whether sum equals the digest in a Content-MD5
+// header. The header may be hex, as sent by Samsung's download server, or
+// base64, as defined by RFC 1864.
+func MD5Matches(sum []byte, header string) bool {
+	header = strings.TrimSpace(header)
+	expected, err := hex.DecodeString(header)
+	if err != nil || len(expected) != md5.Size {
+		expected, err = base64.StdEncoding.DecodeString(header)
+	}
+	return err == nil && bytes.Equal(sum, expected)
 }
 
 // MD5Hasher returns a new MD5 hash.Hash.
@@ -0,0 +1,126 @@
+package cryptutils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+	"os"
+
+	"samsung-firmware-tool/internal/fuserr"
+)
+
+// DecryptedFile is a random-access view of the plaintext of an AES-ECB
+// encrypted firmware file (.enc2 or .enc4). Every block of ECB ciphertext
+// decrypts on its own, so ReadAt only reads and decrypts the blocks it
+// returns. The view can be passed to archive/zip.NewReader together with
+// Size to list the firmware zip or extract single entries without writing
+// a decrypted copy. It is safe for concurrent use if the underlying
+// io.ReaderAt is.
+type DecryptedFile struct {
+	block cipher.Block
+	r     io.ReaderAt
+	size  int64     // Plaintext size without the padding
+	c     io.Closer // The file opened by OpenDecryptedFile, if any
+}
+
+// NewDecryptedFile returns the decrypted view of encSize bytes of
+// ciphertext read from r.
+func NewDecryptedFile(r io.ReaderAt, encSize int64, key []byte) (*DecryptedFile, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fuserr.Wrap(fuserr.CodeBadKey, err, "invalid decryption key")
+	}
+	f := &DecryptedFile{block: block, r: r}
+	f.size, err = f.plainSize(encSize - encSize%aes.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// OpenDecryptedFile opens the encrypted firmware file at path for reading
+// its plaintext. The caller must Close it.
+func OpenDecryptedFile(path string, key []byte) (*DecryptedFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fuserr.Wrap(fuserr.CodeDisk, err, "error opening encrypted file")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fuserr.Wrap(fuserr.CodeDisk, err, "error getting encrypted file info")
+	}
+	f, err := NewDecryptedFile(file, info.Size(), key)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	f.c = file
+	return f, nil
+}
+
+// plainSize returns the size of the plaintext in encSize bytes of
+// ciphertext. The padding that EncryptFirmware appends is left out when
+// the last block carries it.
+func (f *DecryptedFile) plainSize(encSize int64) (int64, error) {
+	if encSize == 0 {
+		return 0, nil
+	}
+	last := make([]byte, aes.BlockSize)
+	if _, err := f.r.ReadAt(last, encSize-aes.BlockSize); err != nil {
+		return 0, fuserr.Wrap(fuserr.CodeDisk, err, "error reading encrypted file")
+	}
+	f.block.Decrypt(last, last)
+	return encSize - int64(paddingLen(last)), nil
+}
+
+// Size returns the size of the plaintext.
+func (f *DecryptedFile) Size() int64 {
+	return f.size
+}
+
+// ReadAt reads len(p) bytes of plaintext at off.
+func (f *DecryptedFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fuserr.New(fuserr.CodeDisk, "negative offset %d", off)
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), f.size)
+	start := off - off%aes.BlockSize
+	alignedEnd := end
+	if rem := alignedEnd % aes.BlockSize; rem != 0 {
+		alignedEnd += aes.BlockSize - rem
+	}
+
+	buf := make([]byte, alignedEnd-start)
+	n, err := f.r.ReadAt(buf, start)
+	n -= n % aes.BlockSize
+	if n < len(buf) && err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	decryptBlocks(f.block, buf[:n])
+
+	skip := int(off - start)
+	if n <= skip {
+		return 0, fuserr.Wrap(fuserr.CodeDisk, err, "error reading encrypted file")
+	}
+	copied := copy(p, buf[skip:min(n, int(end-start))])
+	if copied == len(p) {
+		return copied, nil
+	}
+	if off+int64(copied) == f.size {
+		return copied, io.EOF
+	}
+	return copied, fuserr.Wrap(fuserr.CodeDisk, err, "error reading encrypted file")
+}
+
+// Close closes the file opened by OpenDecryptedFile. It does nothing for
+// views created with NewDecryptedFile.
+func (f *DecryptedFile) Close() error {
+	if f.c == nil {
+		return nil
+	}
+	return f.c.Close()
+}
@@ -0,0 +1,118 @@
+package cryptutils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"io"
+
+	"samsung-firmware-tool/internal/fuserr"
+)
+
+// ECBFile stores the plaintext of an AES-ECB encrypted firmware file while
+// it is downloaded. WriteAt takes ciphertext and writes its plaintext at
+// the same offset. ReadAt returns the ciphertext again by re-encrypting the
+// plaintext, so that the checksums of the encrypted file can be verified
+// without keeping it. Offset and length of every WriteAt must be multiples
+// of BlockSize.
+//
+// The plaintext keeps the padding of the last block until the download is
+// complete; truncate the file to PlainSize then. ReadAt restores the
+// padding of a truncated file, so it can still be verified.
+type ECBFile struct {
+	block cipher.Block
+	file  interface {
+		io.ReaderAt
+		io.WriterAt
+	}
+	size int64 // Size of the encrypted file
+}
+
+// NewECBFile returns an ECBFile that stores the plaintext of an encrypted
+// file of size bytes in file.
+func NewECBFile(file interface {
+	io.ReaderAt
+	io.WriterAt
+}, key []byte, size int64) (*ECBFile, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fuserr.Wrap(fuserr.CodeBadKey, err, "invalid decryption key")
+	}
+	return &ECBFile{block: block, file: file, size: size}, nil
+}
+
+// BlockSize returns the AES block size. Writers must align to it.
+func (f *ECBFile) BlockSize() int {
+	return aes.BlockSize
+}
+
+// WriteAt decrypts p and writes the plaintext at off.
+func (f *ECBFile) WriteAt(p []byte, off int64) (int, error) {
+	if off%aes.BlockSize != 0 || len(p)%aes.BlockSize != 0 {
+		return 0, fmt.Errorf("crypto/aes: write of %d bytes at %d is not block aligned", len(p), off)
+	}
+	plain := make([]byte, len(p))
+	for i := 0; i < len(p); i += aes.BlockSize {
+		f.block.Decrypt(plain[i:], p[i:])
+	}
+	return f.file.WriteAt(plain, off)
+}
+
+// ReadAt reads the plaintext around [off, off+len(p)), re-encrypts it and
+// copies the ciphertext into p. A trailing partial block reads as EOF.
+func (f *ECBFile) ReadAt(p []byte, off int64) (int, error) {
+	start := off - off%aes.BlockSize
+	end := off + int64(len(p))
+	if rem := end % aes.BlockSize; rem != 0 {
+		end += aes.BlockSize - rem
+	}
+	buf := make([]byte, end-start)
+	n, err := f.file.ReadAt(buf, start)
+	if want := f.size - start; err == io.EOF && want <= int64(len(buf)) && want > int64(n) && want-int64(n) <= aes.BlockSize {
+		// The file was truncated to PlainSize; put the padding back.
+		padding := want - int64(n)
+		for i := int64(n); i < want; i++ {
+			buf[i] = byte(padding)
+		}
+		n, err = int(want), nil
+	}
+	n -= n % aes.BlockSize
+	for i := 0; i < n; i += aes.BlockSize {
+		f.block.Encrypt(buf[i:], buf[i:])
+	}
+
+	skip := int(off - start)
+	if n <= skip {
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	copied := copy(p, buf[skip:n])
+	if copied == len(p) {
+		return copied, nil
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	return copied, err
+}
+
+// PlainSize returns the size of the decrypted firmware, which is the size
+// of the encrypted file without the padding of the last block. It is only
+// meaningful once the last block has been written.
+func (f *ECBFile) PlainSize() (int64, error) {
+	if f.size < aes.BlockSize {
+		return f.size, nil
+	}
+	last := make([]byte, aes.BlockSize)
+	n, err := f.file.ReadAt(last, f.size-aes.BlockSize)
+	if n == aes.BlockSize {
+		return f.size - int64(paddingLen(last)), nil
+	}
+	if err != io.EOF {
+		return 0, err
+	}
+	// Already truncated.
+	return f.size - aes.BlockSize + int64(n), nil
+}
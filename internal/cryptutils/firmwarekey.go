@@ -0,0 +1,47 @@
+package cryptutils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"path/filepath"
+	"strings"
+)
+
+// Encryption versions of firmware files, named after their extensions.
+const (
+	EncV2 = 2 // .enc2: key derived from region, model and version (GetV2Key)
+	EncV4 = 4 // .enc4: key derived from LOGIC_VALUE_FACTORY sent by FUS
+)
+
+// zipLocalHeader is the signature of a zip local file header. A firmware
+// zip starts with one, so it is what the first block of a correctly
+// decrypted firmware file begins with.
+var zipLocalHeader = []byte("PK\x03\x04")
+
+// EncVersion returns the encryption version of a firmware file from the
+// extension of its name, or 0 if the name ends in neither .enc2 nor .enc4.
+func EncVersion(name string) int {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".enc2":
+		return EncV2
+	case ".enc4":
+		return EncV4
+	}
+	return 0
+}
+
+// KeyMatches reports whether key decrypts first, the first block of a
+// firmware file, to the start of a zip. It is false if first is shorter
+// than a block or key is not a valid AES key.
+func KeyMatches(first, key []byte) bool {
+	if len(first) < aes.BlockSize {
+		return false
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return false
+	}
+	plain := make([]byte, aes.BlockSize)
+	block.Decrypt(plain, first[:aes.BlockSize])
+	return bytes.HasPrefix(plain, zipLocalHeader)
+}
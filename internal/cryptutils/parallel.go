@@ -0,0 +1,192 @@
+package cryptutils
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"samsung-firmware-tool/internal/fuserr"
+)
+
+// DecryptChunkSize is the default amount of ciphertext that one worker
+// decrypts at a time. It is large enough to keep the hand-over between the
+// reader, the workers and the writer cheap.
+const DecryptChunkSize = 1 << 20
+
+// decryptWorkers holds the worker count set by SetDecryptWorkers, 0 for one
+// per CPU.
+var decryptWorkers atomic.Int32
+
+// DecryptWorkers returns the number of goroutines that decrypt in parallel.
+func DecryptWorkers() int {
+	if n := int(decryptWorkers.Load()); n > 0 {
+		return n
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// SetDecryptWorkers sets the number of goroutines that decrypt in parallel.
+// n <= 0 uses one per CPU.
+func SetDecryptWorkers(n int) {
+	decryptWorkers.Store(int32(max(n, 0)))
+}
+
+// ecbChunk is a buffer of ciphertext on its way from the reader through a
+// worker to the writer.
+type ecbChunk struct {
+	buf  []byte
+	n    int
+	done chan struct{} // Signalled once buf[:n] holds plaintext
+}
+
+// decryptECB decrypts up to length bytes of AES-ECB ciphertext from r to w,
+// or everything up to EOF if length is 0. The reader hands chunks of
+// chunkSize bytes to DecryptWorkers workers, which decrypt them in place,
+// and the writer writes them back in order. A fixed set of buffers is
+// reused, so memory use does not depend on the file size. The padding of
+// the last block is not written. onWrite gets the number of bytes written
+// so far.
+func decryptECB(ctx context.Context, r io.Reader, w io.Writer, block cipher.Block, length int64, chunkSize int, onWrite func(written int64)) error {
+	if chunkSize <= 0 {
+		chunkSize = DecryptChunkSize
+	}
+	chunkSize -= chunkSize % aes.BlockSize
+	if chunkSize == 0 {
+		chunkSize = aes.BlockSize
+	}
+	workers := DecryptWorkers()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Two chunks per worker keep the workers busy while the writer waits
+	// for the oldest one.
+	inflight := 2 * workers
+	free := make(chan *ecbChunk, inflight)
+	for i := 0; i < inflight; i++ {
+		free <- &ecbChunk{buf: make([]byte, chunkSize), done: make(chan struct{}, 1)}
+	}
+	work := make(chan *ecbChunk, inflight)
+	ordered := make(chan *ecbChunk, inflight)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range work {
+				decryptBlocks(block, c.buf[:c.n])
+				c.done <- struct{}{}
+			}
+		}()
+	}
+
+	// The last block may end in padding, which only shows once the input
+	// is exhausted. The writer holds back the last block of each chunk
+	// until the next one arrives, and it is unpadded at the end.
+	var written int64
+	held := make([]byte, 0, aes.BlockSize)
+	write := func(p []byte) error {
+		if len(p) == 0 {
+			return nil
+		}
+		if _, err := w.Write(p); err != nil {
+			return fuserr.Wrap(fuserr.CodeDisk, err, "error writing decrypted file")
+		}
+		written += int64(len(p))
+		return nil
+	}
+
+	writeDone := make(chan error, 1)
+	go func() {
+		var err error
+		for c := range ordered {
+			<-c.done
+			if err == nil {
+				err = ctx.Err()
+			}
+			if err == nil {
+				tail := c.n - aes.BlockSize
+				if err = write(held); err == nil {
+					err = write(c.buf[:tail])
+				}
+				if err != nil {
+					cancel()
+				} else {
+					held = append(held[:0], c.buf[tail:c.n]...)
+					onWrite(written)
+				}
+			}
+			free <- c
+		}
+		writeDone <- err
+	}()
+
+	readErr := func() error {
+		for total := int64(0); length <= 0 || total < length; {
+			var c *ecbChunk
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case c = <-free:
+			}
+			want := int64(chunkSize)
+			if length > 0 {
+				want = min(want, length-total)
+			}
+			n, err := io.ReadFull(r, c.buf[:want])
+			eof := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+			if err != nil && !eof {
+				return fuserr.Wrap(fuserr.CodeDisk, err, "error reading encrypted file")
+			}
+			if n%aes.BlockSize != 0 {
+				return fmt.Errorf("crypto/aes: input not full blocks")
+			}
+			if n > 0 {
+				c.n = n
+				ordered <- c
+				work <- c
+				total += int64(n)
+			}
+			if eof {
+				return nil
+			}
+		}
+		return nil
+	}()
+
+	close(work)
+	close(ordered)
+	wg.Wait()
+	writeErr := <-writeDone
+	if writeErr != nil && !errors.Is(writeErr, context.Canceled) {
+		return writeErr
+	}
+	if readErr != nil {
+		return readErr
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	padding := paddingLen(held)
+	if err := write(held[:len(held)-padding]); err != nil {
+		return err
+	}
+	// Count the dropped padding, so that the progress ends at the size of
+	// the input.
+	onWrite(written + int64(padding))
+	return nil
+}
+
+// decryptBlocks decrypts p in place, one AES block at a time.
+func decryptBlocks(block cipher.Block, p []byte) {
+	for i := 0; i < len(p); i += aes.BlockSize {
+		block.Decrypt(p[i:i+aes.BlockSize], p[i:i+aes.BlockSize])
+	}
+}
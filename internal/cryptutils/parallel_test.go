@@ -0,0 +1,42 @@
+package cryptutils
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+)
+
+// BenchmarkDecrypt compares decrypting a firmware with one worker against
+// one worker per CPU.
+func BenchmarkDecrypt(b *testing.B) {
+	key := bytes.Repeat([]byte{0x5a}, 16)
+	plain := make([]byte, 32<<20)
+	for i := range plain {
+		plain[i] = byte(i)
+	}
+	enc, err := EncryptFirmware(plain, key)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	defer SetDecryptWorkers(int(decryptWorkers.Load()))
+	for _, bc := range []struct {
+		name    string
+		workers int
+	}{
+		{"serial", 1},
+		{"parallel", 0},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			SetDecryptWorkers(bc.workers)
+			b.SetBytes(int64(len(enc)))
+			for i := 0; i < b.N; i++ {
+				err := DecryptProgress(context.Background(), bytes.NewReader(enc), io.Discard, key, int64(len(enc)), 0, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
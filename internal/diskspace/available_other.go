@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package diskspace
+
+import "errors"
+
+// Available is not supported on this platform.
+func Available(path string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,54 @@
+// Package diskspace checks and reserves the disk space that a download or
+// a decryption is going to need before any of it is written.
+package diskspace
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"samsung-firmware-tool/internal/fuserr"
+	"samsung-firmware-tool/internal/progress"
+)
+
+// Check returns a fuserr.CodeNoSpace error if the file system holding dir
+// has less than need bytes available. It passes where the free space
+// cannot be queried.
+func Check(dir string, need int64) error {
+	if need <= 0 {
+		return nil
+	}
+	available, err := Available(dir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return fuserr.Wrap(fuserr.CodeDisk, err, "error checking free disk space")
+	}
+	if available < need {
+		return noSpace(dir, need, available)
+	}
+	return nil
+}
+
+// Reserve makes sure that f can grow to size bytes, of which need are not
+// written yet. With preallocate the blocks are also allocated up front
+// where the file system supports it.
+func Reserve(f *os.File, size, need int64, preallocate bool) error {
+	if err := Check(filepath.Dir(f.Name()), need); err != nil {
+		return err
+	}
+	if !preallocate {
+		return nil
+	}
+	if err := Preallocate(f, size); !errors.Is(err, errors.ErrUnsupported) {
+		return err
+	}
+	return nil
+}
+
+// noSpace returns the error for need bytes that do not fit into dir.
+func noSpace(dir string, need, available int64) error {
+	return fuserr.New(fuserr.CodeNoSpace, "not enough free space in %s: %s needed, %s available",
+		dir, progress.FormatBytes(need), progress.FormatBytes(available))
+}
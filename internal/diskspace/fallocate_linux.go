@@ -0,0 +1,44 @@
+//go:build linux
+
+package diskspace
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"samsung-firmware-tool/internal/fuserr"
+)
+
+// fallocKeepSize is FALLOC_FL_KEEP_SIZE: allocate blocks beyond the end of
+// the file without changing its size.
+const fallocKeepSize = 0x1
+
+// Preallocate allocates the blocks for the first size bytes of f with
+// fallocate(2). The size of f does not change, so a resumed download still
+// sees how much was written. It returns errors.ErrUnsupported if the file
+// system cannot preallocate.
+func Preallocate(f *os.File, size int64) error {
+	for {
+		err := syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+		switch {
+		case err == nil:
+			return nil
+		case errors.Is(err, syscall.EINTR):
+			continue
+		case errors.Is(err, syscall.EOPNOTSUPP), errors.Is(err, syscall.ENOSYS):
+			return errors.ErrUnsupported
+		case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EFBIG):
+			// A failed fallocate may keep what it allocated, so give the
+			// blocks behind the end of the file back.
+			if info, statErr := f.Stat(); statErr == nil {
+				f.Truncate(info.Size())
+			}
+			available, _ := Available(filepath.Dir(f.Name()))
+			return noSpace(filepath.Dir(f.Name()), size, available)
+		default:
+			return fuserr.Wrap(fuserr.CodeDisk, err, "error preallocating "+f.Name())
+		}
+	}
+}
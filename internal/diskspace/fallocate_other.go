@@ -0,0 +1,13 @@
+//go:build !linux
+
+package diskspace
+
+import (
+	"errors"
+	"os"
+)
+
+// Preallocate is not supported on this platform.
+func Preallocate(f *os.File, size int64) error {
+	return errors.ErrUnsupported
+}
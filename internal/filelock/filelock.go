@@ -0,0 +1,50 @@
+// Package filelock takes exclusive locks on files that are shared between
+// processes, such as the download queue.
+package filelock
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// ErrLocked is returned by TryLock for a file that another process, or
+// another Lock in this process, holds.
+var ErrLocked = errors.New("file is locked")
+
+// Lock is an exclusive lock on a file. It is released by Unlock or when
+// the process ends.
+type Lock struct {
+	file *os.File
+}
+
+// TryLock creates the file at path if needed and locks it without waiting.
+// On platforms without file locks it always succeeds.
+func TryLock(path string) (*Lock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lock(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Lock{file: file}, nil
+}
+
+// Unlock releases the lock. The file is left in place, as removing it
+// would race with a process that is just opening it.
+func (l *Lock) Unlock() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	err := unlock(l.file)
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	l.file = nil
+	return err
+}
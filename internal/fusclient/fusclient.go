@@ -2,15 +2,21 @@ package fusclient
 
 import (
 	"bytes"
-	"context" // Import context package
-	"encoding/xml"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os" // Used for splitting cookies
+	"strings"
 	"sync"
+	"time"
 
 	"samsung-firmware-tool/internal/cryptutils"
+	"samsung-firmware-tool/internal/fuserr"
+	"samsung-firmware-tool/internal/fusmsg"
+	"samsung-firmware-tool/internal/httpclient"
+	"samsung-firmware-tool/internal/ratelimit"
 	"samsung-firmware-tool/internal/util"
 )
 
@@ -23,147 +29,344 @@ const (
 	BinaryInit    RequestType = "NF_DownloadBinaryInitForMass.do"
 )
 
+// Default endpoints of Samsung's servers.
+const (
+	DefaultFusURL      = "https://neofussvr.sslcs.cdngc.net"
+	DefaultDownloadURL = "http://cloud-neofussvr.samsungmobile.com"
+	DefaultFotaURL     = "https://fota-cloud-dn.ospserver.net:443"
+)
+
+// Environment variables that override the default endpoints.
+const (
+	EnvFusURL      = "SAMLOAD_FUS_URL"
+	EnvDownloadURL = "SAMLOAD_DOWNLOAD_URL"
+	EnvFotaURL     = "SAMLOAD_FOTA_URL"
+)
+
+// Options configures the endpoints and HTTP client used by FusClient and versionfetch.
+// Empty fields fall back to the defaults.
+type Options struct {
+	FusURL      string // Base URL for nonce generation, BinaryInform and BinaryInit
+	DownloadURL string // Base URL for NF_DownloadBinaryForMass.do
+	FotaURL     string // Base URL for the FOTA version.xml
+
+	// HTTPClient sends every request. Wrap a custom http.RoundTripper in
+	// an http.Client to inject it. Nil uses httpclient.Default().
+	HTTPClient *http.Client
+
+	// Retry is applied to FUS requests and download reconnects.
+	// Nil uses DefaultRetryPolicy().
+	Retry *RetryPolicy
+
+	// SessionFile persists the nonce and cookies between runs. Empty
+	// keeps the session in memory only.
+	SessionFile string
+	// NonceTTL is how long a nonce is reused. Zero uses DefaultNonceTTL,
+	// a negative value never expires it.
+	NonceTTL time.Duration
+
+	// ResumeOverlap is how many bytes before a resume point are fetched
+	// again and compared with the partial file, when the output can be
+	// read. Zero uses DefaultResumeOverlap, a negative value disables it.
+	ResumeOverlap int64
+}
+
+// ErrUnauthorized is returned when the server keeps rejecting the
+// session with 401 after the nonce has been regenerated.
+var ErrUnauthorized error = fuserr.FUSStatus("401")
+
+// DefaultOptions returns the Samsung endpoints, overridden by the
+// SAMLOAD_*_URL environment variables when they are set.
+func DefaultOptions() Options {
+	return Options{
+		FusURL:      envOr(EnvFusURL, DefaultFusURL),
+		DownloadURL: envOr(EnvDownloadURL, DefaultDownloadURL),
+		FotaURL:     envOr(EnvFotaURL, DefaultFotaURL),
+	}
+}
+
+// withDefaults fills empty fields from DefaultOptions.
+func (o Options) withDefaults() Options {
+	def := DefaultOptions()
+	if o.FusURL == "" {
+		o.FusURL = def.FusURL
+	}
+	if o.DownloadURL == "" {
+		o.DownloadURL = def.DownloadURL
+	}
+	if o.FotaURL == "" {
+		o.FotaURL = def.FotaURL
+	}
+	return o
+}
+
+// Client returns the HTTP client to use for requests.
+func (o Options) Client() *http.Client {
+	if o.HTTPClient != nil {
+		return o.HTTPClient
+	}
+	return httpclient.Default()
+}
+
+// RetryPolicy returns the retry policy to use.
+func (o Options) RetryPolicy() RetryPolicy {
+	if o.Retry != nil {
+		return *o.Retry
+	}
+	return DefaultRetryPolicy()
+}
+
+// nonceTTL returns the effective nonce lifetime.
+func (o Options) nonceTTL() time.Duration {
+	if o.NonceTTL == 0 {
+		return DefaultNonceTTL
+	}
+	return o.NonceTTL
+}
+
+// FotaEndpoint returns the FOTA URL for the given path.
+func (o Options) FotaEndpoint(path string) string {
+	return joinURL(o.withDefaults().FotaURL, path)
+}
+
+func envOr(key, fallback string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func joinURL(base, path string) string {
+	return strings.TrimRight(base, "/") + "/" + strings.TrimLeft(path, "/")
+}
+
 // FusClient manages communications with Samsung's server.
+// The JSESSIONID and other cookies are kept in a cookie jar.
+//
+// A FusClient is safe for concurrent use, but all callers share one nonce:
+// a BinaryInform built with one nonce may be rejected if another goroutine
+// refreshes it in between. Use a Pool to give each operation its own session.
 type FusClient struct {
-	encNonce  string
-	nonce     string
-	auth      string
-	sessionID string
-	mu        sync.Mutex // Mutex to protect client state during concurrent access
+	encNonce   string
+	nonce      string
+	auth       string
+	nonceTime  time.Time  // When the nonce was issued
+	mu         sync.Mutex // Protects encNonce, nonce, auth and nonceTime
+	nonceMu    sync.Mutex // Serializes nonce generation
+	saveMu     sync.Mutex // Serializes writes of the session file
+	opts       Options
+	jar        http.CookieJar
+	httpClient *http.Client // opts.Client() with the cookie jar attached
 }
 
 // NewFusClient creates and returns a new FusClient instance.
 func NewFusClient() *FusClient {
-	return &FusClient{}
+	return NewFusClientWithOptions(DefaultOptions())
+}
+
+// NewFusClientWithOptions creates a FusClient that talks to the given endpoints.
+// If opts.SessionFile holds an unexpired session for the same server, it is reused.
+func NewFusClientWithOptions(opts Options) *FusClient {
+	f := &FusClient{opts: opts.withDefaults(), jar: newCookieJar()}
+	client := *f.opts.Client()
+	client.Jar = f.jar
+	f.httpClient = &client
+	f.loadSession()
+	return f
+}
+
+// Options returns the options the client was created with.
+func (f *FusClient) Options() Options {
+	return f.opts
 }
 
 // GetNonce retrieves the current nonce, generating it if necessary.
-func (f *FusClient) GetNonce() (string, error) {
+func (f *FusClient) GetNonce(ctx context.Context) (string, error) {
 	f.mu.Lock()
-	defer f.mu.Unlock()
+	nonce, expired := f.nonce, f.nonceExpired()
+	f.mu.Unlock()
 
-	if f.nonce == "" {
-		err := f.generateNonce()
-		if err != nil {
-			return "", err
-		}
+	if expired {
+		return f.generateNonce(ctx, nonce)
 	}
-	return f.nonce, nil
+	return nonce, nil
 }
 
 // generateNonce generates a new nonce by making a request to the server.
-func (f *FusClient) generateNonce() error {
+// stale is the nonce the caller saw; if another goroutine has already
+// replaced it, that nonce is returned instead of generating a second one.
+func (f *FusClient) generateNonce(ctx context.Context, stale string) (string, error) {
+	f.nonceMu.Lock()
+	defer f.nonceMu.Unlock()
+
+	f.mu.Lock()
+	if f.nonce != stale && !f.nonceExpired() {
+		nonce := f.nonce
+		f.mu.Unlock()
+		return nonce, nil
+	}
+	f.mu.Unlock()
+
 	fmt.Println("Generating nonce.")
-	_, err := f.MakeReq(GenerateNonce, "", true)
-	if err != nil {
+	err := f.opts.RetryPolicy().do(ctx, string(GenerateNonce), func() error {
+		_, _, err := f.makeReqOnce(ctx, GenerateNonce, func(string) string { return "" }, true)
 		return err
+	})
+	if err != nil {
+		return "", classify(err)
 	}
-	fmt.Printf("Nonce: %s\n", f.nonce)
-	fmt.Printf("Auth: %s\n", f.auth)
-	return nil
+
+	f.mu.Lock()
+	nonce, auth := f.nonce, f.auth
+	f.mu.Unlock()
+	if nonce == "" || nonce == stale {
+		return "", fuserr.New(fuserr.CodeAuth, "server did not return a new nonce")
+	}
+	fmt.Printf("Nonce: %s\n", nonce)
+	fmt.Printf("Auth: %s\n", auth)
+	return nonce, nil
 }
 
-// getAuthV constructs the Authorization header value.
-func (f *FusClient) getAuthV(includeNonce bool) string {
+// getAuthV constructs the Authorization header value and returns the nonce it is based on.
+func (f *FusClient) getAuthV(includeNonce bool) (string, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
 	nonceVal := ""
 	if includeNonce {
 		nonceVal = f.encNonce
 	}
-	return fmt.Sprintf("FUS nonce=\"%s\", signature=\"%s\", nc=\"\", type=\"\", realm=\"\", newauth=\"1\"", nonceVal, f.auth)
+	return fmt.Sprintf("FUS nonce=\"%s\", signature=\"%s\", nc=\"\", type=\"\", realm=\"\", newauth=\"1\"", nonceVal, f.auth), f.nonce
 }
 
 // getDownloadUrl constructs the download URL for a given file path.
 func (f *FusClient) getDownloadUrl(path string) string {
-	return fmt.Sprintf("http://cloud-neofussvr.samsungmobile.com/NF_DownloadBinaryForMass.do?file=%s", path)
+	return joinURL(f.opts.DownloadURL, fmt.Sprintf("NF_DownloadBinaryForMass.do?file=%s", path))
 }
 
-// makeReq makes a request to Samsung, automatically inserting authorization data.
-func (f *FusClient) MakeReq(requestType RequestType, data string, includeNonce bool) (string, error) {
-	if f.nonce == "" && requestType != GenerateNonce {
-		err := f.generateNonce()
-		if err != nil {
+// MakeReq makes a request to Samsung, automatically inserting authorization data.
+// Transient failures are retried according to the client's RetryPolicy and a
+// 401 regenerates the nonce before the next attempt.
+func (f *FusClient) MakeReq(ctx context.Context, requestType RequestType, data string, includeNonce bool) (string, error) {
+	return f.MakeReqFunc(ctx, requestType, func(string) string { return data }, includeNonce)
+}
+
+// MakeReqFunc is MakeReq for bodies that depend on the nonce, such as the
+// LOGIC_CHECK of BinaryInform and BinaryInit. build is called with the
+// current nonce before every attempt, so a body is never sent with a
+// signature from a different nonce.
+func (f *FusClient) MakeReqFunc(ctx context.Context, requestType RequestType, build func(nonce string) string, includeNonce bool) (string, error) {
+	if requestType == GenerateNonce {
+		_, err := f.generateNonce(ctx, f.currentNonce())
+		return "", err
+	}
+	if _, err := f.GetNonce(ctx); err != nil {
+		return "", err
+	}
+
+	policy := f.opts.RetryPolicy()
+	for attempt := 1; ; attempt++ {
+		body, usedNonce, err := f.makeReqOnce(ctx, requestType, build, includeNonce)
+		if err == nil {
+			return body, nil
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if errors.Is(err, ErrUnauthorized) {
+			// Always allow one nonce refresh, even with retries disabled.
+			if attempt > 1 && attempt >= policy.attempts() {
+				return "", err
+			}
+			if _, err := f.generateNonce(ctx, usedNonce); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if attempt >= policy.attempts() || !policy.retryErr(err) {
+			return "", classify(err)
+		}
+		if err := policy.wait(ctx, string(requestType), attempt, err); err != nil {
 			return "", err
 		}
 	}
-	authV := f.getAuthV(includeNonce)
+}
+
+// currentNonce returns the nonce without generating one.
+func (f *FusClient) currentNonce() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.nonce
+}
+
+// makeReqOnce performs a single attempt of MakeReq and returns the
+// response body and the nonce the request was signed with.
+func (f *FusClient) makeReqOnce(ctx context.Context, requestType RequestType, build func(nonce string) string, includeNonce bool) (string, string, error) {
+	authV, usedNonce := f.getAuthV(includeNonce)
+	data := build(usedNonce)
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("https://neofussvr.sslcs.cdngc.net/%s", requestType), bytes.NewBufferString(data))
+	req, err := http.NewRequestWithContext(ctx, "POST", joinURL(f.opts.FusURL, string(requestType)), bytes.NewBufferString(data))
 	if err != nil {
-		return "", err
+		return "", usedNonce, err
 	}
 
 	req.Header.Set("Authorization", authV)
 	req.Header.Set("User-Agent", "Kiss2.0_FUS")
-	req.Header.Set("Cookie", "JSESSIONID="+f.sessionID)
-	req.Header.Set("Set-Cookie", "JSESSIONID="+f.sessionID)
 	req.Header.Set("Content-Length", fmt.Sprintf("%d", len(data)))
 
-	resp, err := util.GlobalHttpClient.Do(req)
+	resp, err := f.httpClient.Do(req)
 	if err != nil {
-		return "", err
+		return "", usedNonce, err
 	}
 	defer resp.Body.Close()
 
 	bodyBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return "", usedNonce, err
 	}
 	body := string(bodyBytes)
 
+	if fuserr.IsBlockPage(body) {
+		return "", usedNonce, &fuserr.Error{Code: fuserr.CodeBlocked, Status: resp.Status, Message: "request blocked by the server's firewall"}
+	}
 	if requestType != GenerateNonce && f.is401(resp, body) {
-		err = f.generateNonce()
-		if err != nil {
-			return "", err
-		}
-		return f.MakeReq(requestType, data, includeNonce) // Retry with new nonce
+		return "", usedNonce, ErrUnauthorized
+	}
+	if f.opts.RetryPolicy().retryStatus(resp.StatusCode) {
+		return "", usedNonce, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
 	}
 
-	// Update nonce and session ID from response headers
+	// Update nonce from response headers; the JSESSIONID cookie is kept by the jar.
+	// Header lookup is case-insensitive, so this covers both NONCE and nonce.
 	if nonceHeader := resp.Header.Get("NONCE"); nonceHeader != "" {
-		f.encNonce = nonceHeader
-		decryptedNonce, err := cryptutils.DecryptNonce(f.encNonce)
+		decryptedNonce, err := cryptutils.DecryptNonce(nonceHeader)
 		if err != nil {
-			return "", fmt.Errorf("failed to decrypt nonce: %w", err)
+			return "", usedNonce, fuserr.Wrap(fuserr.CodeAuth, err, "failed to decrypt nonce")
 		}
-		f.nonce = decryptedNonce
-		auth, err := cryptutils.GetAuth(f.nonce)
+		auth, err := cryptutils.GetAuth(decryptedNonce)
 		if err != nil {
-			return "", fmt.Errorf("failed to get auth: %w", err)
+			return "", usedNonce, fuserr.Wrap(fuserr.CodeAuth, err, "failed to get auth")
 		}
-		f.auth = auth
-	} else if nonceHeader := resp.Header.Get("nonce"); nonceHeader != "" {
+		f.mu.Lock()
 		f.encNonce = nonceHeader
-		decryptedNonce, err := cryptutils.DecryptNonce(f.encNonce)
-		if err != nil {
-			return "", fmt.Errorf("failed to decrypt nonce: %w", err)
-		}
 		f.nonce = decryptedNonce
-		auth, err := cryptutils.GetAuth(f.nonce)
-		if err != nil {
-			return "", fmt.Errorf("failed to get auth: %w", err)
-		}
 		f.auth = auth
+		f.nonceTime = time.Now()
+		f.mu.Unlock()
 	}
+	f.saveSession()
 
-	for _, cookie := range resp.Cookies() {
-		if cookie.Name == "JSESSIONID" {
-			// The Kotlin code removes everything after the first semicolon.
-			// Go's cookie.Value already gives the clean value.
-			// However, the Kotlin code also has `.replace(Regex(";.*$"), "")`
-			// which implies the value itself might contain semicolons.
-			// Let's try to replicate that behavior if needed.
-			// For now, assume cookie.Value is clean.
-			f.sessionID = cookie.Value
-			break
-		}
-	}
-
-	return body, nil
+	return body, usedNonce, nil
 }
 
 // DownloadFile downloads a file from Samsung's server.
+// If the connection drops, it reconnects according to the client's
+// RetryPolicy and continues from the bytes already written to output.
+// Output must hold the file from offset 0 up to start. If the server's
+// answer to a resumed request does not fit the partial file (see
+// RangeError), output is truncated and the download starts over once.
 func (f *FusClient) DownloadFile(
-	ctx context.Context, // Add context parameter
+	ctx context.Context,
 	fileName string,
 	start int64,
 	size int64,
@@ -171,27 +374,83 @@ func (f *FusClient) DownloadFile(
 	outputSize int64,
 	progressCallback func(current, max, bps int64),
 ) (string, error) {
-	authV := f.getAuthV(true)
-	url := f.getDownloadUrl(fileName)
-
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil) // Use NewRequestWithContext
-	if err != nil {
-		return "", err
+	policy := f.opts.RetryPolicy()
+	written := int64(0)
+	md5 := ""
+	restarted := false
+
+	for attempt := 1; ; attempt++ {
+		n, respMD5, err := f.downloadOnce(ctx, fileName, start+written, size, output, outputSize+written, progressCallback)
+		written += n
+		if md5 == "" {
+			md5 = respMD5
+		}
+		if err == nil {
+			return md5, nil
+		}
+		if ctx.Err() != nil {
+			return md5, ctx.Err()
+		}
+		var rangeErr *RangeError
+		if errors.As(err, &rangeErr) && start+written > 0 && !restarted {
+			// The partial file cannot be continued, so start over.
+			if err := restartOutput(output); err != nil {
+				return md5, err
+			}
+			start, written, outputSize, md5 = 0, 0, 0, ""
+			restarted = true
+			attempt = 0
+			continue
+		}
+		if n > 0 {
+			// The connection made progress, so start counting attempts again.
+			attempt = 1
+		}
+		if attempt >= policy.attempts() || !policy.retryErr(err) {
+			return md5, classify(err)
+		}
+		if err := policy.wait(ctx, "download", attempt, err); err != nil {
+			return md5, err
+		}
 	}
+}
 
-	req.Header.Set("Authorization", authV)
-	req.Header.Set("User-Agent", "Kies2.0_FUS")
+// downloadOnce performs a single download request starting at start and
+// returns the number of bytes written.
+func (f *FusClient) downloadOnce(
+	ctx context.Context,
+	fileName string,
+	start int64,
+	size int64,
+	output io.Writer,
+	outputSize int64,
+	progressCallback func(current, max, bps int64),
+) (int64, string, error) {
+	rangeHeader := ""
+	var overlap int64
+	file, canRead := output.(io.ReaderAt)
+	if canRead {
+		overlap = f.opts.resumeOverlap(start)
+	}
 	if start > 0 {
-		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", start))
+		rangeHeader = fmt.Sprintf("bytes=%d-", start-overlap)
 	}
-
-	resp, err := util.GlobalHttpClient.Do(req)
+	resp, err := f.requestDownload(ctx, fileName, rangeHeader)
 	if err != nil {
-		return "", err
+		return 0, "", err
 	}
 	defer resp.Body.Close()
 
-	md5 := resp.Header.Get("Content-MD5")
+	if err := checkRange(resp, start-overlap, size); err != nil {
+		return 0, "", err
+	}
+	if err := checkOverlap(resp.Body, file, start-overlap, overlap); err != nil {
+		return 0, "", err
+	}
+
+	md5 := fileMD5(resp)
+	counter := &countingWriter{w: output}
+	body := limitBody(ctx, resp.Body)
 
 	err = util.TrackOperationProgress(
 		size,
@@ -202,7 +461,7 @@ func (f *FusClient) DownloadFile(
 			case <-ctx.Done():
 				return 0, ctx.Err() // Return context error if cancelled
 			default:
-				n, err := io.CopyN(output, resp.Body, util.DEFAULT_CHUNK_SIZE)
+				n, err := io.CopyN(counter, body, util.DEFAULT_CHUNK_SIZE)
 				return n, err
 			}
 		},
@@ -215,40 +474,139 @@ func (f *FusClient) DownloadFile(
 				return true // Continue until io.CopyN returns EOF or error
 			}
 		},
-		false,
+		true,
 	)
-
+	if ctx.Err() != nil {
+		return counter.n, md5, ctx.Err()
+	}
 	if err != nil && err != io.EOF {
-		return "", err
+		return counter.n, md5, err
+	}
+	if size > 0 && start+counter.n < size {
+		// The body ended cleanly but short of the file size.
+		return counter.n, md5, io.ErrUnexpectedEOF
 	}
 
-	return md5, nil
+	return counter.n, md5, nil
 }
 
-// is401 checks if the response indicates a 401 Unauthorized status.
-func (f *FusClient) is401(resp *http.Response, body string) bool {
-	if resp.StatusCode == 401 {
-		return true
+// requestDownload sends the download request for fileName with an optional
+// Range header and checks the response status. Like MakeReqFunc, it
+// regenerates the nonce once when the server answers 401, e.g. because
+// the nonce expired during a long download.
+func (f *FusClient) requestDownload(ctx context.Context, fileName, rangeHeader string) (*http.Response, error) {
+	resp, usedNonce, err := f.requestDownloadOnce(ctx, fileName, rangeHeader)
+	if !errors.Is(err, ErrUnauthorized) {
+		return resp, err
+	}
+	if _, err := f.generateNonce(ctx, usedNonce); err != nil {
+		return nil, err
 	}
+	resp, _, err = f.requestDownloadOnce(ctx, fileName, rangeHeader)
+	return resp, err
+}
 
-	var fusMsg util.XMLNode
-	err := xml.Unmarshal([]byte(body), &fusMsg)
+// requestDownloadOnce performs a single attempt of requestDownload and
+// returns the response and the nonce the request was signed with.
+func (f *FusClient) requestDownloadOnce(ctx context.Context, fileName, rangeHeader string) (*http.Response, string, error) {
+	authV, usedNonce := f.getAuthV(true)
+	url := f.getDownloadUrl(fileName)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return false // Not XML or parsing error, assume not 401 from body
+		return nil, usedNonce, err
 	}
 
-	fusBody := util.FirstElementByTagName(&fusMsg, "FUSBody")
-	if fusBody == nil {
-		return false
+	req.Header.Set("Authorization", authV)
+	req.Header.Set("User-Agent", "Kies2.0_FUS")
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
 	}
-	results := util.FirstElementByTagName(fusBody, "Results")
-	if results == nil {
-		return false
+
+	resp, err := f.httpClient.Do(req)
+	if err != nil {
+		return nil, usedNonce, err
 	}
-	status := util.FirstElementByTagName(results, "Status")
-	if status == nil {
-		return false
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		defer resp.Body.Close()
+		page, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if fuserr.IsBlockPage(string(page)) {
+			return nil, usedNonce, &fuserr.Error{Code: fuserr.CodeBlocked, Status: resp.Status, Message: "download blocked by the server's firewall"}
+		}
+		if resp.StatusCode == http.StatusUnauthorized {
+			return nil, usedNonce, ErrUnauthorized
+		}
+		return nil, usedNonce, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return resp, usedNonce, nil
+}
+
+// fileMD5 returns the Content-MD5 of a download response if it is the MD5
+// of the whole file: that of a 200, or of a 206 whose Content-Range spans
+// the whole file. Any other 206 describes at most its own range, which
+// cannot be compared with the file, so it is ignored and the file is only
+// checked against BINARY_CRC.
+func fileMD5(resp *http.Response) string {
+	if resp.StatusCode == http.StatusPartialContent {
+		var first, last, size int64
+		contentRange := resp.Header.Get("Content-Range")
+		if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &first, &last, &size); err != nil || first != 0 || last != size-1 {
+			return ""
+		}
+	} else if resp.StatusCode != http.StatusOK {
+		return ""
 	}
+	return resp.Header.Get("Content-MD5")
+}
+
+type rateLimitKey struct{}
+
+// WithRateLimit returns a context whose downloads read no faster than l
+// allows, in addition to the process-wide ratelimit.Global. Sharing l
+// between contexts shares the limit between their downloads.
+func WithRateLimit(ctx context.Context, l *ratelimit.Limiter) context.Context {
+	return context.WithValue(ctx, rateLimitKey{}, l)
+}
 
-	return status.Text() == "401"
+// limitBody applies the rate limit of ctx and the global limit to body.
+func limitBody(ctx context.Context, body io.Reader) io.Reader {
+	l, _ := ctx.Value(rateLimitKey{}).(*ratelimit.Limiter)
+	return ratelimit.NewReader(ctx, body, l, ratelimit.Global)
+}
+
+// restartOutput empties output for a download that starts over.
+func restartOutput(output *os.File) error {
+	if err := output.Truncate(0); err != nil {
+		return fuserr.Wrap(fuserr.CodeDisk, err, "error truncating download")
+	}
+	if _, err := output.Seek(0, io.SeekStart); err != nil {
+		return fuserr.Wrap(fuserr.CodeDisk, err, "error truncating download")
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, fuserr.Wrap(fuserr.CodeDisk, err, "error writing download")
+}
+
+// is401 checks if the response indicates a 401 Unauthorized status.
+func (f *FusClient) is401(resp *http.Response, body string) bool {
+	if resp.StatusCode == 401 {
+		return true
+	}
+
+	msg, err := fusmsg.Parse([]byte(body))
+	if err != nil {
+		return false // Not XML or parsing error, assume not 401 from body
+	}
+	return msg.Status() == "401"
 }
@@ -0,0 +1,94 @@
+package fusclient_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"samsung-firmware-tool/internal/fusclient"
+	"samsung-firmware-tool/internal/fustest"
+)
+
+// TestDownloadNonceExpired checks that a download the server answers with
+// 401, because the nonce expired, regenerates the nonce and goes on
+// instead of failing, even with retries disabled.
+func TestDownloadNonceExpired(t *testing.T) {
+	fw := fustest.Firmware{Model: "SM-S9110", Region: "CHC", Version: testVersion}
+	srv, err := fustest.NewServer(fw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	retry := fusclient.DefaultRetryPolicy()
+	retry.MaxAttempts = 1
+	opts := srv.Options()
+	opts.Retry = &retry
+	client := fusclient.NewFusClientWithOptions(opts)
+
+	info, err := binaryInit(client, fw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName := info.Path + info.FileName
+	downloads := map[string]func(out *os.File) error{
+		"DownloadFile": func(out *os.File) error {
+			_, err := client.DownloadFile(context.Background(), fileName, 0, info.Size, out, 0, func(current, max, bps int64) {})
+			return err
+		},
+		"DownloadSegments": func(out *os.File) error {
+			_, err := client.DownloadSegments(context.Background(), fileName, fusclient.SplitSegments(0, info.Size, 1), info.Size, out, nil)
+			return err
+		},
+	}
+	for name, download := range downloads {
+		t.Run(name, func(t *testing.T) {
+			out, err := os.Create(filepath.Join(t.TempDir(), info.FileName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer out.Close()
+
+			srv.ExpireNonces()
+			if err := download(out); err != nil {
+				t.Fatalf("download after the nonce expired = %v", err)
+			}
+			if stat, _ := out.Stat(); stat.Size() != info.Size {
+				t.Errorf("downloaded %d bytes, want %d", stat.Size(), info.Size)
+			}
+		})
+	}
+}
+
+// TestRestoreSessionTTL checks that a saved session, cookies included, is
+// only restored while its nonce is younger than the nonce TTL.
+func TestRestoreSessionTTL(t *testing.T) {
+	opts := fusclient.Options{FusURL: "https://neofussvr.sslcs.cdngc.net", NonceTTL: time.Minute}
+	saved := &fusclient.Session{
+		FusURL: opts.FusURL,
+		Nonce:  "0123456789abcdef",
+	}
+	if err := json.Unmarshal([]byte(`[{"name":"JSESSIONID","value":"abc"}]`), &saved.Cookies); err != nil {
+		t.Fatal(err)
+	}
+
+	saved.CreatedAt = time.Now().Add(-2 * time.Minute)
+	client := fusclient.NewFusClientWithOptions(opts)
+	if client.RestoreSession(saved) {
+		t.Error("restored a session older than the nonce TTL")
+	}
+	if cookies := client.Session().Cookies; len(cookies) != 0 {
+		t.Errorf("expired session left cookies %+v", cookies)
+	}
+
+	saved.CreatedAt = time.Now()
+	client = fusclient.NewFusClientWithOptions(opts)
+	if !client.RestoreSession(saved) {
+		t.Fatal("did not restore a fresh session")
+	}
+	if cookies := client.Session().Cookies; len(cookies) != 1 {
+		t.Errorf("restored cookies = %+v, want JSESSIONID", cookies)
+	}
+}
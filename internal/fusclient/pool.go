@@ -0,0 +1,116 @@
+package fusclient
+
+import (
+	"context"
+	"sync"
+)
+
+// Pool hands each concurrent operation its own FusClient, and therefore its
+// own nonce and cookies, while bounding how many operations run at once.
+// Clients are reused once released, so their sessions stay authorized.
+type Pool struct {
+	opts Options
+
+	mu      sync.Mutex
+	size    int
+	inUse   int
+	idle    []*FusClient
+	created int
+	freed   chan struct{} // Closed and replaced whenever a slot may be free
+}
+
+// NewPool creates a pool that runs at most size operations concurrently.
+// Pooled clients share opts, except that the session file is only used by
+// the first client; concurrent sessions cannot share one file.
+func NewPool(opts Options, size int) *Pool {
+	return &Pool{opts: opts, size: max(size, 1), freed: make(chan struct{})}
+}
+
+// Size returns the maximum number of concurrent operations.
+func (p *Pool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size
+}
+
+// SetSize changes the maximum number of concurrent operations. Lowering
+// it lets the clients in use finish rather than taking them away.
+func (p *Pool) SetSize(size int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.size = max(size, 1)
+	p.freedLocked()
+}
+
+// Acquire waits for a free slot and returns a client for exclusive use
+// until it is passed to Release.
+func (p *Pool) Acquire(ctx context.Context) (*FusClient, error) {
+	for {
+		p.mu.Lock()
+		if client := p.takeLocked(); client != nil {
+			p.mu.Unlock()
+			return client, nil
+		}
+		freed := p.freed
+		p.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// TryAcquire is Acquire without waiting. It returns nil if every slot is
+// taken.
+func (p *Pool) TryAcquire() *FusClient {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.takeLocked()
+}
+
+// takeLocked takes a slot and returns its client, or nil if there is no
+// free slot. p.mu must be held.
+func (p *Pool) takeLocked() *FusClient {
+	if p.inUse >= p.size {
+		return nil
+	}
+	p.inUse++
+	if n := len(p.idle); n > 0 {
+		client := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		return client
+	}
+	opts := p.opts
+	if p.created > 0 {
+		opts.SessionFile = ""
+	}
+	p.created++
+	return NewFusClientWithOptions(opts)
+}
+
+// Release returns a client obtained from Acquire and frees its slot.
+func (p *Pool) Release(client *FusClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.idle = append(p.idle, client)
+	p.inUse--
+	p.freedLocked()
+}
+
+// freedLocked wakes the callers waiting in Acquire. p.mu must be held.
+func (p *Pool) freedLocked() {
+	close(p.freed)
+	p.freed = make(chan struct{})
+}
+
+// Do runs fn with a client from the pool.
+func (p *Pool) Do(ctx context.Context, fn func(client *FusClient) error) error {
+	client, err := p.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer p.Release(client)
+	return fn(client)
+}
@@ -0,0 +1,138 @@
+package fusclient_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"samsung-firmware-tool/internal/cryptutils"
+	"samsung-firmware-tool/internal/fusclient"
+	"samsung-firmware-tool/internal/fustest"
+	"samsung-firmware-tool/internal/request"
+)
+
+const testVersion = "S9110ZCU1AWA1/S9110CHC1AWA1/S9110ZCU1AWA1/S9110ZCU1AWA1"
+
+// TestPoolParallel runs BinaryInform, BinaryInit and a segmented download
+// for several firmware at once, each with a client from one Pool. Run it
+// with -race.
+func TestPoolParallel(t *testing.T) {
+	var firmware []fustest.Firmware
+	for i, region := range []string{"CHC", "CHN", "TGY", "BRI", "KOO", "XAA"} {
+		data := bytes.Repeat([]byte{byte(i)}, 3*fusclient.MinSegmentSize+100)
+		firmware = append(firmware, fustest.Firmware{
+			Model:   "SM-S9110",
+			Region:  region,
+			Version: testVersion,
+			Data:    data,
+			V2:      i%2 == 1,
+		})
+	}
+	srv, err := fustest.NewServer(firmware...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	pool := fusclient.NewPool(srv.Options(), 3)
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	errs := make([]error, len(firmware))
+	for i, fw := range firmware {
+		wg.Add(1)
+		go func(i int, fw fustest.Firmware) {
+			defer wg.Done()
+			errs[i] = pool.Do(context.Background(), func(client *fusclient.FusClient) error {
+				return download(client, fw, filepath.Join(dir, fw.Region))
+			})
+		}(i, fw)
+	}
+	wg.Wait()
+
+	for i, fw := range firmware {
+		if errs[i] != nil {
+			t.Fatalf("%s: %v", fw.Region, errs[i])
+		}
+		key := srv.V4Key(fw.Model, fw.Region)
+		if fw.V2 {
+			key, _ = cryptutils.GetV2Key(fw.Version, fw.Model, fw.Region)
+		}
+		want, err := cryptutils.EncryptFirmware(fw.Data, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(filepath.Join(dir, fw.Region))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: downloaded file differs from the served one", fw.Region)
+		}
+	}
+}
+
+// TestPoolBound checks that a pool never hands out more clients than its
+// size and that released clients are reused.
+func TestPoolBound(t *testing.T) {
+	pool := fusclient.NewPool(fusclient.Options{FusURL: "http://127.0.0.1:1"}, 2)
+	a := pool.TryAcquire()
+	b := pool.TryAcquire()
+	if a == nil || b == nil || a == b {
+		t.Fatalf("TryAcquire = %p, %p; want two distinct clients", a, b)
+	}
+	if c := pool.TryAcquire(); c != nil {
+		t.Fatal("TryAcquire succeeded on a full pool")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := pool.Acquire(ctx); err != context.Canceled {
+		t.Fatalf("Acquire on a full pool = %v, want context.Canceled", err)
+	}
+
+	pool.Release(a)
+	if c := pool.TryAcquire(); c != a {
+		t.Fatal("the released client was not reused")
+	}
+	pool.SetSize(3)
+	if c := pool.TryAcquire(); c == nil {
+		t.Fatal("TryAcquire failed after SetSize")
+	}
+}
+
+// download fetches the encrypted file of fw to path over several
+// connections.
+func download(client *fusclient.FusClient, fw fustest.Firmware, path string) error {
+	info, err := binaryInit(client, fw)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	segments := fusclient.SplitSegments(0, info.Size, 3)
+	_, err = client.DownloadSegments(context.Background(), info.Path+info.FileName, segments, info.Size, out, nil)
+	return err
+}
+
+// binaryInit performs BinaryInform and BinaryInit for fw, after which its
+// file can be downloaded.
+func binaryInit(client *fusclient.FusClient, fw fustest.Firmware) (*request.BinaryFileInfo, error) {
+	ctx := context.Background()
+	info, err := request.RetrieveBinaryFileInfo(ctx, fw.Version, fw.Model, fw.Region, "123456789012345", client, func(string) {}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = client.MakeReqFunc(ctx, fusclient.BinaryInit, func(nonce string) string {
+		return request.CreateBinaryInit(info.FileName, nonce)
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
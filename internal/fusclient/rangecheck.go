@@ -0,0 +1,102 @@
+package fusclient
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+
+	"samsung-firmware-tool/internal/fuserr"
+)
+
+// DefaultResumeOverlap is the number of bytes before a resume point that
+// are downloaded again and compared with what is on disk.
+const DefaultResumeOverlap = 64 << 10
+
+// RangeError is returned when a download response does not fit the
+// requested byte range, e.g. a 200 with the whole file for a resumed
+// download, a Content-Range at another offset or for a file of another
+// size, or overlap bytes that differ from the partial file. The partial
+// file cannot be continued with such a response and has to be restarted.
+type RangeError struct {
+	Offset int64  // Requested start of the range
+	Reason string // What did not match
+}
+
+func (e *RangeError) Error() string {
+	return fmt.Sprintf("download response does not match the range starting at %d: %s", e.Offset, e.Reason)
+}
+
+// ErrorCode classifies range mismatches as server errors.
+func (e *RangeError) ErrorCode() fuserr.Code {
+	return fuserr.CodeServer
+}
+
+func (e *RangeError) Is(target error) bool {
+	return fuserr.Has(target, e.ErrorCode())
+}
+
+// resumeOverlap returns how many bytes before a resume point to fetch
+// again, given that done bytes are on disk.
+func (o Options) resumeOverlap(done int64) int64 {
+	overlap := o.ResumeOverlap
+	if overlap == 0 {
+		overlap = DefaultResumeOverlap
+	}
+	if overlap < 0 {
+		return 0
+	}
+	return min(overlap, done)
+}
+
+// checkRange validates the status and Content-Range of a response to a
+// request for the bytes from offset on. size is the size of the whole
+// file, or 0 if unknown.
+func checkRange(resp *http.Response, offset, size int64) error {
+	if resp.StatusCode == http.StatusOK {
+		if offset > 0 {
+			return &RangeError{Offset: offset, Reason: "the server sent the whole file (200) instead of a range"}
+		}
+		if size > 0 && resp.ContentLength >= 0 && resp.ContentLength != size {
+			return &RangeError{Offset: offset, Reason: fmt.Sprintf("the file has %d bytes, expected %d", resp.ContentLength, size)}
+		}
+		return nil
+	}
+
+	contentRange := resp.Header.Get("Content-Range")
+	var first, last int64
+	var complete string
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%s", &first, &last, &complete); err != nil || last < first {
+		return &RangeError{Offset: offset, Reason: fmt.Sprintf("invalid Content-Range %q", contentRange)}
+	}
+	if first != offset {
+		return &RangeError{Offset: offset, Reason: fmt.Sprintf("Content-Range %q starts at %d", contentRange, first)}
+	}
+	if size > 0 && complete != "*" && complete != fmt.Sprint(size) {
+		return &RangeError{Offset: offset, Reason: fmt.Sprintf("Content-Range %q is for a file of another size than %d", contentRange, size)}
+	}
+	if size > 0 && last >= size {
+		return &RangeError{Offset: offset, Reason: fmt.Sprintf("Content-Range %q ends past the file size %d", contentRange, size)}
+	}
+	return nil
+}
+
+// checkOverlap reads n bytes from body and compares them with the bytes
+// of file at offset, which were written by an earlier connection.
+func checkOverlap(body io.Reader, file io.ReaderAt, offset, n int64) error {
+	if n <= 0 {
+		return nil
+	}
+	fetched := make([]byte, n)
+	if _, err := io.ReadFull(body, fetched); err != nil {
+		return err
+	}
+	onDisk := make([]byte, n)
+	if _, err := file.ReadAt(onDisk, offset); err != nil {
+		return fuserr.Wrap(fuserr.CodeDisk, err, "error reading partial download")
+	}
+	if !bytes.Equal(fetched, onDisk) {
+		return &RangeError{Offset: offset, Reason: "the bytes before the resume point differ from the partial file"}
+	}
+	return nil
+}
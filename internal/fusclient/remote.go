@@ -0,0 +1,144 @@
+package fusclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// remotePageSize is the amount a RemoteFile fetches with one Range
+	// request. Reads are rounded out to whole pages, so that the many small
+	// reads of a zip reader turn into few requests.
+	remotePageSize = 1 << 20
+
+	// remotePages is the number of pages a RemoteFile keeps.
+	remotePages = 16
+)
+
+// RemoteFile is an io.ReaderAt over a file on the download server. Every
+// read is served from pages of remotePageSize bytes that are fetched with
+// Range requests, retried according to the client's RetryPolicy and kept
+// in a small cache. The client must have passed BinaryInit for the file.
+// It is safe for concurrent use.
+type RemoteFile struct {
+	client   *FusClient
+	ctx      context.Context
+	fileName string
+	size     int64
+
+	mu    sync.Mutex
+	pages map[int64][]byte // Page index to content
+	order []int64          // Page indices, least recently used first
+	read  int64            // Bytes fetched from the server
+}
+
+// OpenRemote returns a RemoteFile for fileName (path and name as in
+// DownloadFile) of size bytes. Requests are made under ctx, which also
+// carries the rate limit (see WithRateLimit).
+func (f *FusClient) OpenRemote(ctx context.Context, fileName string, size int64) *RemoteFile {
+	return &RemoteFile{
+		client:   f,
+		ctx:      ctx,
+		fileName: fileName,
+		size:     size,
+		pages:    make(map[int64][]byte),
+	}
+}
+
+// Size returns the size of the file.
+func (r *RemoteFile) Size() int64 {
+	return r.size
+}
+
+// BytesRead returns the number of bytes fetched from the server so far.
+func (r *RemoteFile) BytesRead() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.read
+}
+
+// ReadAt reads len(p) bytes at off, fetching the pages that are not cached.
+func (r *RemoteFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("fusclient: negative offset %d", off)
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.size {
+			return n, io.EOF
+		}
+		page, err := r.page(pos / remotePageSize)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], page[pos%remotePageSize:])
+	}
+	return n, nil
+}
+
+// page returns page index, from the cache or from the server.
+func (r *RemoteFile) page(index int64) ([]byte, error) {
+	r.mu.Lock()
+	if page, ok := r.pages[index]; ok {
+		r.touch(index)
+		r.mu.Unlock()
+		return page, nil
+	}
+	r.mu.Unlock()
+
+	page, err := r.fetch(index)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.read += int64(len(page))
+	if _, ok := r.pages[index]; !ok && len(r.order) >= remotePages {
+		delete(r.pages, r.order[0])
+		r.order = r.order[1:]
+	}
+	r.pages[index] = page
+	r.touch(index)
+	return page, nil
+}
+
+// touch marks page index as the most recently used. r.mu must be held.
+func (r *RemoteFile) touch(index int64) {
+	for i, idx := range r.order {
+		if idx == index {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+	r.order = append(r.order, index)
+}
+
+// fetch downloads page index, reconnecting after failures.
+func (r *RemoteFile) fetch(index int64) ([]byte, error) {
+	start := index * remotePageSize
+	end := min(start+remotePageSize, r.size)
+	page := make([]byte, end-start)
+	err := r.client.opts.RetryPolicy().do(r.ctx, "download", func() error {
+		resp, err := r.client.requestDownload(r.ctx, r.fileName, fmt.Sprintf("bytes=%d-%d", start, end-1))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := checkRange(resp, start, r.size); err != nil {
+			return err
+		}
+		_, err = io.ReadFull(limitBody(r.ctx, resp.Body), page)
+		return err
+	})
+	if err != nil {
+		if r.ctx.Err() != nil {
+			return nil, r.ctx.Err()
+		}
+		return nil, classify(err)
+	}
+	return page, nil
+}
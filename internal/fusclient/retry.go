@@ -0,0 +1,242 @@
+package fusclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"samsung-firmware-tool/internal/fuserr"
+)
+
+// RetryPolicy controls how failed FUS requests and interrupted downloads are retried.
+type RetryPolicy struct {
+	MaxAttempts     int           // Total attempts including the first one; 1 disables retries
+	BaseDelay       time.Duration // Delay before the first retry
+	MaxDelay        time.Duration // Upper bound for a single delay
+	Multiplier      float64       // Growth factor of the delay per attempt
+	Jitter          float64       // Fraction of each delay that is randomised (0..1)
+	RetryableStatus []int         // HTTP status codes that are retried
+
+	// Retryable overrides the classification of transport errors. Nil uses
+	// IsRetryableError. Context cancellation is never retried.
+	Retryable func(err error) bool
+
+	// OnRetry is called before every retry. See also WithRetryNotify.
+	OnRetry func(RetryEvent)
+}
+
+// RetryEvent describes a retry that is about to happen.
+type RetryEvent struct {
+	Op          string        // Request type or "download"
+	Attempt     int           // The attempt that failed, starting at 1
+	MaxAttempts int           // Attempts allowed by the policy
+	Delay       time.Duration // Time until the next attempt
+	Err         error         // Why the attempt failed
+}
+
+func (e RetryEvent) String() string {
+	return fmt.Sprintf("%s failed (attempt %d/%d), retrying in %s: %v", e.Op, e.Attempt, e.MaxAttempts, e.Delay.Round(time.Millisecond), e.Err)
+}
+
+// StatusError is returned when the server answers with an unexpected HTTP status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status: %s", e.Status)
+}
+
+// ErrorCode classifies the status: 401/403 as auth failures, 404 as not
+// found, 429 and 5xx as server errors.
+func (e *StatusError) ErrorCode() fuserr.Code {
+	switch {
+	case e.StatusCode == 401 || e.StatusCode == 403:
+		return fuserr.CodeAuth
+	case e.StatusCode == 404:
+		return fuserr.CodeNotFound
+	case e.StatusCode == 429 || e.StatusCode >= 500:
+		return fuserr.CodeServer
+	default:
+		return fuserr.CodeBadStatus
+	}
+}
+
+func (e *StatusError) Is(target error) bool {
+	return fuserr.Has(target, e.ErrorCode())
+}
+
+// DefaultRetryPolicy returns the policy used when Options.Retry is nil.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:     5,
+		BaseDelay:       1 * time.Second,
+		MaxDelay:        30 * time.Second,
+		Multiplier:      2,
+		Jitter:          0.2,
+		RetryableStatus: []int{429, 500, 502, 503, 504},
+	}
+}
+
+// attempts returns the number of attempts, at least 1.
+func (p RetryPolicy) attempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// backoff returns the delay after the given failed attempt (1-based).
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	delay := float64(p.BaseDelay) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		jitter := math.Min(p.Jitter, 1)
+		delay += delay * jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(delay)
+}
+
+// retryStatus reports whether a response with the given status should be retried.
+func (p RetryPolicy) retryStatus(code int) bool {
+	for _, c := range p.RetryableStatus {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// retryErr reports whether err should be retried.
+func (p RetryPolicy) retryErr(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return p.retryStatus(statusErr.StatusCode)
+	}
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryableError(err)
+}
+
+// wait reports the retry and sleeps for the backoff delay.
+func (p RetryPolicy) wait(ctx context.Context, op string, attempt int, err error) error {
+	event := RetryEvent{
+		Op:          op,
+		Attempt:     attempt,
+		MaxAttempts: p.attempts(),
+		Delay:       p.backoff(attempt),
+		Err:         err,
+	}
+	if p.OnRetry != nil {
+		p.OnRetry(event)
+	}
+	if notify, ok := ctx.Value(retryNotifyKey{}).(func(RetryEvent)); ok {
+		notify(event)
+	}
+
+	timer := time.NewTimer(event.Delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// do runs fn until it succeeds, fails with a non-retryable error or the
+// attempts are used up.
+func (p RetryPolicy) do(ctx context.Context, op string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt >= p.attempts() || !p.retryErr(err) {
+			return err
+		}
+		if err := p.wait(ctx, op, attempt, err); err != nil {
+			return err
+		}
+	}
+}
+
+// IsRetryableError reports whether err looks like a transient network failure:
+// timeouts, refused or reset connections and truncated responses. Failed
+// certificate checks, unknown hosts and other errors that a retry cannot
+// fix are not retried, even though http.Client wraps them in a net.Error.
+func IsRetryableError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || isTLSError(err) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isTLSError reports whether err is a failed TLS handshake or certificate
+// check, e.g. because of a wrong --ca-cert.
+func isTLSError(err error) bool {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		invalid          x509.CertificateInvalidError
+		hostname         x509.HostnameError
+		systemRoots      x509.SystemRootsError
+		verification     *tls.CertificateVerificationError
+		recordHeader     tls.RecordHeaderError
+		alert            tls.AlertError
+	)
+	return errors.As(err, &unknownAuthority) || errors.As(err, &invalid) ||
+		errors.As(err, &hostname) || errors.As(err, &systemRoots) ||
+		errors.As(err, &verification) || errors.As(err, &recordHeader) ||
+		errors.As(err, &alert)
+}
+
+// classify marks transient transport failures as network errors once the
+// retries are used up. Errors that already have a class are kept.
+func classify(err error) error {
+	if IsRetryableError(err) {
+		return fuserr.Wrap(fuserr.CodeNetwork, err, "network error")
+	}
+	return err
+}
+
+type retryNotifyKey struct{}
+
+// WithRetryNotify returns a context whose FUS requests and downloads call fn
+// before every retry, in addition to RetryPolicy.OnRetry. This lets several
+// tasks share a client while each reports its own retries.
+func WithRetryNotify(ctx context.Context, fn func(RetryEvent)) context.Context {
+	return context.WithValue(ctx, retryNotifyKey{}, fn)
+}
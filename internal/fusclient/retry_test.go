@@ -0,0 +1,54 @@
+package fusclient_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"samsung-firmware-tool/internal/fusclient"
+)
+
+// TestIsRetryableError checks that only transient failures are retried,
+// also when http.Client wraps them in a *url.Error.
+func TestIsRetryableError(t *testing.T) {
+	// A TLS server whose certificate the default client does not trust.
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	_, certErr := http.Get(srv.URL)
+	if certErr == nil {
+		t.Fatal("request to an untrusted server succeeded")
+	}
+	_, schemeErr := http.Get("ftp://example.com/")
+
+	urlErr := func(err error) error {
+		return &url.Error{Op: "Post", URL: "https://neofussvr.sslcs.cdngc.net/", Err: err}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"timeout", urlErr(&net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}), true},
+		{"connection reset", urlErr(&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), true},
+		{"connection refused", urlErr(&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), true},
+		{"truncated", urlErr(io.ErrUnexpectedEOF), true},
+		{"temporary DNS failure", urlErr(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "server misbehaving", IsTemporary: true}}), true},
+		{"unknown host", urlErr(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", IsNotFound: true}}), false},
+		{"untrusted certificate", certErr, false},
+		{"unsupported scheme", schemeErr, false},
+		{"proxy refused", urlErr(errors.New("proxyconnect tcp: 407 Proxy Authentication Required")), false},
+		{"cancelled", urlErr(context.Canceled), false},
+	}
+	for _, tt := range tests {
+		if got := fusclient.IsRetryableError(tt.err); got != tt.want {
+			t.Errorf("%s: IsRetryableError(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
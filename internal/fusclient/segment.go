@@ -0,0 +1,224 @@
+package fusclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"samsung-firmware-tool/internal/fuserr"
+)
+
+// MinSegmentSize is the smallest segment SplitSegments creates, so that
+// small files are not split into many tiny requests.
+const MinSegmentSize = 1 << 20
+
+// segmentBufferSize is the read size of a segment connection.
+const segmentBufferSize = 256 << 10
+
+// segmentAlign is the alignment of segment boundaries, the AES block size,
+// so that no block of an encrypted firmware is split between segments.
+const segmentAlign = 16
+
+// blockWriter is implemented by outputs that only accept writes of whole
+// blocks, e.g. cryptutils.ECBFile.
+type blockWriter interface {
+	BlockSize() int
+}
+
+// Segment is the byte range [Start, End) of a download. Done counts the
+// bytes of the range that have been written.
+type Segment struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	Done  int64 `json:"done"`
+}
+
+// Complete reports whether the whole range has been written.
+func (s Segment) Complete() bool {
+	return s.Start+s.Done >= s.End
+}
+
+// SplitSegments divides [start, end) into at most n segments of roughly
+// equal size, none smaller than MinSegmentSize unless the range is. The
+// segments after the first start at multiples of 16 bytes from start.
+func SplitSegments(start, end int64, n int) []Segment {
+	length := end - start
+	if length <= 0 {
+		return nil
+	}
+	if n < 1 {
+		n = 1
+	}
+	if max := length / MinSegmentSize; int64(n) > max {
+		n = int(max)
+		if n < 1 {
+			n = 1
+		}
+	}
+
+	segments := make([]Segment, 0, n)
+	size := length / int64(n)
+	size -= size % segmentAlign
+	for i := 0; i < n; i++ {
+		seg := Segment{Start: start + int64(i)*size, End: start + int64(i+1)*size}
+		if i == n-1 {
+			seg.End = end
+		}
+		segments = append(segments, seg)
+	}
+	return segments
+}
+
+// DownloadSegments downloads the missing part of every segment over its
+// own connection and writes it to output at the segment's offset. Every
+// segment reconnects on its own according to the client's RetryPolicy,
+// continuing from the bytes it has already written. The first segment
+// that fails cancels the others.
+//
+// size is the size of the whole file, used to validate the responses (see
+// RangeError); 0 skips that check. When output is also an io.ReaderAt, a
+// segment that resumes first fetches the bytes before its resume point
+// again and compares them with output (see Options.ResumeOverlap). When
+// output has a BlockSize method, it is only written whole blocks; partial
+// blocks are held back until the rest arrives, so Done stays aligned and
+// resuming starts at a block boundary.
+//
+// segments is not modified. onProgress is called after every chunk with
+// the index and new state of a segment; it may be called from several
+// goroutines at once. The Content-MD5 of the first response that carries
+// the whole file is returned, or "" if every response was partial.
+func (f *FusClient) DownloadSegments(
+	ctx context.Context,
+	fileName string,
+	segments []Segment,
+	size int64,
+	output io.WriterAt,
+	onProgress func(index int, seg Segment),
+) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	work := append([]Segment(nil), segments...)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		md5      string
+		firstErr error
+	)
+	for i := range work {
+		if work[i].Complete() {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			segMD5, err := f.downloadSegment(ctx, fileName, &work[i], size, output, func(seg Segment) {
+				if onProgress != nil {
+					onProgress(i, seg)
+				}
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+			if md5 == "" {
+				md5 = segMD5
+			}
+			if err != nil && firstErr == nil {
+				firstErr = err
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return md5, firstErr
+}
+
+// downloadSegment downloads the rest of seg, reconnecting after failures.
+func (f *FusClient) downloadSegment(ctx context.Context, fileName string, seg *Segment, size int64, output io.WriterAt, onProgress func(Segment)) (string, error) {
+	policy := f.opts.RetryPolicy()
+	md5 := ""
+	for attempt := 1; !seg.Complete(); attempt++ {
+		before := seg.Done
+		respMD5, err := f.fetchSegment(ctx, fileName, seg, size, output, onProgress)
+		if md5 == "" {
+			md5 = respMD5
+		}
+		if err == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			return md5, ctx.Err()
+		}
+		if seg.Done > before {
+			// The connection made progress, so start counting attempts again.
+			attempt = 1
+		}
+		if attempt >= policy.attempts() || !policy.retryErr(err) {
+			return md5, classify(err)
+		}
+		if err := policy.wait(ctx, "download", attempt, err); err != nil {
+			return md5, err
+		}
+	}
+	return md5, nil
+}
+
+// fetchSegment performs a single Range request for the rest of seg.
+func (f *FusClient) fetchSegment(ctx context.Context, fileName string, seg *Segment, size int64, output io.WriterAt, onProgress func(Segment)) (string, error) {
+	from := seg.Start + seg.Done
+	var overlap int64
+	file, canRead := output.(io.ReaderAt)
+	if canRead {
+		overlap = f.opts.resumeOverlap(seg.Done)
+	}
+	resp, err := f.requestDownload(ctx, fileName, fmt.Sprintf("bytes=%d-%d", from-overlap, seg.End-1))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if err := checkRange(resp, from-overlap, size); err != nil {
+		return "", err
+	}
+	if err := checkOverlap(resp.Body, file, from-overlap, overlap); err != nil {
+		return "", err
+	}
+	// A 200 for a segment starting at 0 is the whole file; read only the segment.
+	body := limitBody(ctx, io.LimitReader(resp.Body, seg.End-from))
+
+	blockSize := 1
+	if bw, ok := output.(blockWriter); ok {
+		blockSize = bw.BlockSize()
+	}
+
+	buf := make([]byte, segmentBufferSize)
+	pending := 0 // Bytes at the start of buf that have not been written
+	for !seg.Complete() {
+		n, readErr := body.Read(buf[pending:])
+		pending += n
+		writable := pending - pending%blockSize
+		if seg.Start+seg.Done+int64(pending) >= seg.End {
+			writable = pending // The end of the file need not be aligned
+		}
+		if writable > 0 {
+			if _, err := output.WriteAt(buf[:writable], seg.Start+seg.Done); err != nil {
+				return fileMD5(resp), fuserr.Wrap(fuserr.CodeDisk, err, "error writing download")
+			}
+			pending = copy(buf, buf[writable:pending])
+			seg.Done += int64(writable)
+			onProgress(*seg)
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return fileMD5(resp), readErr
+		}
+	}
+	if !seg.Complete() {
+		// The body ended cleanly but short of the segment.
+		return fileMD5(resp), io.ErrUnexpectedEOF
+	}
+	return fileMD5(resp), nil
+}
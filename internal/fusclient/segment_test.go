@@ -0,0 +1,83 @@
+package fusclient_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"samsung-firmware-tool/internal/fusclient"
+)
+
+// rangeMD5Server serves data with Range support and, like some CDNs, a
+// Content-MD5 of the bytes actually sent, so that a 206 carries the MD5
+// of its range rather than of the file.
+func rangeMD5Server(data []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, status := data, http.StatusOK
+		if spec, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok {
+			from, to, _ := strings.Cut(spec, "-")
+			start, _ := strconv.ParseInt(from, 10, 64)
+			end := int64(len(data)) - 1
+			if to != "" {
+				end, _ = strconv.ParseInt(to, 10, 64)
+			}
+			body, status = data[start:end+1], http.StatusPartialContent
+			w.Header().Set("Content-Range", "bytes "+from+"-"+strconv.FormatInt(end, 10)+"/"+strconv.Itoa(len(data)))
+		}
+		sum := md5.Sum(body)
+		w.Header().Set("Content-MD5", hex.EncodeToString(sum[:]))
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.WriteHeader(status)
+		w.Write(body)
+	}))
+}
+
+// TestDownloadMD5 checks that only the Content-MD5 of a 200 is taken for
+// the MD5 of the file.
+func TestDownloadMD5(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3*fusclient.MinSegmentSize/16)
+	sum := md5.Sum(data)
+	srv := rangeMD5Server(data)
+	defer srv.Close()
+	client := fusclient.NewFusClientWithOptions(fusclient.Options{FusURL: srv.URL, DownloadURL: srv.URL, HTTPClient: srv.Client()})
+
+	tests := []struct {
+		name     string
+		segments []fusclient.Segment
+		want     string
+	}{
+		{"whole file", []fusclient.Segment{{Start: 0, End: int64(len(data))}}, hex.EncodeToString(sum[:])},
+		{"segments", fusclient.SplitSegments(0, int64(len(data)), 3), ""},
+		{"resumed", []fusclient.Segment{{Start: 0, End: int64(len(data)), Done: 1 << 20}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := os.Create(filepath.Join(t.TempDir(), "fw"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer out.Close()
+			// The bytes a resumed segment has already written.
+			if _, err := out.Write(data[:tt.segments[0].Done]); err != nil {
+				t.Fatal(err)
+			}
+			got, err := client.DownloadSegments(context.Background(), "fw", tt.segments, int64(len(data)), out, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("DownloadSegments returned MD5 %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
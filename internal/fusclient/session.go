@@ -0,0 +1,180 @@
+package fusclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultNonceTTL is how long a nonce is reused before a new one is generated.
+// The server may expire it earlier, which is detected through a 401.
+const DefaultNonceTTL = 15 * time.Minute
+
+// Session is the authorization state negotiated with the FUS server.
+type Session struct {
+	FusURL    string        `json:"fusUrl"`
+	EncNonce  string        `json:"encNonce"`
+	Nonce     string        `json:"nonce"`
+	Auth      string        `json:"auth"`
+	Cookies   []savedCookie `json:"cookies,omitempty"`
+	CreatedAt time.Time     `json:"createdAt"`
+}
+
+// savedCookie is the persisted subset of an http.Cookie. The jar does not
+// return the path or expiry of its cookies, so neither is saved: cookies
+// are restored for the whole FUS server and live only as long as the
+// session, which RestoreSession discards once the nonce TTL has passed.
+type savedCookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Expired reports whether the nonce is older than ttl.
+func (s *Session) Expired(ttl time.Duration) bool {
+	if s == nil || s.Nonce == "" {
+		return true
+	}
+	return ttl > 0 && time.Since(s.CreatedAt) > ttl
+}
+
+// LoadSession reads a session previously written by SaveSession.
+func LoadSession(path string) (*Session, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("invalid session file %s: %w", path, err)
+	}
+	return &session, nil
+}
+
+// SaveSession writes the session to path, replacing it atomically.
+func SaveSession(path string, session *Session) error {
+	data, err := json.MarshalIndent(session, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// DefaultSessionFile returns the session path in the user's cache directory,
+// or "" if there is none.
+func DefaultSessionFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "samloadGo", "session.json")
+}
+
+// newCookieJar returns an empty cookie jar.
+func newCookieJar() http.CookieJar {
+	// cookiejar.New only fails for a broken PublicSuffixList, and we pass none.
+	jar, _ := cookiejar.New(nil)
+	return jar
+}
+
+// Session returns a copy of the client's current session.
+func (f *FusClient) Session() *Session {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sessionLocked()
+}
+
+// sessionLocked builds a Session from the client state. f.mu must be held.
+func (f *FusClient) sessionLocked() *Session {
+	session := &Session{
+		FusURL:    f.opts.FusURL,
+		EncNonce:  f.encNonce,
+		Nonce:     f.nonce,
+		Auth:      f.auth,
+		CreatedAt: f.nonceTime,
+	}
+	if u, err := url.Parse(f.opts.FusURL); err == nil {
+		for _, c := range f.jar.Cookies(u) {
+			session.Cookies = append(session.Cookies, savedCookie{Name: c.Name, Value: c.Value})
+		}
+	}
+	return session
+}
+
+// RestoreSession installs a previously saved session. Sessions for another
+// FUS server or with an expired nonce are ignored.
+func (f *FusClient) RestoreSession(session *Session) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if session == nil || session.FusURL != f.opts.FusURL || session.Expired(f.opts.nonceTTL()) {
+		return false
+	}
+	f.encNonce = session.EncNonce
+	f.nonce = session.Nonce
+	f.auth = session.Auth
+	f.nonceTime = session.CreatedAt
+
+	if u, err := url.Parse(f.opts.FusURL); err == nil && len(session.Cookies) > 0 {
+		cookies := make([]*http.Cookie, 0, len(session.Cookies))
+		for _, c := range session.Cookies {
+			cookies = append(cookies, &http.Cookie{Name: c.Name, Value: c.Value, Path: "/"})
+		}
+		f.jar.SetCookies(u, cookies)
+	}
+	return true
+}
+
+// saveSession persists the session if Options.SessionFile is set.
+func (f *FusClient) saveSession() {
+	if f.opts.SessionFile == "" {
+		return
+	}
+	session := f.Session()
+	if session.Nonce == "" {
+		return
+	}
+
+	f.saveMu.Lock()
+	defer f.saveMu.Unlock()
+	if err := SaveSession(f.opts.SessionFile, session); err != nil {
+		fmt.Printf("Warning: could not save FUS session: %v\n", err)
+	}
+}
+
+// loadSession restores the session from Options.SessionFile, if any.
+func (f *FusClient) loadSession() {
+	if f.opts.SessionFile == "" {
+		return
+	}
+	session, err := LoadSession(f.opts.SessionFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("Warning: could not load FUS session: %v\n", err)
+		}
+		return
+	}
+	if f.RestoreSession(session) {
+		fmt.Println("Reusing saved FUS session.")
+	}
+}
+
+// nonceExpired reports whether a new nonce is needed. f.mu must be held.
+func (f *FusClient) nonceExpired() bool {
+	if f.nonce == "" {
+		return true
+	}
+	ttl := f.opts.nonceTTL()
+	return ttl > 0 && time.Since(f.nonceTime) > ttl
+}
@@ -0,0 +1,149 @@
+// Package fuserr defines the error classes reported by the FUS client,
+// the downloader and the decrypter. Every class has a stable Code that
+// scripts and the Dart app can rely on.
+package fuserr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Code identifies an error class. Codes are part of the public interface
+// and must not change.
+type Code string
+
+const (
+	CodeInvalidFirmware Code = "FUS_F01"          // The server does not know the firmware (status F01)
+	CodeInvalidIMEI     Code = "FUS_408"          // The IMEI or serial number was rejected (status 408)
+	CodeUnauthorized    Code = "FUS_401"          // The session was rejected even after a new nonce
+	CodeBadStatus       Code = "FUS_STATUS"       // Any other unexpected FUS status
+	CodeNoBinary        Code = "NO_BINARY"        // The response has no binary for the model and region
+	CodeVersionMismatch Code = "VERSION_MISMATCH" // The server offers a different version than requested
+	CodeVersionCheck    Code = "VERSION_CHECK"    // The served version could not be verified
+	CodeNotFound        Code = "NOT_FOUND"        // No firmware or file for the model and region (HTTP 404, NoSuchKey)
+	CodeAuth            Code = "AUTH"             // HTTP 401/403 or a nonce that cannot be decrypted
+	CodeNetwork         Code = "NETWORK"          // Connection failures, timeouts and truncated responses
+	CodeServer          Code = "SERVER"           // HTTP 5xx and 429 from Samsung's servers
+	CodeBlocked         Code = "WAF_BLOCKED"      // An Incapsula/WAF block page instead of a FUS response
+	CodeBadKey          Code = "BAD_KEY"          // The decryption key is invalid or does not fit the file
+	CodeDisk            Code = "DISK"             // Reading or writing local files failed
+	CodeNoSpace         Code = "NO_SPACE"         // The output does not fit into the free disk space
+	CodeChecksum        Code = "CHECKSUM"         // The download does not match BINARY_CRC or Content-MD5
+)
+
+// Error is an error with a Code. Status holds the FUS or HTTP status when
+// the error came from a response.
+type Error struct {
+	Code    Code
+	Status  string
+	Message string
+	Err     error // Underlying cause, if any
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = string(e.Code)
+	}
+	if e.Err != nil {
+		return msg + ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is matches any *Error with the same Code, so that the sentinels below
+// can be used with errors.Is.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Sentinels for errors.Is. Only their Code is compared.
+var (
+	ErrInvalidFirmware = &Error{Code: CodeInvalidFirmware}
+	ErrInvalidIMEI     = &Error{Code: CodeInvalidIMEI}
+	ErrUnauthorized    = &Error{Code: CodeUnauthorized}
+	ErrBadStatus       = &Error{Code: CodeBadStatus}
+	ErrNoBinary        = &Error{Code: CodeNoBinary}
+	ErrVersionMismatch = &Error{Code: CodeVersionMismatch}
+	ErrVersionCheck    = &Error{Code: CodeVersionCheck}
+	ErrNotFound        = &Error{Code: CodeNotFound}
+	ErrAuth            = &Error{Code: CodeAuth}
+	ErrNetwork         = &Error{Code: CodeNetwork}
+	ErrServer          = &Error{Code: CodeServer}
+	ErrBlocked         = &Error{Code: CodeBlocked}
+	ErrBadKey          = &Error{Code: CodeBadKey}
+	ErrDisk            = &Error{Code: CodeDisk}
+	ErrNoSpace         = &Error{Code: CodeNoSpace}
+	ErrChecksum        = &Error{Code: CodeChecksum}
+)
+
+// New returns an error of the given class.
+func New(code Code, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Wrap returns err classified as code. A nil err, a context error or an
+// error that already has a Code is returned unchanged.
+func Wrap(code Code, err error, message string) error {
+	if err == nil || errors.Is(err, context.Canceled) || CodeOf(err) != "" {
+		return err
+	}
+	return &Error{Code: code, Message: message, Err: err}
+}
+
+// Coder is implemented by error types of other packages that belong to a
+// class, e.g. fusclient.StatusError.
+type Coder interface {
+	ErrorCode() Code
+}
+
+// CodeOf returns the Code of the first classified error in err's chain,
+// or "" if there is none.
+func CodeOf(err error) Code {
+	for err != nil {
+		switch e := err.(type) {
+		case *Error:
+			return e.Code
+		case Coder:
+			if code := e.ErrorCode(); code != "" {
+				return code
+			}
+		}
+		err = errors.Unwrap(err)
+	}
+	return ""
+}
+
+// Has reports whether target is the sentinel of code. Error types that
+// implement Coder use it in their Is method.
+func Has(target error, code Code) bool {
+	t, ok := target.(*Error)
+	return ok && code != "" && t.Code == code
+}
+
+// FUSStatus returns the error for a FUS result status other than 200.
+func FUSStatus(status string) *Error {
+	switch status {
+	case "F01":
+		return &Error{Code: CodeInvalidFirmware, Status: status, Message: "invalid firmware error"}
+	case "408":
+		return &Error{Code: CodeInvalidIMEI, Status: status, Message: "invalid IMEI or serial"}
+	case "401":
+		return &Error{Code: CodeUnauthorized, Status: status, Message: "FUS request unauthorized (401)"}
+	default:
+		return &Error{Code: CodeBadStatus, Status: status, Message: "bad return status: " + status}
+	}
+}
+
+// IsBlockPage reports whether body is a WAF block page rather than a
+// FUS or FOTA response.
+func IsBlockPage(body string) bool {
+	return strings.Contains(body, "Incapsula")
+}
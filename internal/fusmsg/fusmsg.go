@@ -0,0 +1,249 @@
+package fusmsg
+
+import (
+	"bytes"
+	"encoding/xml"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// FUSMsg is the envelope of every FUS request and response.
+type FUSMsg struct {
+	XMLName xml.Name `xml:"FUSMsg"`
+	Hdr     *FUSHdr  `xml:"FUSHdr,omitempty"`
+	Body    FUSBody  `xml:"FUSBody"`
+
+	// Raw is the document the message was parsed from.
+	Raw string `xml:"-"`
+}
+
+// FUSHdr is the message header.
+type FUSHdr struct {
+	ProtoVer  string `xml:"ProtoVer"`
+	SessionID string `xml:"SessionID,omitempty"`
+	MsgID     string `xml:"MsgID,omitempty"`
+}
+
+// FUSBody holds the request parameters and the response results.
+type FUSBody struct {
+	Put     *Put     `xml:"Put,omitempty"`
+	Get     *Get     `xml:"Get,omitempty"`
+	Results *Results `xml:"Results,omitempty"`
+}
+
+// Put carries the known request and response parameters, in the order
+// they are sent. Unknown parameters are kept in Other.
+type Put struct {
+	// BinaryInit
+	BinaryFileName *Field `xml:"BINARY_FILE_NAME,omitempty"`
+
+	// BinaryInform request
+	AccessMode                *Field `xml:"ACCESS_MODE,omitempty"`
+	BinaryNature              *Field `xml:"BINARY_NATURE,omitempty"`
+	ClientProduct             *Field `xml:"CLIENT_PRODUCT,omitempty"`
+	ClientVersion             *Field `xml:"CLIENT_VERSION,omitempty"`
+	DeviceImeiPush            *Field `xml:"DEVICE_IMEI_PUSH,omitempty"`
+	DeviceFwVersion           *Field `xml:"DEVICE_FW_VERSION,omitempty"`
+	DeviceLocalCode           *Field `xml:"DEVICE_LOCAL_CODE,omitempty"`
+	DeviceAidCode             *Field `xml:"DEVICE_AID_CODE,omitempty"`
+	DeviceModelName           *Field `xml:"DEVICE_MODEL_NAME,omitempty"`
+	LogicCheck                *Field `xml:"LOGIC_CHECK,omitempty"`
+	DeviceContentsDataVersion *Field `xml:"DEVICE_CONTENTS_DATA_VERSION,omitempty"`
+	DeviceCscCode2Version     *Field `xml:"DEVICE_CSC_CODE2_VERSION,omitempty"`
+	DevicePdaCode1Version     *Field `xml:"DEVICE_PDA_CODE1_VERSION,omitempty"`
+	DevicePhoneFontVersion    *Field `xml:"DEVICE_PHONE_FONT_VERSION,omitempty"`
+	ClientLanguage            *Field `xml:"CLIENT_LANGUAGE,omitempty"`
+	DeviceCcCode              *Field `xml:"DEVICE_CC_CODE,omitempty"`
+	MccNum                    *Field `xml:"MCC_NUM,omitempty"`
+	MncNum                    *Field `xml:"MNC_NUM,omitempty"`
+
+	// BinaryInform response
+	BinaryByteSize      *Field `xml:"BINARY_BYTE_SIZE,omitempty"`
+	BinaryName          *Field `xml:"BINARY_NAME,omitempty"`
+	BinaryCRC           *Field `xml:"BINARY_CRC,omitempty"`
+	BinaryOsVersion     *Field `xml:"BINARY_OS_VERSION,omitempty"`
+	ModelPath           *Field `xml:"MODEL_PATH,omitempty"`
+	LogicValueFactory   *Field `xml:"LOGIC_VALUE_FACTORY,omitempty"`
+	LogicValueHome      *Field `xml:"LOGIC_VALUE_HOME,omitempty"`
+	DeviceUserDataFile  *Field `xml:"DEVICE_USER_DATA_FILE,omitempty"`
+	DeviceBootFile      *Field `xml:"DEVICE_BOOT_FILE,omitempty"`
+	DevicePdaCode1File  *Field `xml:"DEVICE_PDA_CODE1_FILE,omitempty"`
+	DeviceCscHomeFile   *Field `xml:"DEVICE_CSC_HOME_FILE,omitempty"`
+	DeviceCscFile       *Field `xml:"DEVICE_CSC_FILE,omitempty"`
+	DevicePhoneFontFile *Field `xml:"DEVICE_PHONE_FONT_FILE,omitempty"`
+
+	Other []Field `xml:",any"`
+}
+
+// Get lists the values requested from the server.
+type Get struct {
+	CmdID           string `xml:"CmdID,omitempty"`
+	LatestFwVersion *Empty `xml:"LATEST_FW_VERSION,omitempty"`
+}
+
+// Results holds the response status and returned values.
+type Results struct {
+	Status          string  `xml:"Status"`
+	LatestFwVersion *Field  `xml:"LATEST_FW_VERSION,omitempty"`
+	Other           []Field `xml:",any"`
+}
+
+// Field is a parameter such as <NAME><Data>value</Data></NAME>.
+type Field struct {
+	XMLName xml.Name
+	Type    []string `xml:"Type,omitempty"`
+	Data    string   `xml:"Data"`
+}
+
+// Empty is an element without content, e.g. <LATEST_FW_VERSION/>.
+type Empty struct{}
+
+// NewField returns a field with the given value.
+func NewField(data string) *Field {
+	return &Field{Data: strings.TrimSpace(data)}
+}
+
+// Value returns the trimmed data of the field, or "" for a missing field.
+func (f *Field) Value() string {
+	if f == nil {
+		return ""
+	}
+	return strings.TrimSpace(f.Data)
+}
+
+// Int64 parses the field as a decimal integer.
+func (f *Field) Int64() (int64, bool) {
+	v, err := strconv.ParseInt(f.Value(), 10, 64)
+	return v, err == nil
+}
+
+// Uint32 parses the field as a decimal unsigned 32-bit integer.
+func (f *Field) Uint32() (uint32, bool) {
+	v, err := strconv.ParseUint(f.Value(), 10, 32)
+	return uint32(v), err == nil
+}
+
+// Parse decodes a FUS message. Element names are matched regardless of
+// case and the root element may have any name, as the server is not
+// consistent about either.
+func Parse(data []byte) (*FUSMsg, error) {
+	var msg FUSMsg
+	d := xml.NewTokenDecoder(&canonicalNames{d: xml.NewDecoder(bytes.NewReader(data))})
+	if err := d.Decode(&msg); err != nil {
+		return nil, err
+	}
+	msg.Raw = string(data)
+	return &msg, nil
+}
+
+// knownNames maps the lower-case names of the elements of FUSMsg to their
+// spelling in the struct tags.
+var knownNames = make(map[string]string)
+
+func init() {
+	addNames(reflect.TypeOf(FUSMsg{}), make(map[reflect.Type]bool))
+}
+
+// addNames adds the element names of the struct tags of t and the types
+// of its fields to knownNames.
+func addNames(t reflect.Type, seen map[reflect.Type]bool) {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || seen[t] {
+		return
+	}
+	seen[t] = true
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("xml"), ",")
+		if name != "" && name != "-" {
+			knownNames[strings.ToLower(name)] = name
+		}
+		addNames(field.Type, seen)
+	}
+}
+
+// canonicalNames is an xml.TokenReader that renames the root element to
+// FUSMsg and every other known element to its spelling in the struct tags.
+type canonicalNames struct {
+	d     *xml.Decoder
+	depth int
+}
+
+func (c *canonicalNames) Token() (xml.Token, error) {
+	tok, err := c.d.Token()
+	switch t := tok.(type) {
+	case xml.StartElement:
+		t.Name.Local = c.rename(t.Name.Local)
+		c.depth++
+		return t, err
+	case xml.EndElement:
+		c.depth--
+		t.Name.Local = c.rename(t.Name.Local)
+		return t, err
+	}
+	return tok, err
+}
+
+// rename returns the canonical name of an element at the current depth.
+func (c *canonicalNames) rename(name string) string {
+	if c.depth == 0 {
+		return "FUSMsg"
+	}
+	if known, ok := knownNames[strings.ToLower(name)]; ok {
+		return known
+	}
+	return name
+}
+
+// Marshal encodes the message. Values are escaped by encoding/xml.
+func (m *FUSMsg) Marshal() (string, error) {
+	data, err := xml.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// String returns the encoded message, or "" if it cannot be encoded.
+func (m *FUSMsg) String() string {
+	s, _ := m.Marshal()
+	return s
+}
+
+// Status returns the result status, e.g. "200", "401", "408" or "F01".
+func (m *FUSMsg) Status() string {
+	if m == nil || m.Body.Results == nil {
+		return ""
+	}
+	return strings.TrimSpace(m.Body.Results.Status)
+}
+
+// Put returns the Put section, or an empty one if the message has none,
+// so that fields can be read without nil checks.
+func (m *FUSMsg) Put() *Put {
+	if m == nil || m.Body.Put == nil {
+		return &Put{}
+	}
+	return m.Body.Put
+}
+
+// LatestFwVersion returns the LATEST_FW_VERSION result.
+func (m *FUSMsg) LatestFwVersion() string {
+	if m == nil || m.Body.Results == nil {
+		return ""
+	}
+	return m.Body.Results.LatestFwVersion.Value()
+}
+
+// BinarySize returns BINARY_BYTE_SIZE.
+func (p *Put) BinarySize() (int64, bool) {
+	return p.BinaryByteSize.Int64()
+}
+
+// BinaryCRC32 returns BINARY_CRC.
+func (p *Put) BinaryCRC32() (uint32, bool) {
+	return p.BinaryCRC.Uint32()
+}
@@ -0,0 +1,95 @@
+package fusmsg_test
+
+import (
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"samsung-firmware-tool/internal/fusmsg"
+)
+
+// tagName matches the name in a start or end tag.
+var tagName = regexp.MustCompile(`</?[A-Za-z_0-9]+`)
+
+// TestParseBinaryInform parses a BinaryInform response as the FUS server
+// sends it, and with the element names in another case, which the lookup
+// this package replaced accepted.
+func TestParseBinaryInform(t *testing.T) {
+	data, err := os.ReadFile("testdata/binaryinform.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	variants := map[string]string{
+		"as sent":    string(data),
+		"lower case": tagName.ReplaceAllStringFunc(string(data), strings.ToLower),
+		"upper case": tagName.ReplaceAllStringFunc(string(data), strings.ToUpper),
+	}
+	for name, doc := range variants {
+		t.Run(name, func(t *testing.T) {
+			msg, err := fusmsg.Parse([]byte(doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := msg.Status(); got != "200" {
+				t.Errorf("Status = %q, want 200", got)
+			}
+			if got := msg.LatestFwVersion(); got != "S9110ZCU1AWA1/S9110CHC1AWA1/S9110ZCU1AWA1/S9110ZCU1AWA1" {
+				t.Errorf("LatestFwVersion = %q", got)
+			}
+			put := msg.Put()
+			if size, ok := put.BinarySize(); !ok || size != 7432593440 {
+				t.Errorf("BinarySize = %d, %v", size, ok)
+			}
+			if crc, ok := put.BinaryCRC32(); !ok || crc != 3178497853 {
+				t.Errorf("BinaryCRC32 = %d, %v", crc, ok)
+			}
+			fields := map[string]*fusmsg.Field{
+				"BINARY_NAME":            put.BinaryName,
+				"MODEL_PATH":             put.ModelPath,
+				"LOGIC_VALUE_FACTORY":    put.LogicValueFactory,
+				"DEVICE_CSC_HOME_FILE":   put.DeviceCscHomeFile,
+				"DEVICE_PHONE_FONT_FILE": put.DevicePhoneFontFile,
+				"DEVICE_PDA_CODE1_FILE":  put.DevicePdaCode1File,
+			}
+			want := map[string]string{
+				"BINARY_NAME":            "SM-S9110_CHC_S9110ZCU1AWA1_fac.zip.enc4",
+				"MODEL_PATH":             "/neofus/9/",
+				"LOGIC_VALUE_FACTORY":    "yjrpohbt0bokb3qq",
+				"DEVICE_CSC_HOME_FILE":   "HOME_CSC_CHC_S9110CHC1AWA1_CL27012931_QB61546387_REV00_user_low_ship_MULTI_CERT.tar.md5",
+				"DEVICE_PHONE_FONT_FILE": "CP_S9110ZCU1AWA1_CP23802150_CL27012931_QB61546387_REV00_user_low_ship_MULTI_CERT.tar.md5",
+				"DEVICE_PDA_CODE1_FILE":  "AP_S9110ZCU1AWA1_CL27012931_QB61546387_REV00_user_low_ship_MULTI_CERT_meta_OS13.tar.md5",
+			}
+			for field, value := range want {
+				if got := fields[field].Value(); got != value {
+					t.Errorf("%s = %q, want %q", field, got, value)
+				}
+			}
+			// Parameters without a field of their own are kept.
+			if len(put.Other) != 3 {
+				t.Errorf("Other has %d fields, want 3", len(put.Other))
+			}
+		})
+	}
+}
+
+// TestParseStatus checks the status of an error response and that the
+// root element is accepted under any name.
+func TestParseStatus(t *testing.T) {
+	data, err := os.ReadFile("testdata/status_f01.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, doc := range []string{string(data), strings.ReplaceAll(string(data), "FUSMsg>", "FUSResponse>")} {
+		msg, err := fusmsg.Parse([]byte(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := msg.Status(); got != "F01" {
+			t.Errorf("Status = %q, want F01", got)
+		}
+		if msg.Body.Put != nil || msg.LatestFwVersion() != "" {
+			t.Errorf("error response parsed with values: %+v", msg.Body)
+		}
+	}
+}
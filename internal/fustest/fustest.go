@@ -0,0 +1,460 @@
+// Package fustest implements a local Samsung FUS and FOTA server, so that
+// the check, download and decrypt flow can run without internet access.
+package fustest
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/big"
+	mathrand "math/rand"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"samsung-firmware-tool/internal/cryptutils"
+	"samsung-firmware-tool/internal/fusclient"
+	"samsung-firmware-tool/internal/fusmsg"
+	"samsung-firmware-tool/internal/request"
+)
+
+// ModelPath is the MODEL_PATH returned for every firmware.
+const ModelPath = "/neofus/9/"
+
+// Firmware describes a firmware served by the fake server.
+type Firmware struct {
+	Model          string
+	Region         string
+	Version        string // PDA/CSC/CP/DATA, e.g. S9110ZCU1AWA1/S9110CHC1AWA1/S9110ZCU1AWA1/S9110ZCU1AWA1
+	AndroidVersion string // Reported by version.xml; empty uses "14"
+
+	// Status is the BinaryInform result, e.g. "200", "408" or "F01".
+	// Empty answers "200" for the matching version and "F01" otherwise.
+	Status string
+
+	// Data is the decrypted firmware. Nil generates a zip with AP, BL, CP
+	// and CSC members.
+	Data []byte
+
+	// V2 encrypts the file with the .enc2 key instead of the .enc4 key
+	// and leaves out LOGIC_VALUE_FACTORY.
+	V2 bool
+
+	// LogicValue is LOGIC_VALUE_FACTORY, from which the .enc4 key is
+	// derived. Empty uses a fixed value.
+	LogicValue string
+}
+
+// binary is a prepared firmware with its encrypted file.
+type binary struct {
+	Firmware
+	fileName  string
+	encrypted []byte
+	crc       uint32
+	md5       string
+	modTime   time.Time
+}
+
+// Handler implements the FUS, download and FOTA endpoints.
+type Handler struct {
+	mu       sync.Mutex
+	binaries map[string]*binary // by model/region
+	nonces   map[string]string  // issued nonce by auth signature
+	inited   map[string]bool    // files that passed BinaryInit, by path
+	requests []string           // method and path of every request
+}
+
+// NewHandler creates a handler serving the given firmware.
+func NewHandler(firmware ...Firmware) (*Handler, error) {
+	h := &Handler{
+		binaries: make(map[string]*binary),
+		nonces:   make(map[string]string),
+		inited:   make(map[string]bool),
+	}
+	for _, fw := range firmware {
+		if err := h.Add(fw); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// Add serves fw, replacing any firmware for the same model and region.
+func (h *Handler) Add(fw Firmware) error {
+	parts := strings.Split(fw.Version, "/")
+	if fw.Model == "" || fw.Region == "" || len(parts) != 4 || len(fw.Version) < 16 {
+		return fmt.Errorf("fustest: firmware needs a model, a region and a PDA/CSC/CP/DATA version")
+	}
+	if fw.AndroidVersion == "" {
+		fw.AndroidVersion = "14"
+	}
+	if fw.LogicValue == "" {
+		fw.LogicValue = "abcdefghijklmnop"
+	}
+	if fw.Data == nil {
+		data, err := SampleZip(fw.Version)
+		if err != nil {
+			return err
+		}
+		fw.Data = data
+	}
+
+	var key []byte
+	ext := ".zip.enc4"
+	if fw.V2 {
+		key, _ = cryptutils.GetV2Key(fw.Version, fw.Model, fw.Region)
+		ext = ".zip.enc2"
+	} else {
+		key = md5Sum(request.GetLogicCheck(fw.Version, fw.LogicValue))
+	}
+	encrypted, err := cryptutils.EncryptFirmware(fw.Data, key)
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(encrypted)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.binaries[fw.Model+"/"+fw.Region] = &binary{
+		Firmware:  fw,
+		fileName:  fmt.Sprintf("%s_%s_%s_fac%s", fw.Model, fw.Region, parts[0], ext),
+		encrypted: encrypted,
+		crc:       crc32.ChecksumIEEE(encrypted),
+		md5:       hex.EncodeToString(sum[:]),
+		modTime:   time.Now(),
+	}
+	return nil
+}
+
+// ExpireNonces forgets every issued nonce, so that the next request is
+// answered with 401 until the client generates a new one.
+func (h *Handler) ExpireNonces() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.nonces = make(map[string]string)
+}
+
+// Requests returns the method and path of every request received so far,
+// e.g. "POST /NF_DownloadBinaryInform.do".
+func (h *Handler) Requests() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.requests...)
+}
+
+// V4Key returns the .enc4 key of the firmware for model and region.
+func (h *Handler) V4Key(model, region string) []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b := h.binaries[model+"/"+region]
+	if b == nil || b.V2 {
+		return nil
+	}
+	return md5Sum(request.GetLogicCheck(b.Version, b.LogicValue))
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.requests = append(h.requests, r.Method+" "+r.URL.Path)
+	h.mu.Unlock()
+
+	switch path := r.URL.Path; {
+	case path == "/"+string(fusclient.GenerateNonce):
+		h.generateNonce(w, r)
+	case path == "/"+string(fusclient.BinaryInform):
+		h.binaryInform(w, r)
+	case path == "/"+string(fusclient.BinaryInit):
+		h.binaryInit(w, r)
+	case path == "/NF_DownloadBinaryForMass.do":
+		h.download(w, r)
+	case fotaPath.MatchString(path):
+		m := fotaPath.FindStringSubmatch(path)
+		h.versionXML(w, m[1], m[2])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+var (
+	fotaPath      = regexp.MustCompile(`^/firmware/([^/]+)/([^/]+)/version\.xml$`)
+	signatureAttr = regexp.MustCompile(`signature="([^"]*)"`)
+)
+
+const nonceChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// generateNonce issues a new encrypted nonce and session cookie.
+func (h *Handler) generateNonce(w http.ResponseWriter, r *http.Request) {
+	nonce := make([]byte, 16)
+	for i := range nonce {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(nonceChars))))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		nonce[i] = nonceChars[n.Int64()]
+	}
+	encNonce, err := cryptutils.EncryptNonce(string(nonce))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	auth, err := cryptutils.GetAuth(string(nonce))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.mu.Lock()
+	h.nonces[auth] = string(nonce)
+	h.mu.Unlock()
+
+	w.Header().Set("NONCE", encNonce)
+	http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: hex.EncodeToString(md5Sum(auth)), Path: "/"})
+	w.WriteHeader(http.StatusOK)
+}
+
+// authorize returns the nonce the request's Authorization signature was
+// computed from, or writes a 401 and returns false.
+func (h *Handler) authorize(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var signature string
+	if m := signatureAttr.FindStringSubmatch(r.Header.Get("Authorization")); m != nil {
+		signature = m[1]
+	}
+
+	h.mu.Lock()
+	nonce, ok := h.nonces[signature]
+	h.mu.Unlock()
+	if !ok {
+		writeStatus(w, http.StatusUnauthorized, "401", nil)
+		return "", false
+	}
+	return nonce, true
+}
+
+// binaryInform answers with the metadata of the requested firmware.
+func (h *Handler) binaryInform(w http.ResponseWriter, r *http.Request) {
+	nonce, ok := h.authorize(w, r)
+	if !ok {
+		return
+	}
+	msg, ok := readMsg(w, r)
+	if !ok {
+		return
+	}
+	put := msg.Put()
+	fw := put.DeviceFwVersion.Value()
+	if put.LogicCheck.Value() != request.GetLogicCheck(fw, nonce) {
+		writeStatus(w, http.StatusBadRequest, "400", nil)
+		return
+	}
+
+	h.mu.Lock()
+	b := h.binaries[put.DeviceModelName.Value()+"/"+put.DeviceLocalCode.Value()]
+	h.mu.Unlock()
+	if b == nil {
+		writeStatus(w, http.StatusOK, "F01", nil)
+		return
+	}
+
+	status := b.Status
+	if status == "" {
+		status = "200"
+		if fw != b.Version {
+			status = "F01"
+		}
+	}
+	if status != "200" {
+		writeStatus(w, http.StatusOK, status, nil)
+		return
+	}
+
+	// GetBinaryFile reads the PDA version from the data file and the
+	// DATA version from the PDA file.
+	parts := strings.Split(b.Version, "/")
+	resp := &fusmsg.Put{
+		BinaryByteSize:      fusmsg.NewField(fmt.Sprint(len(b.encrypted))),
+		BinaryName:          fusmsg.NewField(b.fileName),
+		BinaryCRC:           fusmsg.NewField(fmt.Sprint(b.crc)),
+		BinaryOsVersion:     fusmsg.NewField(b.AndroidVersion),
+		ModelPath:           fusmsg.NewField(ModelPath),
+		DeviceUserDataFile:  fusmsg.NewField(fmt.Sprintf("USERDATA_%s_CL1_user_low_ship.tar.md5", parts[0])),
+		DevicePdaCode1File:  fusmsg.NewField(fmt.Sprintf("AP_%s_CL1_user_low_ship_MULTI_CERT.tar.md5", parts[3])),
+		DeviceCscHomeFile:   fusmsg.NewField(fmt.Sprintf("HOME_CSC_OXM_%s_MULTI_CERT.tar.md5", parts[1])),
+		DevicePhoneFontFile: fusmsg.NewField(fmt.Sprintf("CP_%s_CP1_MULTI_CERT.tar.md5", parts[2])),
+	}
+	if !b.V2 {
+		resp.LogicValueFactory = fusmsg.NewField(b.LogicValue)
+	}
+	writeStatus(w, http.StatusOK, "200", resp, b.Version)
+}
+
+// binaryInit allows the download of the requested file.
+func (h *Handler) binaryInit(w http.ResponseWriter, r *http.Request) {
+	nonce, ok := h.authorize(w, r)
+	if !ok {
+		return
+	}
+	msg, ok := readMsg(w, r)
+	if !ok {
+		return
+	}
+	fileName := msg.Put().BinaryFileName.Value()
+	special := fileName
+	if base := strings.Split(fileName, ".")[0]; len(base) >= 16 {
+		special = base[len(base)-16:]
+	}
+	if msg.Put().LogicCheck.Value() != request.GetLogicCheck(special, nonce) {
+		writeStatus(w, http.StatusBadRequest, "400", nil)
+		return
+	}
+
+	h.mu.Lock()
+	h.inited[ModelPath+fileName] = true
+	h.mu.Unlock()
+	writeStatus(w, http.StatusOK, "200", nil)
+}
+
+// download serves an initialized file, honouring Range requests.
+func (h *Handler) download(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.authorize(w, r); !ok {
+		return
+	}
+	file := r.URL.Query().Get("file")
+
+	h.mu.Lock()
+	var found *binary
+	if h.inited[file] {
+		for _, b := range h.binaries {
+			if ModelPath+b.fileName == file {
+				found = b
+			}
+		}
+	}
+	h.mu.Unlock()
+	if found == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-MD5", found.md5)
+	http.ServeContent(w, r, found.fileName, found.modTime, bytes.NewReader(found.encrypted))
+}
+
+// versionXML serves the FOTA version.xml of a model and region.
+func (h *Handler) versionXML(w http.ResponseWriter, region, model string) {
+	h.mu.Lock()
+	b := h.binaries[model+"/"+region]
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/xml")
+	if b == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+		return
+	}
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><versioninfo><url>https://fota-cloud-dn.ospserver.net/firmware/</url><firmware><model>%s</model><cc>%s</cc><version><latest o="%s">%s</latest><upgrade></upgrade></version></firmware></versioninfo>`,
+		model, region, b.AndroidVersion, b.Version)
+}
+
+// readMsg parses the request body, or writes a 400 and returns false.
+func readMsg(w http.ResponseWriter, r *http.Request) (*fusmsg.FUSMsg, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	msg, err := fusmsg.Parse(body)
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, "400", nil)
+		return nil, false
+	}
+	return msg, true
+}
+
+// writeStatus writes a FUS response with the given result status.
+func writeStatus(w http.ResponseWriter, code int, status string, put *fusmsg.Put, latest ...string) {
+	results := &fusmsg.Results{Status: status}
+	if len(latest) > 0 {
+		results.LatestFwVersion = fusmsg.NewField(latest[0])
+	}
+	msg := &fusmsg.FUSMsg{
+		Hdr:  &fusmsg.FUSHdr{ProtoVer: "1.0"},
+		Body: fusmsg.FUSBody{Put: put, Results: results},
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(code)
+	io.WriteString(w, msg.String())
+}
+
+// SampleZip builds a small firmware zip with AP, BL, CP and CSC members
+// filled with deterministic pseudo-random data.
+func SampleZip(version string) ([]byte, error) {
+	parts := strings.Split(version, "/")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("fustest: invalid version %q", version)
+	}
+	members := []string{
+		"AP_" + parts[0] + "_CL1_user_low_ship_MULTI_CERT_meta_OS14.tar.md5",
+		"BL_" + parts[0] + "_CL1_user_low_ship_MULTI_CERT.tar.md5",
+		"CP_" + parts[2] + "_CP1_user_low_ship_MULTI_CERT.tar.md5",
+		"CSC_OXM_" + parts[1] + "_MULTI_CERT.tar.md5",
+		"HOME_CSC_OXM_" + parts[1] + "_MULTI_CERT.tar.md5",
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	rnd := mathrand.New(mathrand.NewSource(int64(crc32.ChecksumIEEE([]byte(version)))))
+	for i, name := range members {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)})
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, 64<<10*(i+1))
+		rnd.Read(data)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func md5Sum(s string) []byte {
+	sum := md5.Sum([]byte(s))
+	return sum[:]
+}
+
+// Server is a Handler listening on a local port.
+type Server struct {
+	*Handler
+	*httptest.Server
+}
+
+// NewServer starts a server for the given firmware. Close it when done.
+func NewServer(firmware ...Firmware) (*Server, error) {
+	h, err := NewHandler(firmware...)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{Handler: h, Server: httptest.NewServer(h)}, nil
+}
+
+// Options returns FusClient options pointing every endpoint at the server.
+func (s *Server) Options() fusclient.Options {
+	return fusclient.Options{
+		FusURL:      s.URL,
+		DownloadURL: s.URL,
+		FotaURL:     s.URL,
+		HTTPClient:  s.Client(),
+	}
+}
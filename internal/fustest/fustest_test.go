@@ -0,0 +1,103 @@
+package fustest_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"samsung-firmware-tool/internal/cryptutils"
+	"samsung-firmware-tool/internal/fusclient"
+	"samsung-firmware-tool/internal/fustest"
+	"samsung-firmware-tool/internal/request"
+	"samsung-firmware-tool/internal/versionfetch"
+)
+
+const testVersion = "S9110ZCU1AWA1/S9110CHC1AWA1/S9110ZCU1AWA1/S9110ZCU1AWA1"
+
+// TestCheckDownloadDecrypt runs the whole flow against the fake server:
+// the FOTA version check, BinaryInform, BinaryInit, the download and the
+// decryption with the key the flow derives, for an .enc4 and an .enc2
+// firmware.
+func TestCheckDownloadDecrypt(t *testing.T) {
+	for _, v2 := range []bool{false, true} {
+		name := "enc4"
+		if v2 {
+			name = "enc2"
+		}
+		t.Run(name, func(t *testing.T) {
+			fw := fustest.Firmware{Model: "SM-S9110", Region: "CHC", Version: testVersion, V2: v2}
+			srv, err := fustest.NewServer(fw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer srv.Close()
+			ctx := context.Background()
+
+			latest := versionfetch.GetLatestVersionWithOptions(ctx, srv.Options(), fw.Model, fw.Region)
+			if latest.Error != nil {
+				t.Fatal(latest.Error)
+			}
+			if latest.VersionCode != fw.Version {
+				t.Fatalf("latest version = %q, want %q", latest.VersionCode, fw.Version)
+			}
+
+			client := fusclient.NewFusClientWithOptions(srv.Options())
+			info, err := request.RetrieveBinaryFileInfo(ctx, latest.VersionCode, fw.Model, fw.Region, "123456789012345", client, func(string) {}, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cryptutils.EncVersion(info.FileName); (got == cryptutils.EncV2) != v2 {
+				t.Fatalf("file name %s has the wrong extension", info.FileName)
+			}
+			_, err = client.MakeReqFunc(ctx, fusclient.BinaryInit, func(nonce string) string {
+				return request.CreateBinaryInit(info.FileName, nonce)
+			}, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			encPath := filepath.Join(t.TempDir(), info.FileName)
+			out, err := os.Create(encPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer out.Close()
+			segments := fusclient.SplitSegments(0, info.Size, 2)
+			if _, err := client.DownloadSegments(ctx, info.Path+info.FileName, segments, info.Size, out, nil); err != nil {
+				t.Fatal(err)
+			}
+			if ok, err := cryptutils.CheckCrc32(openFile(t, encPath), info.Size, info.CRC32, nil); err != nil || !ok {
+				t.Fatalf("CheckCrc32 = %v, %v", ok, err)
+			}
+
+			key := info.V4Key
+			if v2 {
+				key, _ = cryptutils.GetV2Key(fw.Version, fw.Model, fw.Region)
+			}
+			var plain bytes.Buffer
+			if err := cryptutils.DecryptProgress(ctx, openFile(t, encPath), &plain, key, info.Size, 0, nil); err != nil {
+				t.Fatal(err)
+			}
+			want, err := fustest.SampleZip(fw.Version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(plain.Bytes(), want) {
+				t.Errorf("decrypted firmware differs from the served zip (%d bytes, want %d)", plain.Len(), len(want))
+			}
+		})
+	}
+}
+
+// openFile opens path for reading until the test ends.
+func openFile(t *testing.T, path string) *os.File {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
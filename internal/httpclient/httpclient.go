@@ -0,0 +1,212 @@
+package httpclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config describes how outgoing HTTP connections are made.
+// Zero durations disable the corresponding timeout.
+type Config struct {
+	// Proxy is an http://, https:// or socks5:// URL. Empty uses the
+	// HTTP_PROXY/HTTPS_PROXY/NO_PROXY environment, "direct" disables proxying.
+	Proxy string
+	// CAFiles are PEM bundles trusted in addition to the system roots.
+	CAFiles []string
+	// LocalAddr binds outgoing connections to a local IP, IP:port or interface name.
+	LocalAddr string
+
+	ConnectTimeout        time.Duration // TCP connect
+	TLSHandshakeTimeout   time.Duration // TLS handshake
+	ResponseHeaderTimeout time.Duration // Waiting for response headers after the request is sent
+	ReadTimeout           time.Duration // Maximum idle time between two reads of a connection
+	IdleConnTimeout       time.Duration // How long an idle keep-alive connection is kept
+}
+
+// DefaultConfig returns timeouts that fail hung connections instead of
+// blocking forever, while leaving the total transfer time unbounded.
+func DefaultConfig() Config {
+	return Config{
+		ConnectTimeout:        30 * time.Second,
+		TLSHandshakeTimeout:   15 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+		ReadTimeout:           60 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+	}
+}
+
+var (
+	defaultOnce   sync.Once
+	defaultClient *http.Client
+)
+
+// Default returns a shared client built from DefaultConfig.
+func Default() *http.Client {
+	defaultOnce.Do(func() {
+		client, err := New(DefaultConfig())
+		if err != nil {
+			// DefaultConfig has no proxy, CA or bind address, so this cannot happen.
+			panic(err)
+		}
+		defaultClient = client
+	})
+	return defaultClient
+}
+
+// New creates an http.Client for the given configuration.
+// The client has no overall Timeout, since firmware downloads take hours.
+func New(cfg Config) (*http.Client, error) {
+	transport, err := NewTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// NewTransport creates an http.Transport for the given configuration.
+func NewTransport(cfg Config) (*http.Transport, error) {
+	dialer := &net.Dialer{
+		Timeout:   cfg.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	if cfg.LocalAddr != "" {
+		addr, err := resolveLocalAddr(cfg.LocalAddr)
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = addr
+	}
+
+	proxy, err := proxyFunc(cfg.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{}
+	if len(cfg.CAFiles) > 0 {
+		pool, err := loadCertPool(cfg.CAFiles)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	readTimeout := cfg.ReadTimeout
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil || readTimeout <= 0 {
+				return conn, err
+			}
+			return &deadlineConn{Conn: conn, timeout: readTimeout}, nil
+		},
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		MaxIdleConnsPerHost:   8,
+		ForceAttemptHTTP2:     true,
+	}, nil
+}
+
+// proxyFunc returns the proxy selector for http.Transport.
+// net/http understands http, https and socks5 proxy URLs natively.
+func proxyFunc(proxy string) (func(*http.Request) (*url.URL, error), error) {
+	switch strings.ToLower(strings.TrimSpace(proxy)) {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case "direct", "none":
+		return nil, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL %q: %w", proxy, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (want http, https or socks5)", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q: missing host", proxy)
+	}
+	return http.ProxyURL(u), nil
+}
+
+// loadCertPool returns the system roots plus the certificates in files.
+func loadCertPool(files []string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	for _, file := range files {
+		pem, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", file)
+		}
+	}
+	return pool, nil
+}
+
+// resolveLocalAddr parses an IP, IP:port or network interface name.
+func resolveLocalAddr(addr string) (*net.TCPAddr, error) {
+	if ip := net.ParseIP(addr); ip != nil {
+		return &net.TCPAddr{IP: ip}, nil
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			tcpAddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ip.String(), port))
+			if err != nil {
+				return nil, fmt.Errorf("invalid bind address %q: %w", addr, err)
+			}
+			return tcpAddr, nil
+		}
+	}
+
+	iface, err := net.InterfaceByName(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bind address %q: not an IP or interface name", addr)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("error reading addresses of interface %s: %w", addr, err)
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return &net.TCPAddr{IP: ipNet.IP}, nil
+		}
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok {
+			return &net.TCPAddr{IP: ipNet.IP}, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s has no IP address", addr)
+}
+
+// deadlineConn refreshes the read deadline before every Read, so a
+// connection that stops delivering data fails after the timeout.
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,200 @@
+// Package progress turns byte counts into throttled progress reports with
+// a smoothed speed and an estimated time left.
+package progress
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Phase names the step of an operation that a report belongs to.
+type Phase string
+
+const (
+	PhaseInit     Phase = "init"
+	PhaseDownload Phase = "download"
+	PhaseVerify   Phase = "verify"
+	PhaseDecrypt  Phase = "decrypt"
+	PhaseExtract  Phase = "extract"
+)
+
+const (
+	// sampleInterval is the shortest time over which the speed is measured.
+	sampleInterval = 250 * time.Millisecond
+
+	// smoothing is the time constant of the moving average of the speed.
+	// A change in speed is mostly reflected after this long.
+	smoothing = 3 * time.Second
+)
+
+// defaultInterval holds the interval used by reporters created with an
+// interval of 0, in nanoseconds.
+var defaultInterval atomic.Int64
+
+func init() {
+	defaultInterval.Store(int64(200 * time.Millisecond))
+}
+
+// DefaultInterval returns the time between two reports of a Reporter
+// created with an interval of 0.
+func DefaultInterval() time.Duration {
+	return time.Duration(defaultInterval.Load())
+}
+
+// SetDefaultInterval changes the time between two reports for reporters
+// created afterwards with an interval of 0.
+func SetDefaultInterval(d time.Duration) {
+	defaultInterval.Store(int64(d))
+}
+
+// Update is a progress report.
+type Update struct {
+	Phase          Phase
+	Current        int64         // Bytes done, including those of an earlier run
+	Total          int64         // Bytes in total, 0 if unknown
+	BytesPerSecond int64         // Moving average of the speed of this run
+	ETA            time.Duration // Estimated time left, 0 if unknown
+}
+
+// Percent returns Current as a percentage of Total.
+func (u Update) Percent() float64 {
+	if u.Total <= 0 {
+		return 0
+	}
+	return float64(u.Current) / float64(u.Total) * 100
+}
+
+// Reporter tracks the progress of an operation and passes it to a
+// callback at most once per interval, plus once at the start of every
+// phase and once when Current reaches Total. It is safe for concurrent use;
+// callbacks are never called concurrently and never go backwards.
+type Reporter struct {
+	interval time.Duration
+	callback func(Update)
+	callMu   sync.Mutex // Serializes callbacks
+
+	mu          sync.Mutex
+	phase       Phase
+	current     int64
+	total       int64
+	speed       float64 // Bytes per second
+	sampled     bool
+	sampleTime  time.Time
+	sampleBytes int64
+	lastReport  time.Time
+	pending     bool // Changes have not been reported
+}
+
+// NewReporter returns a Reporter that calls callback at most once per
+// interval. An interval of 0 uses DefaultInterval; a negative interval
+// reports every change.
+func NewReporter(interval time.Duration, callback func(Update)) *Reporter {
+	if interval == 0 {
+		interval = DefaultInterval()
+	}
+	return &Reporter{interval: interval, callback: callback}
+}
+
+// Start begins a phase at current of total bytes and reports it. The speed
+// is measured from here, so bytes done by an earlier run do not count.
+func (r *Reporter) Start(phase Phase, current, total int64) {
+	r.mu.Lock()
+	r.phase = phase
+	r.current = current
+	r.total = total
+	r.speed = 0
+	r.sampled = false
+	r.sampleTime = time.Now()
+	r.sampleBytes = current
+	r.lastReport = r.sampleTime
+	r.pending = false
+	r.mu.Unlock()
+	r.report()
+}
+
+// Add records n more bytes and reports them if the interval has passed.
+func (r *Reporter) Add(n int64) {
+	r.advance(func(current int64) int64 { return current + n })
+}
+
+// Set records that current bytes are done and reports it if the interval
+// has passed.
+func (r *Reporter) Set(current int64) {
+	r.advance(func(int64) int64 { return current })
+}
+
+// advance moves the byte count to next(current), updates the speed and
+// reports if due. Calls that do not change the count are ignored.
+func (r *Reporter) advance(next func(current int64) int64) {
+	now := time.Now()
+	r.mu.Lock()
+	current := next(r.current)
+	if current == r.current {
+		r.mu.Unlock()
+		return
+	}
+	r.current = current
+	if elapsed := now.Sub(r.sampleTime); elapsed >= sampleInterval {
+		speed := float64(current-r.sampleBytes) / elapsed.Seconds()
+		if r.sampled {
+			alpha := 1 - math.Exp(-elapsed.Seconds()/smoothing.Seconds())
+			r.speed += alpha * (speed - r.speed)
+		} else {
+			r.speed = speed
+			r.sampled = true
+		}
+		r.sampleTime = now
+		r.sampleBytes = current
+	}
+	due := r.interval < 0 || now.Sub(r.lastReport) >= r.interval || (r.total > 0 && current >= r.total)
+	if due {
+		r.lastReport = now
+	}
+	r.pending = !due
+	r.mu.Unlock()
+
+	if due {
+		r.report()
+	}
+}
+
+// Flush reports changes that the interval has held back.
+func (r *Reporter) Flush() {
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = false
+	r.lastReport = time.Now()
+	r.mu.Unlock()
+	if pending {
+		r.report()
+	}
+}
+
+// Update returns the current state.
+func (r *Reporter) Update() Update {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u := Update{
+		Phase:          r.phase,
+		Current:        r.current,
+		Total:          r.total,
+		BytesPerSecond: int64(r.speed),
+	}
+	if r.speed > 0 && r.total > r.current {
+		u.ETA = time.Duration(float64(r.total-r.current) / r.speed * float64(time.Second)).Round(time.Second)
+	}
+	return u
+}
+
+// report calls the callback with the latest state. Taking the state after
+// callMu keeps reports from concurrent Set calls in order.
+func (r *Reporter) report() {
+	if r.callback == nil {
+		return
+	}
+	r.callMu.Lock()
+	defer r.callMu.Unlock()
+	r.callback(r.Update())
+}
@@ -0,0 +1,147 @@
+package progress
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// barWidth is the number of characters of the progress bar.
+const barWidth = 30
+
+// phaseLabels are the names of the phases on the terminal.
+var phaseLabels = map[Phase]string{
+	PhaseInit:     "Initializing",
+	PhaseDownload: "Downloading",
+	PhaseVerify:   "Verifying",
+	PhaseDecrypt:  "Decrypting",
+	PhaseExtract:  "Extracting",
+}
+
+// Terminal renders progress reports as a single line that is redrawn in
+// place, e.g.
+//
+//	Downloading [#########.....................]  31.2%  1.2/3.9 GiB  24.5 MiB/s  ETA 1m52s
+//
+// A new phase starts a new line.
+type Terminal struct {
+	w     io.Writer
+	mu    sync.Mutex
+	phase Phase
+	drawn bool
+	last  string
+}
+
+// NewTerminal returns a Terminal writing to w.
+func NewTerminal(w io.Writer) *Terminal {
+	return &Terminal{w: w}
+}
+
+// Update draws u, unless it looks the same as the line on the screen.
+func (t *Terminal) Update(u Update) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.drawn && u.Phase != t.phase {
+		fmt.Fprintln(t.w)
+		t.last = ""
+	}
+	t.phase = u.Phase
+	t.drawn = true
+
+	line := Format(u)
+	if line == t.last {
+		return
+	}
+	pad := ""
+	if n := len(t.last) - len(line); n > 0 {
+		pad = strings.Repeat(" ", n)
+	}
+	t.last = line
+	fmt.Fprintf(t.w, "\r%s%s", line, pad)
+}
+
+// Callback returns a function that draws the reports of a legacy
+// (current, max, bps) progress callback as phase.
+func (t *Terminal) Callback(phase Phase) func(current, max, bps int64) {
+	return func(current, max, bps int64) {
+		u := Update{Phase: phase, Current: current, Total: max, BytesPerSecond: bps}
+		if bps > 0 && max > current {
+			u.ETA = time.Duration(float64(max-current) / float64(bps) * float64(time.Second)).Round(time.Second)
+		}
+		t.Update(u)
+	}
+}
+
+// Done ends the current line, if anything has been drawn.
+func (t *Terminal) Done() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.drawn {
+		fmt.Fprintln(t.w)
+	}
+	t.drawn = false
+	t.last = ""
+}
+
+// Format renders u as one line without a line break.
+func Format(u Update) string {
+	label := phaseLabels[u.Phase]
+	if label == "" {
+		label = string(u.Phase)
+	}
+	if u.Total <= 0 {
+		line := fmt.Sprintf("%s %s", label, FormatBytes(u.Current))
+		if u.BytesPerSecond > 0 {
+			line += "  " + FormatBytes(u.BytesPerSecond) + "/s"
+		}
+		return line
+	}
+
+	filled := int(float64(barWidth) * float64(u.Current) / float64(u.Total))
+	filled = max(0, min(filled, barWidth))
+	bar := strings.Repeat("#", filled) + strings.Repeat(".", barWidth-filled)
+	line := fmt.Sprintf("%s [%s] %5.1f%%  %s/%s", label, bar, u.Percent(), formatAmount(u.Current, u.Total), FormatBytes(u.Total))
+	if u.BytesPerSecond > 0 {
+		line += "  " + FormatBytes(u.BytesPerSecond) + "/s"
+	}
+	if u.ETA > 0 {
+		line += "  ETA " + u.ETA.String()
+	}
+	return line
+}
+
+// units are the binary units of FormatBytes.
+var units = []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+// FormatBytes formats n bytes with a binary unit, e.g. "1.5 GiB".
+func FormatBytes(n int64) string {
+	value, unit := scale(n)
+	if unit == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// formatAmount formats n in the unit of total without the unit, so that
+// "1.2/3.9 GiB" reads naturally.
+func formatAmount(n, total int64) string {
+	_, unit := scale(total)
+	if unit == 0 {
+		return fmt.Sprint(n)
+	}
+	return fmt.Sprintf("%.1f", float64(n)/float64(int64(1)<<(10*unit)))
+}
+
+// scale returns n in its largest binary unit below 1024 and the index of
+// that unit.
+func scale(n int64) (float64, int) {
+	value := float64(n)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return value, unit
+}
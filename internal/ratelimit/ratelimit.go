@@ -0,0 +1,184 @@
+// Package ratelimit limits the bandwidth of downloads with token buckets
+// that can be shared between downloads and changed while they run.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxWait is the longest a waiting read sleeps before it looks at the
+// limit again, so that a changed limit takes effect quickly.
+const maxWait = 100 * time.Millisecond
+
+// readSize caps a single read through a limited Reader, so that slow limits
+// are not met with long bursts followed by long pauses.
+const readSize = 32 << 10
+
+// Global is the process-wide limit shared by all downloads. It is
+// unlimited until SetLimit is called.
+var Global = New(0)
+
+// Limiter is a token bucket refilled at a number of bytes per second. A
+// Limiter with a limit of 0 or less lets everything through. The zero
+// value is not usable; use New.
+type Limiter struct {
+	mu     sync.Mutex
+	limit  int64   // Bytes per second; <= 0 is unlimited
+	tokens float64 // May go negative while readers wait for their bytes
+	last   time.Time
+}
+
+// New returns a Limiter for bytesPerSecond. 0 means unlimited.
+func New(bytesPerSecond int64) *Limiter {
+	return &Limiter{limit: bytesPerSecond, last: time.Now()}
+}
+
+// Limit returns the current limit in bytes per second, 0 if unlimited.
+func (l *Limiter) Limit() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit < 0 {
+		return 0
+	}
+	return l.limit
+}
+
+// SetLimit changes the limit. Readers that are waiting pick up the new
+// limit within 100ms. 0 removes the limit.
+func (l *Limiter) SetLimit(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.limit = bytesPerSecond
+	if l.limit <= 0 {
+		l.tokens = 0
+	}
+}
+
+// refill adds the tokens earned since the last call, at most one second
+// worth of them.
+func (l *Limiter) refill(now time.Time) {
+	if l.limit > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.limit)
+		if burst := float64(l.limit); l.tokens > burst {
+			l.tokens = burst
+		}
+	}
+	l.last = now
+}
+
+// WaitN blocks until n bytes may pass or ctx is done. Concurrent callers
+// share the limit: each takes its bytes at once and waits until the
+// bucket has paid them back.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	l.refill(time.Now())
+	if l.limit <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	l.tokens -= float64(n)
+	for {
+		if l.limit <= 0 || l.tokens >= 0 {
+			l.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration(-l.tokens / float64(l.limit) * float64(time.Second))
+		l.mu.Unlock()
+
+		if wait > maxWait {
+			wait = maxWait
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		l.mu.Lock()
+		l.refill(time.Now())
+	}
+}
+
+// NewReader returns a Reader that reads from r no faster than every one
+// of limiters allows. Nil limiters are skipped.
+func NewReader(ctx context.Context, r io.Reader, limiters ...*Limiter) io.Reader {
+	active := make([]*Limiter, 0, len(limiters))
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+	if len(active) == 0 {
+		return r
+	}
+	return &reader{ctx: ctx, r: r, limiters: active}
+}
+
+type reader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > readSize {
+		p = p[:readSize]
+	}
+	n, err := r.r.Read(p)
+	for _, l := range r.limiters {
+		if waitErr := l.WaitN(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// units maps the suffixes accepted by ParseRate to their size in bytes.
+var units = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kb":  1000,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mb":  1000 * 1000,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gb":  1000 * 1000 * 1000,
+	"gib": 1 << 30,
+}
+
+// ParseRate parses a rate such as "20MiB/s", "500KB/s" or "1.5M" into
+// bytes per second. K, M and G without "B" are binary units, KB, MB and GB
+// decimal ones. "0" and "" mean unlimited.
+func ParseRate(s string) (int64, error) {
+	text := strings.ToLower(strings.TrimSpace(s))
+	text = strings.TrimSuffix(text, "/s")
+	if text == "" {
+		return 0, nil
+	}
+	i := strings.IndexFunc(text, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(text)
+	}
+	value, err := strconv.ParseFloat(text[:i], 64)
+	unit, ok := units[strings.TrimSpace(text[i:])]
+	if err != nil || !ok || value < 0 {
+		return 0, fmt.Errorf("invalid rate %q, expected e.g. 20MiB/s", s)
+	}
+	return int64(value * unit), nil
+}
@@ -1,14 +1,15 @@
 package request
 
 import (
-	"encoding/xml"
+	"context"
 	"fmt"
 	"strings"
 	"time"
 
 	"samsung-firmware-tool/internal/cryptutils"
 	"samsung-firmware-tool/internal/fusclient"
-	"samsung-firmware-tool/internal/util"
+	"samsung-firmware-tool/internal/fuserr"
+	"samsung-firmware-tool/internal/fusmsg"
 )
 
 // BinaryFileInfo represents information about a firmware binary file.
@@ -38,7 +39,8 @@ type VersionFetchResult struct {
 	RawOutput      string
 }
 
-// Custom error types
+// Custom error types. Each belongs to a fuserr class, so they also match
+// the fuserr sentinels with errors.Is.
 type VersionException struct {
 	Message string
 }
@@ -47,6 +49,9 @@ func (e *VersionException) Error() string {
 	return e.Message
 }
 
+func (e *VersionException) ErrorCode() fuserr.Code { return fuserr.CodeVersionMismatch }
+func (e *VersionException) Is(target error) bool   { return fuserr.Has(target, e.ErrorCode()) }
+
 type VersionCheckException struct {
 	Message string
 }
@@ -55,6 +60,9 @@ func (e *VersionCheckException) Error() string {
 	return e.Message
 }
 
+func (e *VersionCheckException) ErrorCode() fuserr.Code { return fuserr.CodeVersionCheck }
+func (e *VersionCheckException) Is(target error) bool   { return fuserr.Has(target, e.ErrorCode()) }
+
 type VersionMismatchException struct {
 	Message string
 }
@@ -63,6 +71,9 @@ func (e *VersionMismatchException) Error() string {
 	return e.Message
 }
 
+func (e *VersionMismatchException) ErrorCode() fuserr.Code { return fuserr.CodeVersionMismatch }
+func (e *VersionMismatchException) Is(target error) bool   { return fuserr.Has(target, e.ErrorCode()) }
+
 type NoBinaryFileError struct {
 	Model  string
 	Region string
@@ -72,6 +83,9 @@ func (e *NoBinaryFileError) Error() string {
 	return fmt.Sprintf("No binary file found for model %s, region %s", e.Model, e.Region)
 }
 
+func (e *NoBinaryFileError) ErrorCode() fuserr.Code { return fuserr.CodeNoBinary }
+func (e *NoBinaryFileError) Is(target error) bool   { return fuserr.Has(target, e.ErrorCode()) }
+
 // GetLogicCheck generates a logic-check for a given input.
 func GetLogicCheck(input, nonce string) string {
 	if len(input) < 16 {
@@ -92,16 +106,17 @@ func GetLogicCheck(input, nonce string) string {
 
 // performBinaryInformRetry performs a binary inform request with retries for multiple IMEI/Serial numbers.
 func PerformBinaryInformRetry(
+	ctx context.Context,
 	fw, model, region, imeiSerial string,
 	includeNonce bool,
 	client *fusclient.FusClient,
-) (string, *util.XMLNode, error) {
+) (string, *fusmsg.FUSMsg, error) {
 	splitImeiSerial := strings.FieldsFunc(imeiSerial, func(r rune) bool {
 		return r == '\n' || r == ';'
 	})
 
 	var latestRequest string
-	var latestResult *util.XMLNode
+	var latestResult *fusmsg.FUSMsg
 	var latestError error
 
 	for i, imei := range splitImeiSerial {
@@ -110,48 +125,46 @@ func PerformBinaryInformRetry(
 			continue
 		}
 
-		nonce, err := client.GetNonce()
-		if err != nil {
+		if _, err := client.GetNonce(ctx); err != nil {
+			if ctx.Err() != nil {
+				return latestRequest, latestResult, ctx.Err()
+			}
 			latestError = err
 			continue
 		}
 
-		latestRequest = CreateBinaryInform(fw, model, region, nonce, imei)
-
 		if i%10 == 0 {
-			time.Sleep(1 * time.Second) // Delay as in Kotlin code
+			// Delay as in Kotlin code
+			select {
+			case <-ctx.Done():
+				return latestRequest, latestResult, ctx.Err()
+			case <-time.After(1 * time.Second):
+			}
 		}
 
-		response, err := client.MakeReq(fusclient.BinaryInform, latestRequest, includeNonce)
+		response, err := client.MakeReqFunc(ctx, fusclient.BinaryInform, func(nonce string) string {
+			latestRequest = CreateBinaryInform(fw, model, region, nonce, imei)
+			return latestRequest
+		}, includeNonce)
 		// fmt.Println(response)
 		if err != nil {
+			if ctx.Err() != nil {
+				return latestRequest, latestResult, ctx.Err()
+			}
 			latestError = err
 			fmt.Printf("Error making request for IMEI %s: %v\n", imei, err)
 			continue
 		}
 
-		var fusMsg util.XMLNode
-		err = xml.Unmarshal([]byte(response), &fusMsg)
+		fusMsg, err := fusmsg.Parse([]byte(response))
 		if err != nil {
 			latestError = err
 			fmt.Printf("Error unmarshalling XML for IMEI %s: %v\n", imei, err)
 			continue
 		}
-		latestResult = &fusMsg
-
-		statusNode := util.FirstElementByTagName(
-			util.FirstElementByTagName(
-				util.FirstElementByTagName(latestResult, "FUSBody"),
-				"Results",
-			),
-			"Status",
-		)
-		status := ""
-		if statusNode != nil {
-			status = statusNode.Text()
-		}
+		latestResult = fusMsg
 
-		if status != "408" {
+		if latestResult.Status() != "408" {
 			return latestRequest, latestResult, nil
 		}
 	}
@@ -160,11 +173,7 @@ func PerformBinaryInformRetry(
 		return latestRequest, latestResult, latestError
 	}
 
-	return latestRequest, latestResult, fmt.Errorf("all IMEI/Serial attempts failed with status 408")
-}
-
-var dataNode = func(node string, data string) string {
-	return fmt.Sprintf("<%s><Data>%s</Data></%s>", node, strings.TrimSpace(data), node)
+	return latestRequest, latestResult, &fuserr.Error{Code: fuserr.CodeInvalidIMEI, Status: "408", Message: "all IMEI/Serial attempts failed with status 408"}
 }
 
 // CreateBinaryInform generates the XML needed to perform a binary inform.
@@ -188,75 +197,48 @@ func CreateBinaryInform(
 
 	logicCheck := GetLogicCheck(fw, nonce)
 
-	// Manually construct XML string
-	var xmlBuilder strings.Builder
-	xmlBuilder.WriteString("<FUSMsg>")
-	xmlBuilder.WriteString("<FUSHdr>")
-	xmlBuilder.WriteString("<ProtoVer>1.0</ProtoVer>")
-	xmlBuilder.WriteString("<SessionID>0</SessionID>")
-	xmlBuilder.WriteString("<MsgID>1</MsgID>")
-	xmlBuilder.WriteString("</FUSHdr>")
-	xmlBuilder.WriteString("<FUSBody>")
-	xmlBuilder.WriteString("<Put>")
-	xmlBuilder.WriteString(dataNode("ACCESS_MODE", "2"))
-	xmlBuilder.WriteString(dataNode("BINARY_NATURE", "1"))
-	xmlBuilder.WriteString(dataNode("CLIENT_PRODUCT", "Smart Switch"))
-	xmlBuilder.WriteString(dataNode("CLIENT_VERSION", "4.3.23123_1"))
-	xmlBuilder.WriteString(dataNode("DEVICE_IMEI_PUSH", imeiSerial))
-	xmlBuilder.WriteString(dataNode("DEVICE_FW_VERSION", fw))
-	xmlBuilder.WriteString(dataNode("DEVICE_LOCAL_CODE", region))
-	xmlBuilder.WriteString(dataNode("DEVICE_AID_CODE", region))
-	xmlBuilder.WriteString(dataNode("DEVICE_MODEL_NAME", model))
-	xmlBuilder.WriteString(dataNode("LOGIC_CHECK", logicCheck))
-	xmlBuilder.WriteString(dataNode("DEVICE_CONTENTS_DATA_VERSION", data))
-	xmlBuilder.WriteString(dataNode("DEVICE_CSC_CODE2_VERSION", csc))
-	xmlBuilder.WriteString(dataNode("DEVICE_PDA_CODE1_VERSION", pda))
-	xmlBuilder.WriteString(dataNode("DEVICE_PHONE_FONT_VERSION", phone))
-	xmlBuilder.WriteString("<CLIENT_LANGUAGE>")
-	xmlBuilder.WriteString("<Type>String</Type>")
-	xmlBuilder.WriteString("<Type>ISO 3166-1-alpha-3</Type>")
-	xmlBuilder.WriteString("<Data>1033</Data>")
-	xmlBuilder.WriteString("</CLIENT_LANGUAGE>")
+	put := &fusmsg.Put{
+		AccessMode:                fusmsg.NewField("2"),
+		BinaryNature:              fusmsg.NewField("1"),
+		ClientProduct:             fusmsg.NewField("Smart Switch"),
+		ClientVersion:             fusmsg.NewField("4.3.23123_1"),
+		DeviceImeiPush:            fusmsg.NewField(imeiSerial),
+		DeviceFwVersion:           fusmsg.NewField(fw),
+		DeviceLocalCode:           fusmsg.NewField(region),
+		DeviceAidCode:             fusmsg.NewField(region),
+		DeviceModelName:           fusmsg.NewField(model),
+		LogicCheck:                fusmsg.NewField(logicCheck),
+		DeviceContentsDataVersion: fusmsg.NewField(data),
+		DeviceCscCode2Version:     fusmsg.NewField(csc),
+		DevicePdaCode1Version:     fusmsg.NewField(pda),
+		DevicePhoneFontVersion:    fusmsg.NewField(phone),
+		ClientLanguage: &fusmsg.Field{
+			Type: []string{"String", "ISO 3166-1-alpha-3"},
+			Data: "1033",
+		},
+	}
 
 	// Some regions need extra properties specified.
 	// TODO: Make these settable in the UI?
-	var cc, mcc, mnc *string
 	switch region {
 	case "EUX":
-		c := "DE"
-		mccVal := "262"
-		mncVal := "01"
-		cc = &c
-		mcc = &mccVal
-		mnc = &mncVal
+		put.DeviceCcCode = fusmsg.NewField("DE")
+		put.MccNum = fusmsg.NewField("262")
+		put.MncNum = fusmsg.NewField("01")
 	case "EUY":
-		c := "RS"
-		mccVal := "220"
-		mncVal := "01"
-		cc = &c
-		mcc = &mccVal
-		mnc = &mncVal
+		put.DeviceCcCode = fusmsg.NewField("RS")
+		put.MccNum = fusmsg.NewField("220")
+		put.MncNum = fusmsg.NewField("01")
 	}
 
-	if cc != nil {
-		xmlBuilder.WriteString(dataNode("DEVICE_CC_CODE", *cc))
-	}
-	if mcc != nil {
-		xmlBuilder.WriteString(dataNode("MCC_NUM", *mcc))
-	}
-	if mnc != nil {
-		xmlBuilder.WriteString(dataNode("MNC_NUM", *mnc))
+	msg := &fusmsg.FUSMsg{
+		Hdr: &fusmsg.FUSHdr{ProtoVer: "1.0", SessionID: "0", MsgID: "1"},
+		Body: fusmsg.FUSBody{
+			Put: put,
+			Get: &fusmsg.Get{CmdID: "2", LatestFwVersion: &fusmsg.Empty{}},
+		},
 	}
-
-	xmlBuilder.WriteString("</Put>")
-	xmlBuilder.WriteString("<Get>")
-	xmlBuilder.WriteString("<CmdID>2</CmdID>")
-	xmlBuilder.WriteString("<LATEST_FW_VERSION/>")
-	xmlBuilder.WriteString("</Get>")
-	xmlBuilder.WriteString("</FUSBody>")
-	xmlBuilder.WriteString("</FUSMsg>")
-
-	return xmlBuilder.String()
+	return msg.String()
 }
 
 // CreateBinaryInit generates the XML needed to perform a binary init.
@@ -267,39 +249,36 @@ func CreateBinaryInit(fileName, nonce string) string {
 		// This logic seems a bit off in Kotlin, 16 % this.length would be 0 if length is a multiple of 16,
 		// resulting in slice(length..lastIndex) which is empty.
 		// Assuming it means the last 16 characters if length >= 16, otherwise the whole string.
-		if len(fileName) >= 16 {
-			split0 := strings.Split(fileName, ".")[0]
+		if split0 := strings.Split(fileName, ".")[0]; len(split0) >= 16 {
 			special = split0[len(split0)-16:]
 		}
 	}
 
 	logicCheck := GetLogicCheck(special, nonce)
 
-	var xmlBuilder strings.Builder
-	xmlBuilder.WriteString("<FUSMsg>")
-	xmlBuilder.WriteString("<FUSHdr>")
-	xmlBuilder.WriteString("<ProtoVer>1.0</ProtoVer>")
-	xmlBuilder.WriteString("</FUSHdr>")
-	xmlBuilder.WriteString("<FUSBody>")
-	xmlBuilder.WriteString("<Put>")
-	xmlBuilder.WriteString(dataNode("BINARY_FILE_NAME", fileName))
-	xmlBuilder.WriteString(dataNode("LOGIC_CHECK", logicCheck))
-	xmlBuilder.WriteString("</Put>")
-	xmlBuilder.WriteString("</FUSBody>")
-	xmlBuilder.WriteString("</FUSMsg>")
-
-	return xmlBuilder.String()
+	msg := &fusmsg.FUSMsg{
+		Hdr: &fusmsg.FUSHdr{ProtoVer: "1.0"},
+		Body: fusmsg.FUSBody{
+			Put: &fusmsg.Put{
+				BinaryFileName: fusmsg.NewField(fileName),
+				LogicCheck:     fusmsg.NewField(logicCheck),
+			},
+		},
+	}
+	return msg.String()
 }
 
 // RetrieveBinaryFileInfo retrieves the file information for a given firmware.
+// The info is nil whenever an error is returned.
 func RetrieveBinaryFileInfo(
+	ctx context.Context,
 	fw, model, region, imeiSerial string,
 	client *fusclient.FusClient,
 	onFinish func(string),
 	onVersionException func(error, *BinaryFileInfo),
 	shouldReportError func(error) bool,
-) *BinaryFileInfo {
-	result := GetBinaryFile(fw, model, region, imeiSerial, client)
+) (*BinaryFileInfo, error) {
+	result := GetBinaryFile(ctx, fw, model, region, imeiSerial, client)
 
 	info := result.Info
 	err := result.Error
@@ -309,7 +288,6 @@ func RetrieveBinaryFileInfo(
 	if err != nil {
 		if _, ok := err.(*VersionException); ok && onVersionException != nil {
 			onVersionException(err, info)
-			return nil
 		} else {
 			onFinish(fmt.Sprintf("%s\n\n%s", err.Error(), output))
 			// TODO: Implement isReportableCode and CrossPlatformBugsnag equivalent
@@ -318,17 +296,19 @@ func RetrieveBinaryFileInfo(
 			// 	CrossPlatformBugsnag.notify(DownloadError(requestBody, output, err))
 			// }
 		}
+		return nil, err
 	}
 
-	return info
+	return info, nil
 }
 
 // GetBinaryFile retrieves the file information for a given firmware.
 func GetBinaryFile(
+	ctx context.Context,
 	fw, model, region, imeiSerial string,
 	client *fusclient.FusClient,
 ) *FetchResultGetBinaryFileResult {
-	requestBody, responseXMLNode, err := PerformBinaryInformRetry(fw, model, region, imeiSerial, false, client)
+	requestBody, response, err := PerformBinaryInformRetry(ctx, fw, model, region, imeiSerial, false, client)
 	if err != nil {
 		return &FetchResultGetBinaryFileResult{
 			Error:       err,
@@ -337,40 +317,14 @@ func GetBinaryFile(
 		}
 	}
 
-	statusNode := util.FirstElementByTagName(
-		util.FirstElementByTagName(
-			util.FirstElementByTagName(responseXMLNode, "FUSBody"),
-			"Results",
-		),
-		"Status",
-	)
-	status := ""
-	if statusNode != nil {
-		status = statusNode.Text()
-	}
-
-	if status == "F01" {
-		return &FetchResultGetBinaryFileResult{
-			Error:        fmt.Errorf("invalid firmware error"), // TODO: Use proper error message from resources
-			RawOutput:    responseXMLNode.Text(),
-			RequestBody:  requestBody,
-			ResponseCode: status,
-		}
-	}
-
-	if status == "408" {
-		return &FetchResultGetBinaryFileResult{
-			Error:        fmt.Errorf("invalid IMEI or serial"), // TODO: Use proper error message from resources
-			RawOutput:    responseXMLNode.Text(),
-			RequestBody:  requestBody,
-			ResponseCode: status,
-		}
-	}
+	status := response.Status()
 
+	// F01 (invalid firmware), 408 (invalid IMEI or serial) and any other
+	// status become a fuserr.Error with the matching code.
 	if status != "200" {
 		return &FetchResultGetBinaryFileResult{
-			Error:        fmt.Errorf("bad return status: %s", status), // TODO: Use proper error message from resources
-			RawOutput:    responseXMLNode.Text(),
+			Error:        fuserr.FUSStatus(status),
+			RawOutput:    response.Raw,
 			RequestBody:  requestBody,
 			ResponseCode: status,
 		}
@@ -379,74 +333,34 @@ func GetBinaryFile(
 	noBinaryError := func() *FetchResultGetBinaryFileResult {
 		return &FetchResultGetBinaryFileResult{
 			Error:        &NoBinaryFileError{Model: model, Region: region},
-			RawOutput:    responseXMLNode.Text(),
+			RawOutput:    response.Raw,
 			RequestBody:  requestBody,
 			ResponseCode: status,
 		}
 	}
 
-	sizeStr := util.FirstElementByTagName(util.FirstElementByTagName(
-		util.FirstElementByTagName(
-			util.FirstElementByTagName(responseXMLNode, "FUSBody"),
-			"Put",
-		),
-		"BINARY_BYTE_SIZE",
-	), "Data")
-	size := int64(0)
-	if sizeStr == nil || sizeStr.Text() == "" {
+	put := response.Put()
+
+	size, ok := put.BinarySize()
+	if !ok {
 		return noBinaryError()
 	}
-	fmt.Sscanf(sizeStr.Text(), "%d", &size)
-
-	fileNameNode := util.FirstElementByTagName(util.FirstElementByTagName(
-		util.FirstElementByTagName(
-			util.FirstElementByTagName(responseXMLNode, "FUSBody"),
-			"Put",
-		),
-		"BINARY_NAME",
-	), "Data")
-	fileName := ""
-	if fileNameNode == nil || fileNameNode.Text() == "" {
+
+	fileName := put.BinaryName.Value()
+	if fileName == "" {
 		return noBinaryError()
 	}
-	fileName = fileNameNode.Text()
 
 	generateInfo := func() *BinaryFileInfo {
-		pathNode := util.FirstElementByTagName(util.FirstElementByTagName(
-			util.FirstElementByTagName(
-				util.FirstElementByTagName(responseXMLNode, "FUSBody"),
-				"Put",
-			),
-			"MODEL_PATH",
-		), "Data")
-		path := ""
-		if pathNode != nil {
-			path = pathNode.Text()
-		}
-
-		crc32Node := util.FirstElementByTagName(util.FirstElementByTagName(
-			util.FirstElementByTagName(
-				util.FirstElementByTagName(responseXMLNode, "FUSBody"),
-				"Put",
-			),
-			"BINARY_CRC",
-		), "Data")
-		crc32Val := uint32(0)
-		if crc32Node != nil && crc32Node.Text() != "" {
-			fmt.Sscanf(crc32Node.Text(), "%d", &crc32Val)
-		}
+		crc32Val, _ := put.BinaryCRC32()
 
 		// Kotlin code calls CryptUtils.getV4Key here if extractV4Key returns null.
 		// This would create a circular dependency if CryptUtils also calls Request.
 		// For now, we'll just use extractV4Key. If it's null, V4Key will be nil.
-		v4Key, v4KeyStr := ExtractV4Key(responseXMLNode)
-		if v4Key == nil {
-			// TODO: Potentially call CryptUtils.GetV4Key here, but need to break circular dependency.
-			// For now, leave it nil.
-		}
+		v4Key, v4KeyStr := ExtractV4Key(response)
 
 		return &BinaryFileInfo{
-			Path:     path,
+			Path:     put.ModelPath.Value(),
 			FileName: fileName,
 			Size:     size,
 			CRC32:    crc32Val,
@@ -455,25 +369,14 @@ func GetBinaryFile(
 		}
 	}
 
-	dataKeys := []string{
-		"DEVICE_USER_DATA_FILE",
-		"DEVICE_BOOT_FILE",
-		"DEVICE_PDA_CODE1_FILE",
-	}
-
 	var dataFile string
-	for _, key := range dataKeys {
-		node := util.FirstElementByTagName(
-			util.FirstElementByTagName(
-				util.FirstElementByTagName(
-					util.FirstElementByTagName(responseXMLNode, "FUSBody"),
-					"Put",
-				),
-				key,
-			), "Data")
-
-		if node != nil && node.Text() != "" {
-			dataFile = node.Text()
+	for _, field := range []*fusmsg.Field{
+		put.DeviceUserDataFile,
+		put.DeviceBootFile,
+		put.DevicePdaCode1File,
+	} {
+		if v := field.Value(); v != "" {
+			dataFile = v
 			break
 		}
 	}
@@ -545,28 +448,11 @@ func GetBinaryFile(
 		versionSuffix = dataFileSplit[*dataIndex+1]
 	}
 
-	cscFileNode := util.FirstElementByTagName(
-		util.FirstElementByTagName(
-			util.FirstElementByTagName(responseXMLNode, "FUSBody"),
-			"Put",
-		),
-		"DEVICE_CSC_HOME_FILE",
-	)
-	cscFile := ""
-	if cscFileNode != nil {
-		cscFile = cscFileNode.Text()
-	}
+	// The served CSC, CP and PDA come from the <Data> of their file names;
+	// without a file they fall back to the data file's version and suffix.
+	cscFile := put.DeviceCscHomeFile.Value()
 	if cscFile == "" {
-		cscFileNode = util.FirstElementByTagName(
-			util.FirstElementByTagName(
-				util.FirstElementByTagName(responseXMLNode, "FUSBody"),
-				"Put",
-			),
-			"DEVICE_CSC_FILE",
-		)
-		if cscFileNode != nil {
-			cscFile = cscFileNode.Text()
-		}
+		cscFile = put.DeviceCscFile.Value()
 	}
 
 	cscIndex := getIndex(cscFile)
@@ -581,17 +467,7 @@ func GetBinaryFile(
 		}
 	}
 
-	cpFileNode := util.FirstElementByTagName(
-		util.FirstElementByTagName(
-			util.FirstElementByTagName(responseXMLNode, "FUSBody"),
-			"Put",
-		),
-		"DEVICE_PHONE_FONT_FILE",
-	)
-	cpFile := ""
-	if cpFileNode != nil {
-		cpFile = cpFileNode.Text()
-	}
+	cpFile := put.DevicePhoneFontFile.Value()
 
 	cpIndex := getIndex(cpFile)
 	var servedCp, cpSuffix string
@@ -605,17 +481,7 @@ func GetBinaryFile(
 		}
 	}
 
-	pdaFileNode := util.FirstElementByTagName(
-		util.FirstElementByTagName(
-			util.FirstElementByTagName(responseXMLNode, "FUSBody"),
-			"Put",
-		),
-		"DEVICE_PDA_CODE1_FILE",
-	)
-	pdaFile := ""
-	if pdaFileNode != nil {
-		pdaFile = pdaFileNode.Text()
-	}
+	pdaFile := put.DevicePdaCode1File.Value()
 
 	pdaIndex := getIndex(pdaFile)
 	var servedPda string
@@ -680,31 +546,17 @@ func GetBinaryFile(
 }
 
 // ExtractV4Key extracts the V4 decryption key from the XML response.
-func ExtractV4Key(doc *util.XMLNode) ([]byte, string) {
-	fwVerNode := util.FirstElementByTagName(util.FirstElementByTagName(
-		util.FirstElementByTagName(
-			util.FirstElementByTagName(doc, "FUSBody"),
-			"Results",
-		),
-		"LATEST_FW_VERSION",
-	), "Data")
-	fwVer := ""
-	if fwVerNode != nil {
-		fwVer = fwVerNode.Text()
-	}
-
-	putNode := util.FirstElementByTagName(util.FirstElementByTagName(doc, "FUSBody"), "Put")
-	if putNode == nil {
+func ExtractV4Key(doc *fusmsg.FUSMsg) ([]byte, string) {
+	fwVer := doc.LatestFwVersion()
+
+	if doc == nil || doc.Body.Put == nil {
 		return nil, ""
 	}
+	put := doc.Body.Put
 
-	logicValNode := util.FirstElementByTagName(util.FirstElementByTagName(putNode, "LOGIC_VALUE_FACTORY"), "Data")
-	if logicValNode == nil {
-		logicValNode = util.FirstElementByTagName(util.FirstElementByTagName(putNode, "LOGIC_VALUE_HOME"), "Data")
-	}
-	logicVal := ""
-	if logicValNode != nil {
-		logicVal = logicValNode.Text()
+	logicVal := put.LogicValueFactory.Value()
+	if logicVal == "" {
+		logicVal = put.LogicValueHome.Value()
 	}
 
 	if fwVer != "" && logicVal != "" {
@@ -0,0 +1,77 @@
+package request_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"samsung-firmware-tool/internal/cassette"
+	"samsung-firmware-tool/internal/fusclient"
+	"samsung-firmware-tool/internal/fusmsg"
+	"samsung-firmware-tool/internal/request"
+)
+
+// TestGetBinaryFileReplay replays a recorded nonce and BinaryInform
+// exchange, for SM-S9110 in CHC, and checks GetBinaryFile's version
+// matching against it without network.
+func TestGetBinaryFileReplay(t *testing.T) {
+	tests := []struct {
+		name     string
+		fw       string
+		mismatch bool
+	}{
+		{"match", "S9110ZCU1AWA1/S9110CHC1AWA1/S9110ZCU1AWA1/S9110ZCU1AWA1", false},
+		{"older build", "S9110ZCU1AVL5/S9110CHC1AVL5/S9110ZCU1AVL5/S9110ZCU1AVL5", true},
+		{"other CSC", "S9110ZCU1AWA1/S9110CHC1AWA2/S9110ZCU1AWA1/S9110ZCU1AWA1", true},
+		{"other CP", "S9110ZCU1AWA1/S9110CHC1AWA1/S9110ZCU2AWA1/S9110ZCU1AWA1", true},
+		// The served CSC is the one in DEVICE_CSC_HOME_FILE, not the part
+		// after the version in the data file name.
+		{"data file suffix as CSC", "S9110ZCU1AWA1/CL1/S9110ZCU1AWA1/S9110ZCU1AWA1", true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			replayer, err := cassette.NewReplayer("testdata/binaryinform.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := fusclient.NewFusClientWithOptions(fusclient.Options{
+				HTTPClient: &http.Client{Transport: replayer},
+			})
+
+			result := request.GetBinaryFile(context.Background(), tt.fw, "SM-S9110", "CHC", "123456789012345", client)
+			var mismatch *request.VersionMismatchException
+			if got := errors.As(result.Error, &mismatch); got != tt.mismatch {
+				t.Fatalf("GetBinaryFile error = %v, want mismatch %v", result.Error, tt.mismatch)
+			}
+			if !tt.mismatch && result.Error != nil {
+				t.Fatalf("GetBinaryFile error = %v", result.Error)
+			}
+			if result.Info == nil || result.Info.FileName != "SM-S9110_CHC_S9110ZCU1AWA1_fac.zip.enc4" || result.Info.Size != 984128 {
+				t.Errorf("GetBinaryFile info = %+v", result.Info)
+			}
+			if n := replayer.Remaining(); n != 0 {
+				t.Errorf("%d recorded interactions were not replayed", n)
+			}
+		})
+	}
+}
+
+// TestExtractV4KeyHome checks that LOGIC_VALUE_HOME is used whenever
+// LOGIC_VALUE_FACTORY has no value, not only when it is missing.
+func TestExtractV4KeyHome(t *testing.T) {
+	const latest = "<Results><Status>200</Status><LATEST_FW_VERSION><Data>S9110ZCU1AWA1/S9110CHC1AWA1/S9110ZCU1AWA1/S9110ZCU1AWA1</Data></LATEST_FW_VERSION></Results>"
+	home := "<LOGIC_VALUE_HOME><Data>abcdefghijklmnop</Data></LOGIC_VALUE_HOME>"
+	for _, factory := range []string{"", "<LOGIC_VALUE_FACTORY/>", "<LOGIC_VALUE_FACTORY><Data/></LOGIC_VALUE_FACTORY>"} {
+		msg, err := fusmsg.Parse([]byte("<FUSMsg><FUSBody>" + latest + "<Put>" + factory + home + "</Put></FUSBody></FUSMsg>"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, str := request.ExtractV4Key(msg)
+		if want := request.GetLogicCheck("S9110ZCU1AWA1/S9110CHC1AWA1/S9110ZCU1AWA1/S9110ZCU1AWA1", "abcdefghijklmnop"); key == nil || str != want {
+			t.Errorf("with %q: ExtractV4Key = %x, %q, want the key of %q", factory, key, str, want)
+		}
+	}
+}
@@ -2,18 +2,14 @@ package util
 
 import (
 	"encoding/xml"
-	"net/http"
 	"strings"
 	"time"
+
+	"samsung-firmware-tool/internal/progress"
 )
 
 const DEFAULT_CHUNK_SIZE = 4096 // 4KB, Kotlin code uses 256KB for download, but 4KB for CRC32 check. Let's start with 4KB.
 
-// GlobalHttpClient is a shared HTTP client with infinite timeout.
-var GlobalHttpClient = &http.Client{
-	Timeout: 0, // No timeout
-}
-
 // XMLNode represents a generic XML element for parsing.
 type XMLNode struct {
 	XMLName  xml.Name
@@ -37,8 +33,12 @@ func (n *XMLNode) Text() string {
 	return strings.TrimSpace(string(n.Content))
 }
 
-// TrackOperationProgress is a placeholder for progress tracking.
-// In a real application, this would update a UI or log progress.
+// TrackOperationProgress runs operation while condition holds and reports
+// the bytes it returns, starting at progressOffset of size. bps is the
+// moving average of the speed of this run, so bytes done before
+// progressOffset do not count. With throttle the callback is called at most
+// every progress.DefaultInterval and once at the end, otherwise after
+// every operation.
 func TrackOperationProgress(
 	size int64,
 	progressCallback func(current, max, bps int64),
@@ -47,24 +47,24 @@ func TrackOperationProgress(
 	condition func() bool,
 	throttle bool,
 ) error {
-	var current int64 = progressOffset
-	startTime := time.Now()
+	interval := time.Duration(-1)
+	if throttle {
+		interval = progress.DefaultInterval()
+	}
+	reporter := progress.NewReporter(interval, func(u progress.Update) {
+		progressCallback(u.Current, u.Total, u.BytesPerSecond)
+	})
+	reporter.Start(progress.PhaseDownload, progressOffset, size)
+	if throttle {
+		defer reporter.Flush()
+	}
 
 	for condition() {
 		n, err := operation()
 		if err != nil {
 			return err
 		}
-		current += n
-
-		// Calculate bytes per second (bps)
-		elapsed := time.Since(startTime).Seconds()
-		var bps int64
-		if elapsed > 0 {
-			bps = int64(float64(current) / elapsed)
-		}
-
-		progressCallback(current, size, bps)
+		reporter.Add(n)
 
 		if n == 0 { // No more data read, break to prevent infinite loop
 			break
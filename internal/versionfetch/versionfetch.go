@@ -1,21 +1,29 @@
 package versionfetch
 
 import (
+	"context"
 	"encoding/xml"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
 
+	"samsung-firmware-tool/internal/fusclient"
+	"samsung-firmware-tool/internal/fuserr"
 	"samsung-firmware-tool/internal/request" // For FetchResult.VersionFetchResult
 	"samsung-firmware-tool/internal/util"
 )
 
 // GetLatestVersion gets the latest firmware version for a given model and region.
-func GetLatestVersion(model, region string) *request.VersionFetchResult {
-	url := fmt.Sprintf("https://fota-cloud-dn.ospserver.net:443/firmware/%s/%s/version.xml", region, model)
+func GetLatestVersion(ctx context.Context, model, region string) *request.VersionFetchResult {
+	return GetLatestVersionWithOptions(ctx, fusclient.DefaultOptions(), model, region)
+}
+
+// GetLatestVersionWithOptions is GetLatestVersion against the FOTA endpoint in opts.
+func GetLatestVersionWithOptions(ctx context.Context, opts fusclient.Options, model, region string) *request.VersionFetchResult {
+	url := opts.FotaEndpoint(fmt.Sprintf("firmware/%s/%s/version.xml", region, model))
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return &request.VersionFetchResult{
 			Error: err,
@@ -23,10 +31,10 @@ func GetLatestVersion(model, region string) *request.VersionFetchResult {
 	}
 	req.Header.Set("User-Agent", "Kies2.0_FUS")
 
-	resp, err := util.GlobalHttpClient.Do(req)
+	resp, err := opts.Client().Do(req)
 	if err != nil {
 		return &request.VersionFetchResult{
-			Error: err,
+			Error: fuserr.Wrap(fuserr.CodeNetwork, err, "network error"),
 		}
 	}
 	defer resp.Body.Close()
@@ -34,16 +42,27 @@ func GetLatestVersion(model, region string) *request.VersionFetchResult {
 	bodyBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return &request.VersionFetchResult{
-			Error: err,
+			Error: fuserr.Wrap(fuserr.CodeNetwork, err, "network error"),
 		}
 	}
 	body := string(bodyBytes)
 
+	if fuserr.IsBlockPage(body) {
+		return &request.VersionFetchResult{
+			Error:     &fuserr.Error{Code: fuserr.CodeBlocked, Status: resp.Status, Message: "request blocked by the server's firewall"},
+			RawOutput: body,
+		}
+	}
+
 	var responseXML util.XMLNode
 	err = xml.Unmarshal(bodyBytes, &responseXML)
 	if err != nil {
+		parseErr := fmt.Errorf("failed to parse XML response: %w", err)
+		if resp.StatusCode >= 500 {
+			parseErr = &fuserr.Error{Code: fuserr.CodeServer, Status: resp.Status, Message: "failed to parse XML response", Err: err}
+		}
 		return &request.VersionFetchResult{
-			Error:     fmt.Errorf("failed to parse XML response: %w", err),
+			Error:     parseErr,
 			RawOutput: body,
 		}
 	}
@@ -61,8 +80,17 @@ func GetLatestVersion(model, region string) *request.VersionFetchResult {
 			message = messageNode.Text()
 		}
 
+		errCode := fuserr.CodeBadStatus
+		switch {
+		case code == "NoSuchKey":
+			errCode = fuserr.CodeNotFound
+		case code == "AccessDenied":
+			errCode = fuserr.CodeAuth
+		case resp.StatusCode >= 500:
+			errCode = fuserr.CodeServer
+		}
 		return &request.VersionFetchResult{
-			Error:     fmt.Errorf("code: %s, message: %s", code, message),
+			Error:     &fuserr.Error{Code: errCode, Status: code, Message: fmt.Sprintf("code: %s, message: %s", code, message)},
 			RawOutput: body,
 		}
 	}
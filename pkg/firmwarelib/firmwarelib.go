@@ -55,7 +55,8 @@ typedef struct {
 } Dart_Callback_Handle;
 
 // A C function to post a message to Dart using the provided handle
-// type: 0 for progress update
+// type: 0 for progress update (current, max, bps)
+// type: 1 for a retry (attempt, max attempts, delay in milliseconds)
 static void post_dart_message_from_c(Dart_Callback_Handle* handle, int type, long current, long max, long bps) {
     if (handle == NULL || handle->post_c_object_fn == NULL || handle->send_port_id == 0) {
         return; // Callback handle not initialized or SendPort not set
@@ -120,11 +121,20 @@ static inline void callProgressCallback(progressCallback cb, long current, long
 */
 import "C"
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 	"unsafe"
 
 	"samsung-firmware-tool/cmd"
+	"samsung-firmware-tool/internal/cryptutils"
+	"samsung-firmware-tool/internal/fusclient"
+	"samsung-firmware-tool/internal/fuserr"
+	"samsung-firmware-tool/internal/progress"
+	"samsung-firmware-tool/internal/ratelimit"
 	"samsung-firmware-tool/internal/versionfetch"
 )
 
@@ -132,10 +142,110 @@ import (
 type Result struct {
 	Success bool        `json:"success"`
 	Message string      `json:"message"`
+	Code    string      `json:"code,omitempty"` // fuserr code of a failure, e.g. "FUS_408"
 	Data    interface{} `json:"data,omitempty"`
 }
 
-var downloadManagerMap = make(map[string]*cmd.DownloadTask)
+var (
+	managerOnce sync.Once
+	manager     *cmd.DownloadManager
+	managerErr  error
+
+	callbacksMu sync.Mutex
+	callbacks   = make(map[string]*C.Dart_Callback_Handle) // Progress callback by job ID
+
+	callsMu sync.Mutex
+	calls   = make(map[string]context.CancelFunc) // Cancels a running call by its ID
+)
+
+// errCallExists is returned for a call whose ID is already in use.
+var errCallExists = errors.New("a call with this ID is already running")
+
+// downloadManager returns the manager that runs all downloads of the
+// library, starting it on first use. Its queue is kept in
+// cmd.DefaultLibraryQueueFile(), so downloads that were queued, running or
+// paused when the process ended come back the next time it is used.
+func downloadManager() (*cmd.DownloadManager, error) {
+	managerOnce.Do(func() {
+		manager, managerErr = cmd.NewDownloadManager(cmd.DefaultLibraryQueueFile(), 0)
+		if managerErr != nil {
+			return
+		}
+		newTask := manager.NewTask
+		manager.NewTask = func(job cmd.Job, client *fusclient.FusClient) *cmd.DownloadTask {
+			task := newTask(job, client)
+			task.OnRetry = func(event fusclient.RetryEvent) {
+				if handle := callback(job.ID); handle != nil {
+					C.post_dart_message_from_c(handle, 1, C.long(event.Attempt), C.long(event.MaxAttempts), C.long(event.Delay.Milliseconds()))
+				}
+			}
+			return task
+		}
+		manager.OnProgress = func(job cmd.Job) {
+			if handle := callback(job.ID); handle != nil {
+				C.post_dart_message_from_c(handle, 0, C.long(job.CurrentSize), C.long(job.TotalSize), C.long(job.BytesPerSecond))
+			}
+		}
+		manager.OnChange = func(job cmd.Job) {
+			if job.Status.Done() {
+				setCallback(job.ID, nil)
+			}
+		}
+		go manager.Run(context.Background())
+	})
+	return manager, managerErr
+}
+
+// callback returns the Dart callback of a job, or nil.
+func callback(id string) *C.Dart_Callback_Handle {
+	callbacksMu.Lock()
+	defer callbacksMu.Unlock()
+	return callbacks[id]
+}
+
+// setCallback sets or, with a nil handle, removes the Dart callback of a job.
+func setCallback(id string, handle *C.Dart_Callback_Handle) {
+	callbacksMu.Lock()
+	defer callbacksMu.Unlock()
+	if handle == nil {
+		delete(callbacks, id)
+		return
+	}
+	callbacks[id] = handle
+}
+
+// startCall returns the context of a blocking library call. A call with a
+// non-empty id can be cancelled by CancelCall until done is called.
+func startCall(id string) (ctx context.Context, done func(), err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if id == "" {
+		return ctx, cancel, nil
+	}
+	callsMu.Lock()
+	defer callsMu.Unlock()
+	if _, exists := calls[id]; exists {
+		cancel()
+		return nil, nil, errCallExists
+	}
+	calls[id] = cancel
+	return ctx, func() {
+		callsMu.Lock()
+		delete(calls, id)
+		callsMu.Unlock()
+		cancel()
+	}, nil
+}
+
+// resultJSON returns res as a C string.
+func resultJSON(res Result) *C.char {
+	jsonRes, _ := json.Marshal(res)
+	return C.CString(string(jsonRes))
+}
+
+// errorResult returns a failed Result for err.
+func errorResult(err error) *C.char {
+	return resultJSON(Result{Success: false, Message: err.Error(), Code: string(fuserr.CodeOf(err))})
+}
 
 //export NewDartCallbackHandle
 func NewDartCallbackHandle(sendPortID C.longlong, postCObjectPtr unsafe.Pointer) *C.Dart_Callback_Handle {
@@ -157,8 +267,18 @@ func FreeDartCallbackHandle(handle *C.Dart_Callback_Handle) {
 	}
 }
 
+// CheckFirmwareVersion looks up the latest firmware of a model and region.
+//
 //export CheckFirmwareVersion
 func CheckFirmwareVersion(modelC *C.char, regionC *C.char) *C.char {
+	return CheckFirmwareVersionWithID(nil, modelC, regionC)
+}
+
+// CheckFirmwareVersionWithID is CheckFirmwareVersion that CancelCall can
+// stop by callID while it runs.
+//
+//export CheckFirmwareVersionWithID
+func CheckFirmwareVersionWithID(callIDC *C.char, modelC *C.char, regionC *C.char) *C.char {
 	model := C.GoString(modelC)
 	region := C.GoString(regionC)
 
@@ -168,11 +288,17 @@ func CheckFirmwareVersion(modelC *C.char, regionC *C.char) *C.char {
 		return C.CString(string(jsonRes))
 	}
 
+	ctx, done, err := startCall(C.GoString(callIDC))
+	if err != nil {
+		return errorResult(err)
+	}
+	defer done()
+
 	fmt.Printf("Checking latest version for Model: %s, Region: %s\n", model, region)
-	result := versionfetch.GetLatestVersion(model, region)
+	result := versionfetch.GetLatestVersion(ctx, model, region)
 
 	if result.Error != nil {
-		res := Result{Success: false, Message: fmt.Sprintf("Error checking version: %v, Raw output: %s", result.Error, result.RawOutput)}
+		res := Result{Success: false, Message: fmt.Sprintf("Error checking version: %v, Raw output: %s", result.Error, result.RawOutput), Code: string(fuserr.CodeOf(result.Error))}
 		jsonRes, _ := json.Marshal(res)
 		return C.CString(string(jsonRes))
 	}
@@ -200,37 +326,213 @@ func DownloadFirmware(modelC *C.char, regionC *C.char, fwVersionC *C.char, imeiS
 		return C.CString(string(jsonRes))
 	}
 
-	/// 相同id不进入
-	taskId := model + region + fwVersion + imeiSerial + outputPath
-	if task, exists := downloadManagerMap[taskId]; exists {
-		if task.Status >= cmd.StatusInitializing && task.Status < cmd.StatusFailed {
-			res := Result{Success: false, Message: "下载中..."}
-			jsonRes, _ := json.Marshal(res)
-			return C.CString(string(jsonRes))
-		}
+	m, err := downloadManager()
+	if err != nil {
+		return errorResult(err)
+	}
+	job, err := m.Add(cmd.Job{Model: model, Region: region, FwVersion: fwVersion, ImeiSerial: imeiSerial, OutputPath: outputPath})
+	if errors.Is(err, cmd.ErrJobExists) {
+		res := Result{Success: false, Message: "下载中...", Data: job}
+		jsonRes, _ := json.Marshal(res)
+		return C.CString(string(jsonRes))
 	}
+	if err != nil {
+		return errorResult(err)
+	}
+	setCallback(job.ID, callbackHandle)
 
 	fmt.Printf("Downloading firmware %s for Model: %s, Region: %s to %s\n", fwVersion, model, region, outputPath)
-	progressCallback := func(current, max, bps int64) {
-		C.post_dart_message_from_c(callbackHandle, 0, C.long(current), C.long(max), C.long(bps))
+	job, err = m.Wait(context.Background(), job.ID)
+	if err != nil {
+		return errorResult(err)
 	}
+	switch job.Status {
+	case cmd.StatusFailed:
+		res := Result{Success: false, Message: job.Error, Code: string(job.Code)}
+		jsonRes, _ := json.Marshal(res)
+		return C.CString(string(jsonRes))
+	case cmd.StatusCancelled:
+		res := Result{Success: false, Message: "下载已取消", Data: job}
+		jsonRes, _ := json.Marshal(res)
+		return C.CString(string(jsonRes))
+	}
+
+	res := Result{Success: true, Message: "固件下载成功", Data: map[string]string{"filePath": outputPath + "/" + job.FileName}}
+	jsonRes, _ := json.Marshal(res)
+	return C.CString(string(jsonRes))
+}
 
-	task := cmd.NewDownloadTask(model, region, fwVersion, imeiSerial, outputPath, progressCallback)
-	downloadManagerMap[taskId] = task
-	err := task.Start()
-	if nil != err {
-		res := Result{Success: false, Message: err.Error()}
+// EnqueueDownload queues a download and returns at once with the job in
+// Data. Higher priorities start first. Progress and retries are posted to
+// callbackHandle like for DownloadFirmware.
+//
+//export EnqueueDownload
+func EnqueueDownload(modelC *C.char, regionC *C.char, fwVersionC *C.char, imeiSerialC *C.char, outputPathC *C.char, priority C.int, callbackHandle *C.Dart_Callback_Handle) *C.char {
+	m, err := downloadManager()
+	if err != nil {
+		return errorResult(err)
+	}
+	job, err := m.Add(cmd.Job{
+		Model:      C.GoString(modelC),
+		Region:     C.GoString(regionC),
+		FwVersion:  C.GoString(fwVersionC),
+		ImeiSerial: C.GoString(imeiSerialC),
+		OutputPath: C.GoString(outputPathC),
+		Priority:   int(priority),
+	})
+	if err != nil {
+		res := Result{Success: false, Message: err.Error(), Data: job}
 		jsonRes, _ := json.Marshal(res)
 		return C.CString(string(jsonRes))
 	}
+	setCallback(job.ID, callbackHandle)
+	return resultJSON(Result{Success: true, Message: "已加入下载队列", Data: job})
+}
 
-	res := Result{Success: true, Message: "固件下载成功", Data: map[string]string{"filePath": outputPath + "/" + task.FileName}}
+// PauseDownload pauses a queued or running download and keeps its partial
+// file.
+//
+//export PauseDownload
+func PauseDownload(idC *C.char) *C.char {
+	return updateJob(C.GoString(idC), "下载已暂停", func(m *cmd.DownloadManager, id string) error {
+		return m.Pause(id)
+	})
+}
+
+// ResumeDownload queues a paused, failed or cancelled download again.
+//
+//export ResumeDownload
+func ResumeDownload(idC *C.char) *C.char {
+	return updateJob(C.GoString(idC), "下载已恢复", func(m *cmd.DownloadManager, id string) error {
+		return m.Resume(id)
+	})
+}
+
+// CancelDownload cancels a download. A non-zero deleteFiles also removes
+// its partial file.
+//
+//export CancelDownload
+func CancelDownload(idC *C.char, deleteFiles C.int) *C.char {
+	return updateJob(C.GoString(idC), "下载已取消", func(m *cmd.DownloadManager, id string) error {
+		return m.Cancel(id, deleteFiles != 0)
+	})
+}
+
+// GetDownloadStatus returns the job with the given ID in Data.
+//
+//export GetDownloadStatus
+func GetDownloadStatus(idC *C.char) *C.char {
+	m, err := downloadManager()
+	if err != nil {
+		return errorResult(err)
+	}
+	job, ok := m.Job(C.GoString(idC))
+	if !ok {
+		return errorResult(cmd.ErrJobNotFound)
+	}
+	return resultJSON(Result{Success: true, Message: job.Status.String(), Data: job})
+}
+
+// ListDownloads returns all jobs in queue order in Data.
+//
+//export ListDownloads
+func ListDownloads() *C.char {
+	m, err := downloadManager()
+	if err != nil {
+		return errorResult(err)
+	}
+	return resultJSON(Result{Success: true, Message: "下载队列", Data: m.Jobs()})
+}
+
+// SetMaxConcurrentDownloads sets how many downloads run at the same time.
+//
+//export SetMaxConcurrentDownloads
+func SetMaxConcurrentDownloads(n C.int) *C.char {
+	m, err := downloadManager()
+	if err != nil {
+		return errorResult(err)
+	}
+	if err := m.SetConcurrency(int(n)); err != nil {
+		return errorResult(err)
+	}
+	return resultJSON(Result{Success: true, Message: "并发下载数已更新"})
+}
+
+// updateJob applies change to a job and returns the job in Data.
+func updateJob(id, message string, change func(m *cmd.DownloadManager, id string) error) *C.char {
+	m, err := downloadManager()
+	if err != nil {
+		return errorResult(err)
+	}
+	if err := change(m, id); err != nil {
+		return errorResult(err)
+	}
+	job, _ := m.Job(id)
+	return resultJSON(Result{Success: true, Message: message, Data: job})
+}
+
+// SetDownloadLimit changes the speed limit of a download in bytes per
+// second, also while it is running. The download is identified by the
+// arguments of DownloadFirmware.
+//
+//export SetDownloadLimit
+func SetDownloadLimit(modelC *C.char, regionC *C.char, fwVersionC *C.char, imeiSerialC *C.char, outputPathC *C.char, bytesPerSecond C.longlong) *C.char {
+	m, err := downloadManager()
+	if err != nil {
+		return errorResult(err)
+	}
+	job, exists := m.Find(C.GoString(modelC), C.GoString(regionC), C.GoString(fwVersionC), C.GoString(outputPathC))
+	if !exists {
+		res := Result{Success: false, Message: "错误: 下载任务不存在。"}
+		jsonRes, _ := json.Marshal(res)
+		return C.CString(string(jsonRes))
+	}
+	if err := m.SetRateLimit(job.ID, int64(bytesPerSecond)); err != nil {
+		return errorResult(err)
+	}
+
+	res := Result{Success: true, Message: "下载限速已更新"}
 	jsonRes, _ := json.Marshal(res)
 	return C.CString(string(jsonRes))
 }
 
+// SetGlobalDownloadLimit limits the combined speed of all downloads in
+// bytes per second. 0 removes the limit.
+//
+//export SetGlobalDownloadLimit
+func SetGlobalDownloadLimit(bytesPerSecond C.longlong) {
+	ratelimit.Global.SetLimit(int64(bytesPerSecond))
+}
+
+// SetProgressInterval sets the least time in milliseconds between two
+// progress messages of a download or decryption started afterwards.
+//
+//export SetProgressInterval
+func SetProgressInterval(milliseconds C.int) {
+	progress.SetDefaultInterval(time.Duration(milliseconds) * time.Millisecond)
+}
+
+// SetDecryptWorkers sets the number of threads that decrypt a firmware
+// file in parallel. 0 uses one per CPU.
+//
+//export SetDecryptWorkers
+func SetDecryptWorkers(workers C.int) {
+	cryptutils.SetDecryptWorkers(int(workers))
+}
+
+// DecryptFirmware decrypts a downloaded firmware file, posting the progress
+// to callbackHandle.
+//
 //export DecryptFirmware
 func DecryptFirmware(inputPathC *C.char, outputPathC *C.char, fwVersionC *C.char, modelC *C.char, regionC *C.char, imeiSerialC *C.char, callbackHandle *C.Dart_Callback_Handle) *C.char {
+	return DecryptFirmwareWithID(nil, inputPathC, outputPathC, fwVersionC, modelC, regionC, imeiSerialC, callbackHandle)
+}
+
+// DecryptFirmwareWithID is DecryptFirmware that CancelCall can stop by
+// callID while it runs. A cancelled decryption leaves no output file.
+//
+//export DecryptFirmwareWithID
+func DecryptFirmwareWithID(callIDC *C.char, inputPathC *C.char, outputPathC *C.char, fwVersionC *C.char, modelC *C.char, regionC *C.char, imeiSerialC *C.char, callbackHandle *C.Dart_Callback_Handle) *C.char {
 	inputPath := C.GoString(inputPathC)
 	outputPath := C.GoString(outputPathC)
 	fwVersion := C.GoString(fwVersionC)
@@ -244,14 +546,20 @@ func DecryptFirmware(inputPathC *C.char, outputPathC *C.char, fwVersionC *C.char
 		return C.CString(string(jsonRes))
 	}
 
+	ctx, done, err := startCall(C.GoString(callIDC))
+	if err != nil {
+		return errorResult(err)
+	}
+	defer done()
+
 	fmt.Printf("Decrypting %s to %s\n", inputPath, outputPath)
 
 	progressCallback := func(current, max, bps int64) {
 		C.post_dart_message_from_c(callbackHandle, 0, C.long(current), C.long(max), C.long(bps))
 	}
-	err := cmd.DecryptFirmware(inputPath, outputPath, fwVersion, model, region, imeiSerial, progressCallback)
+	err = cmd.DecryptFirmware(ctx, inputPath, outputPath, fwVersion, model, region, imeiSerial, progressCallback)
 	if err != nil {
-		res := Result{Success: false, Message: fmt.Sprintf("\nError decrypting file: %v", err)}
+		res := Result{Success: false, Message: fmt.Sprintf("\nError decrypting file: %v", err), Code: string(fuserr.CodeOf(err))}
 		jsonRes, _ := json.Marshal(res)
 		return C.CString(string(jsonRes))
 	}
@@ -262,6 +570,22 @@ func DecryptFirmware(inputPathC *C.char, outputPathC *C.char, fwVersionC *C.char
 	return C.CString(string(jsonRes))
 }
 
+// CancelCall cancels the running CheckFirmwareVersionWithID or
+// DecryptFirmwareWithID call with the given ID, which then returns a
+// failed Result. Downloads are cancelled with CancelDownload.
+//
+//export CancelCall
+func CancelCall(callIDC *C.char) *C.char {
+	callsMu.Lock()
+	cancel, ok := calls[C.GoString(callIDC)]
+	callsMu.Unlock()
+	if !ok {
+		return resultJSON(Result{Success: false, Message: "错误: 调用不存在或已结束。"})
+	}
+	cancel()
+	return resultJSON(Result{Success: true, Message: "调用已取消"})
+}
+
 // FreeString is a C-callable function to free memory allocated by C.CString
 // This is important to prevent memory leaks when C code calls Go functions
 // that return C strings.